@@ -1,16 +1,25 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 
+	"github.com/OneKonsole/web-service-billing/auth"
 	helpers "github.com/OneKonsole/web-service-billing/helpers"
 	paypalOrder "github.com/OneKonsole/web-service-billing/paypal"
+	"github.com/OneKonsole/web-service-billing/pricing"
+	"github.com/OneKonsole/web-service-billing/stripe"
 
+	"github.com/go-playground/validator"
 	"github.com/gorilla/mux"
 )
 
@@ -18,20 +27,112 @@ type App struct {
 	Router            *mux.Router
 	AppConf           *AppConf
 	OrderOrchestrator *paypalOrder.OrderOrchestrator
-	OrderInfos        *paypalOrder.PaypalOrderInfos
+	Store             paypalOrder.OrderStore
+	Prices            *pricing.CatalogStore
+	Taxes             *pricing.TaxTable
+	Coupons           *pricing.CouponBook
+	Validator         *validator.Validate
+	Verifier          *auth.Verifier
 }
 
 type AppConf struct {
-	ServedPort   string `json:"served_port"`           // e.g. "8010"
-	WebOrderURL  string `json:"web_order_service_url"` // e.g. "http://localhost:xxxx/order
-	ClientID     string
-	ClientSecret string
+	ServedPort        string        `json:"served_port"`              // e.g. "8010"
+	WebOrderURL       string        `json:"web_order_service_url"`    // e.g. "http://localhost:xxxx/order
+	WebOrderToken     string        `json:"web_order_callback_token"` // Sent by web-order in its provisioning reports
+	WebOrderTimeout   time.Duration `json:"web_order_timeout"`        // e.g. "30s"
+	ClientID          string
+	ClientSecret      string
+	PaypalEnvironment string        `json:"paypal_environment"` // "sandbox" or "live"
+	PaypalBaseURL     string        `json:"paypal_base_url"`    // e.g. "http://localhost:8090", overrides the environment URL
+	PaypalTimeout     time.Duration `json:"paypal_timeout"`     // e.g. "30s"
+	WebhookID         string        `json:"paypal_webhook_id"`
+	StripeSecretKey   string        `json:"stripe_secret_key"`
+	StripeSuccessURL  string        `json:"stripe_success_url"`     // e.g. "https://onekonsole.fr/order/paid?session={CHECKOUT_SESSION_ID}"
+	StripeCancelURL   string        `json:"stripe_cancel_url"`      // e.g. "https://onekonsole.fr/order"
+	PriceCatalogFile  string        `json:"price_catalog_file"`     // e.g. "/etc/web-billing/prices.json"
+	TaxTableFile      string        `json:"tax_table_file"`         // e.g. "/etc/web-billing/taxes.json"
+	VIESURL           string        `json:"vies_url"`               // e.g. "https://ec.europa.eu/taxation_customs/vies/rest-api/check-vat-number"
+	CouponsFile       string        `json:"coupons_file"`           // e.g. "/etc/web-billing/coupons.json"
+	OrderStorePath    string        `json:"order_store_path"`       // e.g. "/data/billing.db"
+	ApprovalTimeout   time.Duration `json:"order_approval_timeout"` // e.g. "30m"
+	OutboxMaxAttempts int           `json:"outbox_max_attempts"`    // e.g. 10
+	OutboxBaseDelay   time.Duration `json:"outbox_base_delay"`      // e.g. "5s"
+	OIDCJWKS          string        `json:"oidc_jwks"`              // JWKS file or URL, e.g. Keycloak ".../protocol/openid-connect/certs"
+	OIDCIssuer        string        `json:"oidc_issuer"`            // e.g. "https://keycloak.onekonsole.fr/realms/onekonsole"
+	OIDCAudience      string        `json:"oidc_audience"`          // e.g. "web-billing"
+	AdminRole         string        `json:"admin_role"`             // e.g. "billing-admin"
 }
 
 func (a *App) Initialize() {
 	fmt.Printf("[INFO] .... INITIALIZING APP ....\n")
 	a.Router = mux.NewRouter()
-	a.OrderOrchestrator = paypalOrder.NewOrderOchestrator()
+	a.Validator = helpers.NewValidator()
+
+	keys, err := auth.NewKeySet(a.AppConf.OIDCJWKS, &http.Client{Timeout: 10 * time.Second})
+	if err != nil {
+		log.Fatalf("[ERROR] Could not load signing keys: %s\n", err)
+	}
+	a.Verifier, err = auth.NewVerifier(keys, a.AppConf.OIDCIssuer, a.AppConf.OIDCAudience)
+	if err != nil {
+		log.Fatalf("[ERROR] Could not create token verifier: %s\n", err)
+	}
+
+	prices, err := pricing.NewCatalogStore(a.AppConf.PriceCatalogFile)
+	if err != nil {
+		log.Fatalf("[ERROR] Could not load price catalog: %s\n", err)
+	}
+	a.Prices = prices
+
+	taxes, err := pricing.LoadTaxTable(a.AppConf.TaxTableFile)
+	if err != nil {
+		log.Fatalf("[ERROR] Could not load tax table: %s\n", err)
+	}
+	taxes.UseVATChecker(pricing.NewVIESChecker(a.AppConf.VIESURL, &http.Client{Timeout: 10 * time.Second}))
+	a.Taxes = taxes
+
+	store, err := paypalOrder.NewBoltOrderStore(a.AppConf.OrderStorePath)
+	if err != nil {
+		log.Fatalf("[ERROR] Could not open order store: %s\n", err)
+	}
+	a.Store = store
+	go a.purgeIdempotencyKeys()
+
+	// Redemptions are counted in the order store, released with the orders ending unpaid
+	coupons, err := pricing.LoadCouponBook(a.AppConf.CouponsFile, store)
+	if err != nil {
+		log.Fatalf("[ERROR] Could not load coupons: %s\n", err)
+	}
+	a.Coupons = coupons
+
+	paypalClient, err := paypalOrder.NewClient(
+		a.AppConf.PaypalEnvironment,
+		a.AppConf.PaypalBaseURL,
+		a.AppConf.ClientID,
+		a.AppConf.ClientSecret,
+		&http.Client{Timeout: a.AppConf.PaypalTimeout})
+	if err != nil {
+		log.Fatalf("[ERROR] Could not configure Paypal client: %s\n", err)
+	}
+	fmt.Printf("[INFO] Using Paypal %s environment (%s)\n", paypalClient.Environment, paypalClient.BaseURL)
+	a.OrderOrchestrator = paypalOrder.NewOrderOchestrator(store, paypalClient, a.AppConf.ApprovalTimeout)
+	if a.AppConf.StripeSecretKey != "" {
+		a.OrderOrchestrator.RegisterProvider(stripe.NewClient(
+			a.AppConf.StripeSecretKey,
+			a.AppConf.StripeSuccessURL,
+			a.AppConf.StripeCancelURL,
+			&http.Client{Timeout: a.AppConf.PaypalTimeout}))
+		fmt.Printf("[INFO] Stripe payments enabled\n")
+	}
+
+	// Finish the orders that were pending when the service stopped
+	if err := a.OrderOrchestrator.ResumeOrders(); err != nil {
+		log.Fatalf("[ERROR] Could not resume pending orders: %s\n", err)
+	}
+	a.OrderOrchestrator.StartOutbox(a.AppConf.WebOrderURL, paypalOrder.OutboxSettings{
+		MaxAttempts: a.AppConf.OutboxMaxAttempts,
+		BaseDelay:   a.AppConf.OutboxBaseDelay,
+		HTTPClient:  &http.Client{Timeout: a.AppConf.WebOrderTimeout},
+	})
 	a.initializeRoutes()
 }
 
@@ -39,11 +140,85 @@ func (appConf *AppConf) Initialize() {
 	fmt.Printf("[INFO] .... INITIALIZING APP CONFIGURATIONS ....\n")
 	appConf.ServedPort = os.Getenv("served_port")
 	appConf.WebOrderURL = os.Getenv("web_order_service_url")
+	appConf.WebOrderToken = os.Getenv("web_order_callback_token")
 	appConf.ClientID = os.Getenv("paypal_client_id")
 	appConf.ClientSecret = os.Getenv("paypal_client_secret")
+	appConf.PaypalEnvironment = os.Getenv("paypal_environment")
+	appConf.PaypalBaseURL = os.Getenv("paypal_base_url")
+	appConf.WebhookID = os.Getenv("paypal_webhook_id")
+	appConf.StripeSecretKey = os.Getenv("stripe_secret_key")
+	appConf.StripeSuccessURL = os.Getenv("stripe_success_url")
+	appConf.StripeCancelURL = os.Getenv("stripe_cancel_url")
+	appConf.PriceCatalogFile = os.Getenv("price_catalog_file")
+	appConf.TaxTableFile = os.Getenv("tax_table_file")
+	appConf.VIESURL = os.Getenv("vies_url")
+	appConf.CouponsFile = os.Getenv("coupons_file")
+	appConf.OrderStorePath = os.Getenv("order_store_path")
+	appConf.OIDCJWKS = os.Getenv("oidc_jwks")
+	appConf.OIDCIssuer = os.Getenv("oidc_issuer")
+	appConf.OIDCAudience = os.Getenv("oidc_audience")
+	appConf.AdminRole = os.Getenv("admin_role")
+
+	if appConf.AdminRole == "" {
+		appConf.AdminRole = "billing-admin"
+	}
+
+	if appConf.OrderStorePath == "" {
+		appConf.OrderStorePath = "billing.db"
+	}
+
+	appConf.PaypalTimeout = paypalOrder.DefaultRequestTimeout
+	if timeout := os.Getenv("paypal_timeout"); timeout != "" {
+		paypalTimeout, err := time.ParseDuration(timeout)
+		if err != nil {
+			log.Fatalf("[ERROR] Invalid paypal_timeout %q: %s\n", timeout, err)
+		}
+		appConf.PaypalTimeout = paypalTimeout
+	}
+
+	appConf.WebOrderTimeout = paypalOrder.DefaultWebOrderTimeout
+	if timeout := os.Getenv("web_order_timeout"); timeout != "" {
+		webOrderTimeout, err := time.ParseDuration(timeout)
+		if err != nil || webOrderTimeout <= 0 {
+			log.Fatalf("[ERROR] Invalid web_order_timeout %q\n", timeout)
+		}
+		appConf.WebOrderTimeout = webOrderTimeout
+	}
+
+	if timeout := os.Getenv("order_approval_timeout"); timeout != "" {
+		approvalTimeout, err := time.ParseDuration(timeout)
+		if err != nil {
+			log.Fatalf("[ERROR] Invalid order_approval_timeout %q: %s\n", timeout, err)
+		}
+		appConf.ApprovalTimeout = approvalTimeout
+	}
+
+	if attempts := os.Getenv("outbox_max_attempts"); attempts != "" {
+		maxAttempts, err := strconv.Atoi(attempts)
+		if err != nil || maxAttempts < 1 {
+			log.Fatalf("[ERROR] Invalid outbox_max_attempts %q\n", attempts)
+		}
+		appConf.OutboxMaxAttempts = maxAttempts
+	}
+
+	if delay := os.Getenv("outbox_base_delay"); delay != "" {
+		baseDelay, err := time.ParseDuration(delay)
+		if err != nil {
+			log.Fatalf("[ERROR] Invalid outbox_base_delay %q: %s\n", delay, err)
+		}
+		appConf.OutboxBaseDelay = baseDelay
+	}
+
+	if appConf.StripeSecretKey != "" && (appConf.StripeSuccessURL == "" || appConf.StripeCancelURL == "") {
+		log.Fatal("[ERROR] stripe_success_url and stripe_cancel_url are required with stripe_secret_key\n")
+	}
 
 	if appConf.ServedPort == "" ||
 		appConf.WebOrderURL == "" ||
+		appConf.WebOrderToken == "" ||
+		appConf.OIDCJWKS == "" ||
+		appConf.OIDCIssuer == "" ||
+		appConf.OIDCAudience == "" ||
 		appConf.ClientSecret == "" ||
 		appConf.ClientID == "" {
 
@@ -72,11 +247,35 @@ func (a *App) Run() {
 }
 
 func (a *App) getPrices(w http.ResponseWriter, r *http.Request) {
-	fmt.Printf("[INFO] Default prices requested\n")
+	currency := r.URL.Query().Get("currency")
+	fmt.Printf("[INFO] Prices requested (currency: %s)\n", currency)
 
-	prices := helpers.NewPrices()
+	prices, err := a.Prices.Current().ForCurrency(currency)
+	if err != nil {
+		fmt.Printf("[ERROR] Could not get prices: %s\n", err)
+		helpers.RespondWithError(w, helpers.ValidationError(err.Error(), nil))
+		return
+	}
 
-	helpers.RespondWithJSON(w, http.StatusOK, prices)
+	helpers.RespondWithJSON(w, http.StatusOK, prices.PriceList())
+}
+
+func (a *App) reloadPrices(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("[INFO] Price catalog reload requested\n")
+
+	prices, err := a.Prices.Reload()
+	if err != nil {
+		fmt.Printf("[ERROR] Could not reload price catalog: %s\n", err)
+		helpers.RespondWithError(w, &helpers.Error{
+			Code:    helpers.CodeInternal,
+			Message: "Could not reload price catalog",
+			Details: err.Error(),
+			Err:     err,
+		})
+		return
+	}
+
+	helpers.RespondWithJSON(w, http.StatusOK, prices.PriceList())
 }
 
 func (a *App) validatePodHealth(w http.ResponseWriter, r *http.Request) {
@@ -89,42 +288,314 @@ func (a *App) approveOrder(w http.ResponseWriter, r *http.Request) {
 	parsedBody := make(map[string]string)
 
 	if err := decoder.Decode(&parsedBody); err != nil {
-		fmt.Printf("Invalid payload: %s", err)
+		fmt.Printf("[ERROR] Invalid payload: %s\n", err)
+		helpers.RespondWithError(w, helpers.ValidationError("Invalid payload", err.Error()))
+		return
+	}
+	if fieldErrors := a.validateApproval(parsedBody["order_id"]); len(fieldErrors) > 0 {
+		fmt.Printf("[ERROR] Invalid approval: %v\n", fieldErrors)
+		helpers.RespondWithError(w, helpers.ValidationError("Invalid payload", fieldErrors))
+		return
+	}
+	if err := a.authorizeOrder(r, parsedBody["order_id"]); err != nil {
+		helpers.RespondWithError(w, err)
+		return
 	}
-	fmt.Printf("[INFO] Approving order %s for user %s...\n",
-		string(parsedBody["order_id"]),
-		a.OrderInfos.Order.UserID)
 
-	a.OrderOrchestrator.ApproveOrder(string(parsedBody["order_id"]), w, r)
+	a.OrderOrchestrator.ApproveOrder(parsedBody["order_id"], w, r)
 }
 
-func (a *App) createOrder(w http.ResponseWriter, r *http.Request) {
+// ===========================================================================================================
+// Calculates the price of an order with the configured catalog, coupons and taxes,
+// in the currency requested by the client
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	orderInfos (*paypalOrder.PaypalOrderInfos) : Order requested by the client
+//
+// Returns:
+//
+//	(pricing.Quote) : Itemized price with net, tax and gross amounts
+//	(*helpers.Error) : Error to answer if the currency is not supported, the coupon
+//		can not be used, the customer tax information is invalid or can not be checked
+//
+// ===========================================================================================================
+func (a *App) calculateQuote(orderInfos *paypalOrder.PaypalOrderInfos) (pricing.Quote, *helpers.Error) {
+	var coupon *pricing.Coupon
+
+	if orderInfos.CouponCode != "" {
+		found, err := a.Coupons.Find(orderInfos.CouponCode, orderInfos.Order.UserID, time.Now())
+		if err != nil {
+			return pricing.Quote{}, quoteError("Could not check coupon", err)
+		}
+		coupon = found
+	}
+
+	catalog, err := a.Prices.Current().ForCurrency(orderInfos.CurrencyCode)
+	if err != nil {
+		return pricing.Quote{}, quoteError("Could not load price catalog", err)
+	}
+
+	quote, err := catalog.CalculatePrice(&orderInfos.Order, coupon)
+	if err != nil {
+		return pricing.Quote{}, quoteError("Could not calculate price", err)
+	}
+
+	if err := a.Taxes.Apply(&quote, orderInfos.Country, orderInfos.VATNumber); err != nil {
+		return pricing.Quote{}, quoteError("Could not calculate tax", err)
+	}
+
+	return quote, nil
+}
+
+// ===========================================================================================================
+// Converts an error of the pricing into the error answered to the client: invalid
+// order details are refused (400), coupons used up conflict with other orders (409),
+// VIES outages can be retried (503) and store errors are internal errors (500)
+//
+// Parameters:
+//
+//	message (string) : Message answered for internal errors
+//	err (error) : Error returned while pricing the order
+//
+// Returns:
+//
+//	(*helpers.Error) : Error to answer with
+//
+// ===========================================================================================================
+func quoteError(message string, err error) *helpers.Error {
+	switch {
+	case errors.Is(err, pricing.ErrCouponNotFound),
+		errors.Is(err, pricing.ErrCouponNotActive),
+		errors.Is(err, pricing.ErrCouponNotApplicable),
+		errors.Is(err, pricing.ErrUnsupportedCurrency),
+		errors.Is(err, pricing.ErrInvalidCustomerTax),
+		errors.Is(err, pricing.ErrUnregisteredVATNumber):
+		return &helpers.Error{Code: helpers.CodeValidation, Message: err.Error(), Err: err}
+	case errors.Is(err, pricing.ErrCouponExhausted),
+		errors.Is(err, pricing.ErrCouponUserLimit):
+		return helpers.ConflictError(err.Error(), err)
+	case errors.Is(err, pricing.ErrVATCheckUnavailable):
+		return helpers.UpstreamUnavailableError("VAT number can not be checked at the moment, retry later", err)
+	default:
+		return helpers.InternalError(message, err)
+	}
+}
+
+func (a *App) quoteOrder(w http.ResponseWriter, r *http.Request) {
+	var orderInfos paypalOrder.PaypalOrderInfos
 
 	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&orderInfos); err != nil {
+		fmt.Printf("[ERROR] Invalid payload: %s\n", err)
+		helpers.RespondWithError(w, helpers.ValidationError("Invalid payload", err.Error()))
+		return
+	}
+	// Quotes are made for the authenticated user only, e.g. to check their coupon redemptions
+	claims := auth.ClaimsFromContext(r.Context())
+	if orderInfos.Order.UserID == "" {
+		orderInfos.Order.UserID = claims.Subject
+	}
+	if orderInfos.Order.UserID != claims.Subject {
+		fmt.Printf("[ERROR] User %s tried to quote for user %s\n", claims.Subject, orderInfos.Order.UserID)
+		helpers.RespondWithError(w, helpers.ForbiddenError("user_id does not match the authenticated user"))
+		return
+	}
+	if fieldErrors := a.validateOrderInfos(&orderInfos); len(fieldErrors) > 0 {
+		fmt.Printf("[ERROR] Invalid quote request: %v\n", fieldErrors)
+		helpers.RespondWithError(w, helpers.ValidationError("Invalid payload", fieldErrors))
+		return
+	}
+
+	// At the moment, control plane will everytime be enabled
+	orderInfos.Order.HasControlPlane = true
+	quote, quoteErr := a.calculateQuote(&orderInfos)
+	if quoteErr != nil {
+		fmt.Printf("[ERROR] Could not calculate quote: %s\n", quoteErr)
+		helpers.RespondWithError(w, quoteErr)
+		return
+	}
+
+	fmt.Printf("[INFO] Quote requested by %s : %s %s\n",
+		orderInfos.Order.UserID,
+		quote.Gross,
+		quote.Gross.Currency)
+
+	helpers.RespondWithJSON(w, http.StatusOK, quote)
+}
+
+func (a *App) createOrder(w http.ResponseWriter, r *http.Request) {
+	// Every request works on its own order, handlers run concurrently
+	var orderInfos paypalOrder.PaypalOrderInfos
 
-	if err := decoder.Decode(&a.OrderInfos); err != nil {
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&orderInfos); err != nil {
 		fmt.Printf("[ERROR] Invalid payload: %s\n", err)
+		helpers.RespondWithError(w, helpers.ValidationError("Invalid payload", err.Error()))
+		return
+	}
+	// Orders are made for the authenticated user only
+	claims := auth.ClaimsFromContext(r.Context())
+	if orderInfos.Order.UserID == "" {
+		orderInfos.Order.UserID = claims.Subject
+	}
+	if orderInfos.Order.UserID != claims.Subject {
+		fmt.Printf("[ERROR] User %s tried to order for user %s\n", claims.Subject, orderInfos.Order.UserID)
+		helpers.RespondWithError(w, helpers.ForbiddenError("user_id does not match the authenticated user"))
+		return
+	}
+	if fieldErrors := a.validateOrderInfos(&orderInfos); len(fieldErrors) > 0 {
+		fmt.Printf("[ERROR] Invalid order: %v\n", fieldErrors)
+		helpers.RespondWithError(w, helpers.ValidationError("Invalid payload", fieldErrors))
+		return
 	}
 
 	// At the moment, control plane will everytime be enabled
-	a.OrderInfos.Order.HasControlPlane = true
+	orderInfos.Order.HasControlPlane = true
 	// Calculating the price based on order infos
-	price := helpers.CalculatePrice(&a.OrderInfos.Order)
-	a.OrderInfos.MaxAmountValue = strconv.Itoa(price)
-	fmt.Printf("\n[INFO] Order creation requested by %s\n   ---> Cluster name : %s\n   ---> Control plane : %s\n   ---> Monitoring : %s - %d Go\n   ---> Images storage : %d\n   ---> Alerting : %s\n   ---> Price calculated : (%d %s) \n\n",
-		a.OrderInfos.Order.UserID,
-		a.OrderInfos.Order.ClusterName,
-		strconv.FormatBool(a.OrderInfos.Order.HasControlPlane),
-		strconv.FormatBool(a.OrderInfos.Order.HasControlPlane),
-		a.OrderInfos.Order.MonitoringStorage,
-		a.OrderInfos.Order.ImageStorage,
-		strconv.FormatBool(a.OrderInfos.Order.HasControlPlane),
+	quote, quoteErr := a.calculateQuote(&orderInfos)
+	if quoteErr != nil {
+		fmt.Printf("[ERROR] Could not calculate order price: %s\n", quoteErr)
+		helpers.RespondWithError(w, quoteErr)
+		return
+	}
+	price := quote.Gross
+	orderInfos.Quote = quote
+	orderInfos.MaxAmountValue = price
+	orderInfos.CurrencyCode = price.Currency
+	fmt.Printf("\n[INFO] Order creation requested by %s\n   ---> Cluster name : %s\n   ---> Control plane : %s\n   ---> Monitoring : %s - %d Go\n   ---> Images storage : %d\n   ---> Alerting : %s\n   ---> Price calculated : (%s %s) \n\n",
+		orderInfos.Order.UserID,
+		orderInfos.Order.ClusterName,
+		strconv.FormatBool(orderInfos.Order.HasControlPlane),
+		strconv.FormatBool(orderInfos.Order.HasMonitoring),
+		orderInfos.Order.MonitoringStorage,
+		orderInfos.Order.ImageStorage,
+		strconv.FormatBool(orderInfos.Order.HasAlerting),
 		price,
-		a.OrderInfos.CurrencyCode,
+		price.Currency,
 	)
+	// Count the coupon redemption before creating the order, limits are checked again
+	if orderInfos.CouponCode != "" {
+		if err := a.Coupons.Redeem(orderInfos.CouponCode, orderInfos.Order.UserID, time.Now()); err != nil {
+			fmt.Printf("[ERROR] Could not redeem coupon %s: %s\n", orderInfos.CouponCode, err)
+			helpers.RespondWithError(w, quoteError("Could not redeem coupon", err))
+			return
+		}
+	}
+
 	// Call the actual method to manage the new order
-	a.OrderOrchestrator.CreateOrder(w, *a.OrderInfos, a.AppConf.ClientID, a.AppConf.ClientSecret, a.AppConf.WebOrderURL)
+	err := a.OrderOrchestrator.CreateOrder(w, orderInfos, providerIdempotencyKey(r))
+	// The redemption is only kept for a new order, not for a failed or replayed creation
+	if err != nil && orderInfos.CouponCode != "" {
+		if err := a.Coupons.Release(orderInfos.CouponCode, orderInfos.Order.UserID); err != nil {
+			fmt.Printf("[ERROR] Could not release coupon %s: %s\n", orderInfos.CouponCode, err)
+		}
+	}
+}
+
+func (a *App) refundOrder(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["id"]
+
+	var request paypalOrder.RefundRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&request); err != nil && err != io.EOF {
+		fmt.Printf("[ERROR] Invalid payload: %s\n", err)
+		helpers.RespondWithError(w, helpers.ValidationError("Invalid payload", err.Error()))
+		return
+	}
+	if err := a.authorizeOrder(r, orderID); err != nil {
+		helpers.RespondWithError(w, err)
+		return
+	}
+	fmt.Printf("[INFO] Refund of order %s requested\n", orderID)
+
+	a.OrderOrchestrator.RefundOrder(w, orderID, request)
+}
 
+func (a *App) getOrder(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["id"]
+
+	if err := a.authorizeOrder(r, orderID); err != nil {
+		helpers.RespondWithError(w, err)
+		return
+	}
+
+	a.OrderOrchestrator.GetOrder(w, orderID)
+}
+
+func (a *App) listOrders(w http.ResponseWriter, r *http.Request) {
+	filter, fieldErrors := a.parseOrderFilter(r.URL.Query())
+	if len(fieldErrors) > 0 {
+		fmt.Printf("[ERROR] Invalid order listing: %v\n", fieldErrors)
+		helpers.RespondWithError(w, helpers.ValidationError("Invalid query parameters", fieldErrors))
+		return
+	}
+	// Users only list their own orders, administrators list the orders of every user
+	if !a.isAdmin(r) {
+		subject := auth.ClaimsFromContext(r.Context()).Subject
+		if filter.UserID != "" && filter.UserID != subject {
+			fmt.Printf("[ERROR] User %s tried to list the orders of user %s\n", subject, filter.UserID)
+			helpers.RespondWithError(w, helpers.ForbiddenError("user_id does not match the authenticated user"))
+			return
+		}
+		filter.UserID = subject
+	}
+
+	a.OrderOrchestrator.ListOrders(w, filter)
+}
+
+func (a *App) reportProvisioning(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["id"]
+
+	var report paypalOrder.ProvisioningReport
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&report); err != nil {
+		fmt.Printf("[ERROR] Invalid payload: %s\n", err)
+		helpers.RespondWithError(w, helpers.ValidationError("Invalid payload", err.Error()))
+		return
+	}
+	fmt.Printf("[INFO] Provisioning of order %s reported\n", orderID)
+
+	a.OrderOrchestrator.ReportProvisioning(w, orderID, report)
+}
+
+// ===========================================================================================================
+// Only lets web-order call a route: the request must hold the shared
+// web_order_callback_token as a bearer token
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	next (http.HandlerFunc) : Route restricted to web-order
+//
+// Examples:
+//
+//	a.Router.HandleFunc("/order/{id}/provisioning", a.webOrderOnly(a.reportProvisioning))
+//
+// ===========================================================================================================
+func (a *App) webOrderOnly(next http.HandlerFunc) http.HandlerFunc {
+	expected := []byte("Bearer " + a.AppConf.WebOrderToken)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		received := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(received, expected) != 1 {
+			fmt.Printf("[ERROR] Unauthenticated call to %s\n", r.URL.Path)
+			helpers.RespondWithError(w, helpers.UnauthorizedError("Invalid web-order token"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (a *App) receivePaypalWebhook(w http.ResponseWriter, r *http.Request) {
+	a.OrderOrchestrator.HandleWebhook(w, r, a.AppConf.WebhookID)
 }
 
 // ===========================================================================================================
@@ -136,8 +607,21 @@ func (a *App) createOrder(w http.ResponseWriter, r *http.Request) {
 //
 // ===========================================================================================================
 func (a *App) initializeRoutes() {
+	a.Router.Use(withRequestID, withRecovery)
+
 	a.Router.HandleFunc("/", a.validatePodHealth).Methods("GET") // Method that only returns "ok" status for kube probes
-	a.Router.HandleFunc("/order/approve", a.approveOrder).Methods("POST")
-	a.Router.HandleFunc("/order/create", a.createOrder).Methods("POST")
+	// Order counters, but also the command line and memory stats of the service
+	a.Router.HandleFunc("/debug/vars", a.adminOnly(expvar.Handler().ServeHTTP)).Methods("GET")
+	a.Router.HandleFunc("/order/approve", a.authenticated(a.approveOrder)).Methods("POST")
+	a.Router.HandleFunc("/order/create", a.authenticated(a.idempotent(a.createOrder))).Methods("POST")
 	a.Router.HandleFunc("/order/prices", a.getPrices).Methods("GET")
+	a.Router.HandleFunc("/order/quote", a.authenticated(a.quoteOrder)).Methods("POST")
+	a.Router.HandleFunc("/order/{id}", a.authenticated(a.getOrder)).Methods("GET")
+	a.Router.HandleFunc("/orders", a.authenticated(a.listOrders)).Methods("GET")
+	a.Router.HandleFunc("/order/{id}/refund", a.authenticated(a.refundOrder)).Methods("POST")
+	a.Router.HandleFunc("/order/{id}/provisioning", a.webOrderOnly(a.reportProvisioning)).Methods("POST")
+	a.Router.HandleFunc("/admin/prices/reload", a.adminOnly(a.reloadPrices)).Methods("POST")
+	a.Router.HandleFunc("/admin/outbox/dead-letters", a.adminOnly(a.OrderOrchestrator.ListDeadLetters)).Methods("GET")
+	a.Router.HandleFunc("/admin/outbox/dead-letters/{id}/replay", a.adminOnly(a.OrderOrchestrator.ReplayDeadLetter)).Methods("POST")
+	a.Router.HandleFunc("/paypal/webhook", a.receivePaypalWebhook).Methods("POST")
 }
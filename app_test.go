@@ -0,0 +1,738 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OneKonsole/web-service-billing/auth"
+	helpers "github.com/OneKonsole/web-service-billing/helpers"
+	"github.com/OneKonsole/web-service-billing/payment"
+	paypalOrder "github.com/OneKonsole/web-service-billing/paypal"
+	"github.com/OneKonsole/web-service-billing/pricing"
+	"github.com/gorilla/mux"
+)
+
+// fakeProvider is a payment provider whose checkouts are approved as soon as they are created
+type fakeProvider struct {
+	mutex          sync.Mutex
+	amounts        map[string]pricing.Money // Amount of each checkout
+	byKey          map[string]string        // Checkout created for each idempotency key
+	authorizations map[string]int           // Authorizations requested for each checkout
+	captures       map[string]int           // Captures requested for each checkout
+}
+
+func newFakeProvider() *fakeProvider {
+	return &fakeProvider{
+		amounts:        make(map[string]pricing.Money),
+		byKey:          make(map[string]string),
+		authorizations: make(map[string]int),
+		captures:       make(map[string]int),
+	}
+}
+
+func (p *fakeProvider) Name() string {
+	return paypalOrder.ProviderName
+}
+
+func (p *fakeProvider) CreateCheckout(request payment.CheckoutRequest) (payment.Checkout, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	id, ok := p.byKey[request.IdempotencyKey]
+	if !ok || request.IdempotencyKey == "" {
+		id = fmt.Sprintf("FAKE-%d", len(p.amounts)+1)
+		p.amounts[id] = request.Amount
+		if request.IdempotencyKey != "" {
+			p.byKey[request.IdempotencyKey] = id
+		}
+	}
+	return payment.Checkout{ID: id, Provider: p.Name(), Status: "CREATED", ApprovalURL: "https://pay.example/" + id}, nil
+}
+
+func (p *fakeProvider) GetStatus(checkoutID string) (payment.Status, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	amount, ok := p.amounts[checkoutID]
+	if !ok {
+		return payment.Status{}, fmt.Errorf("unknown checkout %s", checkoutID)
+	}
+	return payment.Status{CheckoutID: checkoutID, ProviderStatus: "APPROVED", State: payment.StateApproved, Amount: amount}, nil
+}
+
+func (p *fakeProvider) Authorize(checkoutID string) (payment.Status, error) {
+	status, err := p.GetStatus(checkoutID)
+	if err != nil {
+		return status, err
+	}
+
+	p.mutex.Lock()
+	p.authorizations[checkoutID]++
+	p.mutex.Unlock()
+
+	status.State = payment.StateAuthorized
+	status.AuthorizationID = "AUTH-" + checkoutID
+	return status, nil
+}
+
+func (p *fakeProvider) Capture(checkoutID string) (payment.Status, error) {
+	p.mutex.Lock()
+	p.captures[checkoutID]++
+	p.mutex.Unlock()
+
+	return payment.Status{CheckoutID: checkoutID, State: payment.StateCaptured, CaptureID: "CAPTURE-" + checkoutID}, nil
+}
+
+func (p *fakeProvider) Refund(captureID string, amount *pricing.Money, reason string, idempotencyKey string) (payment.Refund, error) {
+	return payment.Refund{}, fmt.Errorf("not supported")
+}
+
+func (p *fakeProvider) Cancel(checkoutID string) error {
+	return nil
+}
+
+// Issuer and audience of the test tokens
+const (
+	testIssuer   = "https://keycloak.example/realms/onekonsole"
+	testAudience = "web-billing"
+)
+
+// Token sent by web-order in its provisioning reports
+const testWebOrderToken = "web-order-secret"
+
+// testSigner signs the tokens of the users with the key published in the test JWKS
+type testSigner struct {
+	key *rsa.PrivateKey
+}
+
+// newTestVerifier returns a verifier trusting the keys of a JWKS file, and the signer of its key
+func newTestVerifier(t *testing.T) (*auth.Verifier, *testSigner) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kid": "test",
+			"kty": "RSA",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwks, 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := auth.NewKeySet(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier, err := auth.NewVerifier(keys, testIssuer, testAudience)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return verifier, &testSigner{key: key}
+}
+
+// token returns a bearer token of a user, valid for an hour
+func (s *testSigner) token(t *testing.T, userID string) string {
+	t.Helper()
+	return s.sign(t, map[string]interface{}{
+		"sub": userID,
+		"iss": testIssuer,
+		"aud": testAudience,
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+}
+
+// adminToken returns a bearer token of a user with the administrator role of the test app
+func (s *testSigner) adminToken(t *testing.T, userID string) string {
+	t.Helper()
+	return s.sign(t, map[string]interface{}{
+		"sub":          userID,
+		"iss":          testIssuer,
+		"aud":          testAudience,
+		"exp":          time.Now().Add(time.Hour).Unix(),
+		"realm_access": map[string][]string{"roles": {"billing-admin"}},
+	})
+}
+
+// sign returns a token holding the given claims
+func (s *testSigner) sign(t *testing.T, tokenClaims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test"})
+	claims, _ := json.Marshal(tokenClaims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// newTestApp returns the service routes backed by a temporary order store and a fake payment provider
+func newTestApp(t *testing.T) (*httptest.Server, *App, *fakeProvider, *testSigner) {
+	t.Helper()
+	store := openTestStore(t)
+	verifier, signer := newTestVerifier(t)
+
+	prices, err := pricing.NewCatalogStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	taxes, err := pricing.LoadTaxTable("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	coupons, err := pricing.LoadCouponBook("", store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider := newFakeProvider()
+	orchestrator := paypalOrder.NewOrderOchestrator(store, nil, time.Minute)
+	orchestrator.RegisterProvider(provider)
+
+	a := &App{
+		Router:            mux.NewRouter(),
+		AppConf:           &AppConf{AdminRole: "billing-admin", WebOrderToken: testWebOrderToken},
+		OrderOrchestrator: orchestrator,
+		Store:             store,
+		Prices:            prices,
+		Taxes:             taxes,
+		Coupons:           coupons,
+		Validator:         helpers.NewValidator(),
+		Verifier:          verifier,
+	}
+	a.initializeRoutes()
+
+	server := httptest.NewServer(a.Router)
+	t.Cleanup(server.Close)
+	return server, a, provider, signer
+}
+
+// post sends a JSON body to a route of the service
+func post(t *testing.T, server *httptest.Server, path string, token string, idempotencyKey string, body string) (int, map[string]interface{}) {
+	req, err := http.NewRequest("POST", server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Error(err)
+		return 0, nil
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	res, err := server.Client().Do(req)
+	if err != nil {
+		t.Error(err)
+		return 0, nil
+	}
+	defer res.Body.Close()
+
+	var response map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&response)
+	return res.StatusCode, response
+}
+
+func TestConcurrentCreateAndApprove(t *testing.T) {
+	server, a, provider, signer := newTestApp(t)
+
+	const users = 20
+	var wg sync.WaitGroup
+	orderIDs := make([]string, users)
+
+	for i := 0; i < users; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			userID := fmt.Sprintf("00000000-0000-4000-8000-%012d", i)
+			token := signer.token(t, userID)
+			body := fmt.Sprintf(`{"order_details": {"user_id": %q, "cluster_name": "cluster-%d"}, "country": "FR"}`, userID, i)
+
+			// The same creation sent twice at once: one is processed, the other replayed or refused
+			created := make([]string, 2)
+			var creations sync.WaitGroup
+			for j := range created {
+				creations.Add(1)
+				go func(j int) {
+					defer creations.Done()
+					status, response := post(t, server, "/order/create", token, "create-order", body)
+					switch status {
+					case http.StatusOK:
+						created[j], _ = response["order_id"].(string)
+					case http.StatusConflict:
+					default:
+						t.Errorf("user %d: /order/create status = %d (%v)", i, status, response)
+					}
+				}(j)
+			}
+			creations.Wait()
+
+			orderID := created[0]
+			if orderID == "" {
+				orderID = created[1]
+			}
+			if orderID == "" || (created[1] != "" && created[1] != orderID) {
+				t.Errorf("user %d: created orders %q, want a single order", i, created)
+				return
+			}
+			orderIDs[i] = orderID
+
+			// The approval sent twice at once is only processed once
+			statuses := make(chan int, 2)
+			var approvals sync.WaitGroup
+			for j := 0; j < 2; j++ {
+				approvals.Add(1)
+				go func() {
+					defer approvals.Done()
+					status, _ := post(t, server, "/order/approve", token, "", fmt.Sprintf(`{"order_id": %q}`, orderID))
+					statuses <- status
+				}()
+			}
+			approvals.Wait()
+			close(statuses)
+
+			approved := 0
+			for status := range statuses {
+				switch status {
+				case http.StatusOK:
+					approved++
+				case http.StatusConflict:
+				default:
+					t.Errorf("user %d: /order/approve status = %d", i, status)
+				}
+			}
+			if approved != 1 {
+				t.Errorf("user %d: order %s approved %d times, want 1", i, orderID, approved)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i, orderID := range orderIDs {
+		if orderID == "" {
+			continue
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			order, err := a.Store.GetOrder(orderID)
+			if err != nil {
+				t.Fatalf("GetOrder(%s) error = %v", orderID, err)
+			}
+			if order.Status == paypalOrder.StatusProvisioningRequested {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("user %d: order %s is %s, want %s", i, orderID, order.Status, paypalOrder.StatusProvisioningRequested)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	if len(provider.amounts) != users {
+		t.Errorf("%d checkouts created, want %d", len(provider.amounts), users)
+	}
+	for orderID, count := range provider.authorizations {
+		if count != 1 {
+			t.Errorf("order %s authorized %d times, want 1", orderID, count)
+		}
+	}
+}
+
+func TestAuthenticatedRoutesCheckIssuerAndAudience(t *testing.T) {
+	server, _, _, signer := newTestApp(t)
+	userID := "00000000-0000-4000-8000-000000000001"
+
+	tests := []struct {
+		name       string
+		claims     map[string]interface{}
+		wantStatus int
+	}{
+		{name: "expected issuer and audience", wantStatus: http.StatusNotFound},
+		{name: "wrong issuer", claims: map[string]interface{}{"iss": "https://evil.example"}, wantStatus: http.StatusUnauthorized},
+		{name: "no issuer", claims: map[string]interface{}{"iss": nil}, wantStatus: http.StatusUnauthorized},
+		{name: "wrong audience", claims: map[string]interface{}{"aud": "another-service"}, wantStatus: http.StatusUnauthorized},
+		{name: "no audience", claims: map[string]interface{}{"aud": nil}, wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims := map[string]interface{}{
+				"sub": userID,
+				"iss": testIssuer,
+				"aud": testAudience,
+				"exp": time.Now().Add(time.Hour).Unix(),
+			}
+			for name, value := range test.claims {
+				if value == nil {
+					delete(claims, name)
+					continue
+				}
+				claims[name] = value
+			}
+
+			// The order is unknown: only an accepted token gets past the authentication
+			status, response := post(t, server, "/order/approve", signer.sign(t, claims), "", `{"order_id": "ORDER-1"}`)
+			if status != test.wantStatus {
+				t.Errorf("/order/approve status = %d (%v), want %d", status, response, test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestQuoteRequiresUser(t *testing.T) {
+	server, _, _, signer := newTestApp(t)
+	alice := "00000000-0000-4000-8000-000000000001"
+	mallory := "00000000-0000-4000-8000-000000000002"
+
+	tests := []struct {
+		name       string
+		token      string
+		userID     string
+		wantStatus int
+	}{
+		{name: "own quote", token: signer.token(t, alice), userID: alice, wantStatus: http.StatusOK},
+		{name: "user taken from the token", token: signer.token(t, alice), wantStatus: http.StatusOK},
+		{name: "quote of another user", token: signer.token(t, mallory), userID: alice, wantStatus: http.StatusForbidden},
+		{name: "no token", userID: alice, wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := fmt.Sprintf(`{"order_details": {"user_id": %q, "cluster_name": "cluster"}, "country": "FR"}`, test.userID)
+			status, response := post(t, server, "/order/quote", test.token, "", body)
+			if status != test.wantStatus {
+				t.Errorf("/order/quote status = %d (%v), want %d", status, response, test.wantStatus)
+			}
+		})
+	}
+}
+
+// failingRedemptions is a redemption store that can not be read
+type failingRedemptions struct{}
+
+func (failingRedemptions) CouponRedemptions(code string, userID string) (int, int, error) {
+	return 0, 0, fmt.Errorf("database not open")
+}
+
+func (failingRedemptions) RedeemCoupon(code string, userID string, check func(total int, byUser int) error) error {
+	return fmt.Errorf("database not open")
+}
+
+func (failingRedemptions) ReleaseCoupon(code string, userID string) error {
+	return fmt.Errorf("database not open")
+}
+
+// unreachableVIES is a VAT checker whose registry can not be reached
+type unreachableVIES struct{}
+
+func (unreachableVIES) IsRegistered(vatNumber string) (bool, error) {
+	return false, fmt.Errorf("could not reach VIES: timeout")
+}
+
+func TestQuoteErrors(t *testing.T) {
+	server, a, _, signer := newTestApp(t)
+	alice := "00000000-0000-4000-8000-000000000001"
+
+	coupons, _ := json.Marshal([]map[string]interface{}{
+		{"code": "LAUNCH", "type": "percentage", "value": "10", "max_per_user": 1},
+		{"code": "SUMMER", "type": "percentage", "value": "10", "valid_until": "2020-09-01T00:00:00Z"},
+	})
+	path := filepath.Join(t.TempDir(), "coupons.json")
+	if err := os.WriteFile(path, coupons, 0600); err != nil {
+		t.Fatal(err)
+	}
+	loadCoupons := func(redemptions pricing.RedemptionStore) *pricing.CouponBook {
+		book, err := pricing.LoadCouponBook(path, redemptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return book
+	}
+	if err := a.Store.RedeemCoupon("LAUNCH", alice, func(total int, byUser int) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	a.Taxes.UseVATChecker(unreachableVIES{})
+
+	tests := []struct {
+		name        string
+		redemptions pricing.RedemptionStore
+		details     string // Fields added to the order details
+		wantStatus  int
+		wantCode    helpers.ErrorCode
+	}{
+		{name: "unknown coupon", details: `"coupon_code": "UNKNOWN"`, wantStatus: http.StatusBadRequest, wantCode: helpers.CodeValidation},
+		{name: "expired coupon", details: `"coupon_code": "SUMMER"`, wantStatus: http.StatusBadRequest, wantCode: helpers.CodeValidation},
+		{name: "coupon used up", details: `"coupon_code": "LAUNCH"`, wantStatus: http.StatusConflict, wantCode: helpers.CodeConflict},
+		{
+			name: "redemptions can not be read", redemptions: failingRedemptions{}, details: `"coupon_code": "LAUNCH"`,
+			wantStatus: http.StatusInternalServerError, wantCode: helpers.CodeInternal,
+		},
+		{name: "invalid VAT number", details: `"country": "DE", "vat_number": "AT123456789"`, wantStatus: http.StatusBadRequest, wantCode: helpers.CodeValidation},
+		{name: "VIES unavailable", details: `"country": "DE", "vat_number": "DE123456789"`, wantStatus: http.StatusServiceUnavailable, wantCode: helpers.CodeUpstreamUnavailable},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			redemptions := test.redemptions
+			if redemptions == nil {
+				redemptions = a.Store
+			}
+			a.Coupons = loadCoupons(redemptions)
+
+			body := fmt.Sprintf(`{"order_details": {"cluster_name": "cluster"}, "country": "FR", %s}`, test.details)
+			for _, path := range []string{"/order/quote", "/order/create"} {
+				status, response := post(t, server, path, signer.token(t, alice), "", body)
+				if status != test.wantStatus || response["code"] != string(test.wantCode) {
+					t.Errorf("%s = %d (%v), want %d %s", path, status, response, test.wantStatus, test.wantCode)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayDeadLetter(t *testing.T) {
+	server, a, _, signer := newTestApp(t)
+	admin := signer.adminToken(t, "00000000-0000-4000-8000-000000000009")
+
+	order := paypalOrder.NewOrderRecord("PAY-1", paypalOrder.PaypalOrderInfos{})
+	if err := a.Store.SaveOrder(order); err != nil {
+		t.Fatal(err)
+	}
+	_, err := a.Store.UpdateOrderWithOutbox(order.ID, func(order *paypalOrder.OrderRecord) ([]paypalOrder.OutboxMessage, error) {
+		return []paypalOrder.OutboxMessage{
+			{OrderID: order.ID, Kind: paypalOrder.MessageLaunchOrder, Status: paypalOrder.OutboxDeadLetter, Attempts: 10, LastError: "web order answered 500"},
+			{OrderID: order.ID, Kind: paypalOrder.MessageDecommissionOrder, Status: paypalOrder.OutboxPending, Attempts: 1},
+		}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		id         string
+		wantStatus int
+	}{
+		{name: "not an administrator", token: signer.token(t, "00000000-0000-4000-8000-000000000001"), id: "1", wantStatus: http.StatusForbidden},
+		{name: "dead letter", token: admin, id: "1", wantStatus: http.StatusOK},
+		{name: "replayed already", token: admin, id: "1", wantStatus: http.StatusConflict},
+		{name: "pending message", token: admin, id: "2", wantStatus: http.StatusConflict},
+		{name: "unknown message", token: admin, id: "42", wantStatus: http.StatusNotFound},
+		{name: "invalid ID", token: admin, id: "first", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, response := post(t, server, "/admin/outbox/dead-letters/"+test.id+"/replay", test.token, "", "")
+			if status != test.wantStatus {
+				t.Fatalf("replay status = %d (%v), want %d", status, response, test.wantStatus)
+			}
+			if status == http.StatusOK && (response["status"] != string(paypalOrder.OutboxPending) || response["attempts"] != float64(0)) {
+				t.Errorf("replayed message = %v, want it pending without attempts", response)
+			}
+		})
+	}
+
+	deadLetters, err := a.Store.ListOutboxMessages(paypalOrder.OutboxDeadLetter)
+	if err != nil || len(deadLetters) != 0 {
+		t.Errorf("ListOutboxMessages() = %d dead letters, %v, want the replayed message pending", len(deadLetters), err)
+	}
+}
+
+// saveOrderWithStatus saves an order of the fake provider moved through the given statuses
+func saveOrderWithStatus(t *testing.T, a *App, id string, statuses ...paypalOrder.OrderStatus) {
+	t.Helper()
+	order := paypalOrder.NewOrderRecord(id, paypalOrder.PaypalOrderInfos{Provider: paypalOrder.ProviderName})
+	for _, status := range statuses {
+		if err := order.Transition(status, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	order.AuthorizationID = "AUTH-" + id
+	if err := a.Store.SaveOrder(order); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReportProvisioning(t *testing.T) {
+	server, a, provider, _ := newTestApp(t)
+	requested := []paypalOrder.OrderStatus{paypalOrder.StatusApproved, paypalOrder.StatusAuthorized, paypalOrder.StatusProvisioningRequested}
+	saveOrderWithStatus(t, a, "PAY-1", requested...)
+	saveOrderWithStatus(t, a, "PAY-2", paypalOrder.StatusCancelled)
+
+	tests := []struct {
+		name       string
+		token      string
+		orderID    string
+		status     string
+		wantStatus int
+		wantOrder  paypalOrder.OrderStatus // Status of the order after the report
+	}{
+		{name: "missing token", orderID: "PAY-1", status: "PROVISIONED", wantStatus: http.StatusUnauthorized, wantOrder: paypalOrder.StatusProvisioningRequested},
+		{name: "wrong token", token: "user-token", orderID: "PAY-1", status: "PROVISIONED", wantStatus: http.StatusUnauthorized, wantOrder: paypalOrder.StatusProvisioningRequested},
+		{name: "unknown order", token: testWebOrderToken, orderID: "PAY-42", status: "PROVISIONED", wantStatus: http.StatusNotFound},
+		{name: "invalid status", token: testWebOrderToken, orderID: "PAY-1", status: "DONE", wantStatus: http.StatusBadRequest, wantOrder: paypalOrder.StatusProvisioningRequested},
+		{name: "provisioned", token: testWebOrderToken, orderID: "PAY-1", status: "PROVISIONED", wantStatus: http.StatusOK, wantOrder: paypalOrder.StatusProvisioned},
+		{name: "provisioned twice", token: testWebOrderToken, orderID: "PAY-1", status: "PROVISIONED", wantStatus: http.StatusOK, wantOrder: paypalOrder.StatusProvisioned},
+		{name: "failed once provisioned", token: testWebOrderToken, orderID: "PAY-1", status: "FAILED", wantStatus: http.StatusConflict, wantOrder: paypalOrder.StatusProvisioned},
+		{name: "cancelled order", token: testWebOrderToken, orderID: "PAY-2", status: "PROVISIONED", wantStatus: http.StatusConflict, wantOrder: paypalOrder.StatusCancelled},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := fmt.Sprintf(`{"status": %q, "details": "cluster ready"}`, test.status)
+			status, response := post(t, server, "/order/"+test.orderID+"/provisioning", test.token, "", body)
+			if status != test.wantStatus {
+				t.Fatalf("provisioning report status = %d (%v), want %d", status, response, test.wantStatus)
+			}
+			if test.wantOrder == "" {
+				return
+			}
+			order, err := a.Store.GetOrder(test.orderID)
+			if err != nil || order.Status != test.wantOrder {
+				t.Errorf("order = %+v, %v, want %s", order, err, test.wantOrder)
+			}
+		})
+	}
+
+	// The payment of the order is captured once, by the first report
+	if captures := provider.captures["PAY-1"]; captures != 1 {
+		t.Errorf("PAY-1 captured %d times, want 1", captures)
+	}
+	if captures := provider.captures["PAY-2"]; captures != 0 {
+		t.Errorf("cancelled order captured %d times, want 0", captures)
+	}
+}
+
+// fieldRules returns the "field:rule" pairs of the field errors of a validation error response
+func fieldRules(response map[string]interface{}) []string {
+	var rules []string
+	details, _ := response["details"].([]interface{})
+	for _, detail := range details {
+		fieldError, _ := detail.(map[string]interface{})
+		rules = append(rules, fmt.Sprintf("%v:%v", fieldError["field"], fieldError["rule"]))
+	}
+	return rules
+}
+
+func TestRequestValidation(t *testing.T) {
+	server, _, _, signer := newTestApp(t)
+	alice := signer.token(t, "00000000-0000-4000-8000-000000000001")
+
+	// order returns a valid order body completed with the given order details and fields
+	order := func(details string, fields string) string {
+		return `{"order_details": {"cluster_name": "my-cluster"` + details + `}, "country": "FR"` + fields + `}`
+	}
+
+	tests := []struct {
+		name      string
+		token     string
+		path      string
+		body      string
+		wantRules []string // Expected among the field errors
+	}{
+		{name: "valid order quoted", path: "/order/quote", body: order("", "")},
+		{name: "cluster name with uppercase", path: "/order/create", body: `{"order_details": {"cluster_name": "My_Cluster"}, "country": "FR"}`,
+			wantRules: []string{"order_details.cluster_name:isvalidclustername"}},
+		{name: "cluster name starting with a dash", path: "/order/create", body: `{"order_details": {"cluster_name": "-cluster"}, "country": "FR"}`,
+			wantRules: []string{"order_details.cluster_name:isvalidclustername"}},
+		{name: "cluster name ending with a dash", path: "/order/quote", body: `{"order_details": {"cluster_name": "cluster-"}, "country": "FR"}`,
+			wantRules: []string{"order_details.cluster_name:isvalidclustername"}},
+		{name: "cluster name too long", path: "/order/create", body: `{"order_details": {"cluster_name": "` + strings.Repeat("a", 64) + `"}, "country": "FR"}`,
+			wantRules: []string{"order_details.cluster_name:max"}},
+		{name: "missing cluster name", path: "/order/create", body: `{"order_details": {}, "country": "FR"}`,
+			wantRules: []string{"order_details.cluster_name:required"}},
+		{name: "user ID not a UUID", token: signer.token(t, "alice"), path: "/order/create", body: order("", ""),
+			wantRules: []string{"order_details.user_id:isuuid"}},
+		{name: "negative storage", path: "/order/create", body: order(`, "images_storage": -1`, ""),
+			wantRules: []string{"order_details.images_storage:min"}},
+		{name: "storage too large", path: "/order/quote", body: order(`, "images_storage": 1001`, ""),
+			wantRules: []string{"order_details.images_storage:max"}},
+		{name: "monitoring without storage", path: "/order/create", body: order(`, "has_monitoring": true`, ""),
+			wantRules: []string{"order_details.monitoring_storage:required_with"}},
+		{name: "unsupported currency", path: "/order/create", body: order("", `, "currency": "XYZ"`),
+			wantRules: []string{"currency:supported"}},
+		{name: "malformed currency", path: "/order/create", body: order("", `, "currency": "EURO"`),
+			wantRules: []string{"currency:len"}},
+		{name: "missing country", path: "/order/create", body: `{"order_details": {"cluster_name": "my-cluster"}}`,
+			wantRules: []string{"country:required"}},
+		{name: "unknown provider", path: "/order/create", body: order("", `, "provider": "bitcoin"`),
+			wantRules: []string{"provider:oneof"}},
+		{name: "several invalid fields", path: "/order/create", body: `{"order_details": {"cluster_name": "-", "images_storage": -1}}`,
+			wantRules: []string{"order_details.cluster_name:isvalidclustername", "order_details.images_storage:min", "country:required"}},
+		{name: "missing order ID", path: "/order/approve", body: `{}`, wantRules: []string{"order_id:required"}},
+		{name: "order ID with a path", path: "/order/approve", body: `{"order_id": "../admin"}`, wantRules: []string{"order_id:excludesall"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token := test.token
+			if token == "" {
+				token = alice
+			}
+			status, response := post(t, server, test.path, token, "", test.body)
+
+			if test.wantRules == nil {
+				if status != http.StatusOK {
+					t.Errorf("%s status = %d (%v), want %d", test.path, status, response, http.StatusOK)
+				}
+				return
+			}
+			if status != http.StatusBadRequest || response["code"] != string(helpers.CodeValidation) {
+				t.Fatalf("%s = %d (%v), want %d %s", test.path, status, response, http.StatusBadRequest, helpers.CodeValidation)
+			}
+			rules := fieldRules(response)
+			for _, want := range test.wantRules {
+				found := false
+				for _, rule := range rules {
+					found = found || rule == want
+				}
+				if !found {
+					t.Errorf("field errors = %v, want %s", rules, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestValidationInvalidJSON(t *testing.T) {
+	server, _, _, signer := newTestApp(t)
+	alice := signer.token(t, "00000000-0000-4000-8000-000000000001")
+
+	for _, path := range []string{"/order/create", "/order/quote", "/order/approve"} {
+		status, response := post(t, server, path, alice, "", `{"order_details": `)
+		if status != http.StatusBadRequest || response["code"] != string(helpers.CodeValidation) {
+			t.Errorf("%s = %d (%v), want %d %s", path, status, response, http.StatusBadRequest, helpers.CodeValidation)
+		}
+		// The decoding error is given in the details
+		if details, ok := response["details"].(string); !ok || details == "" {
+			t.Errorf("%s details = %v, want the decoding error", path, response["details"])
+		}
+	}
+}
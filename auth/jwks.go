@@ -0,0 +1,251 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Shortest delay between two downloads of a JWKS, when an unknown key is used
+const minRefreshInterval = time.Minute
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// jsonWebKey is a key of a JWKS (RFC 7517), only signature keys are used
+type jsonWebKey struct {
+	KeyID   string `json:"kid"`
+	KeyType string `json:"kty"` // RSA or EC
+	Use     string `json:"use"`
+	N       string `json:"n"` // RSA modulus
+	E       string `json:"e"` // RSA exponent
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+// KeySet holds the public keys used to sign the tokens, loaded from a
+// JWKS file or URL (e.g. Keycloak's openid-connect/certs endpoint)
+type KeySet struct {
+	source       string
+	httpClient   *http.Client
+	keys         map[string]crypto.PublicKey
+	mutex        sync.RWMutex
+	attemptedAt  time.Time  // Last load of the JWKS, even a failed one
+	refreshMutex sync.Mutex // Held during a refresh, guards attemptedAt
+}
+
+// ===================================================================
+// Loads the keys of a JWKS
+//
+// Parameters:
+//
+//	(string) source : URL (http or https) or path of the JWKS
+//	(*http.Client) httpClient : Client used to download the JWKS from a URL
+//
+// Return
+//
+//	(*KeySet) : Keys found in the JWKS
+//	(error) : Error while reading the JWKS or nil if no error occurs
+//
+// Example:
+//
+//	keys, err := NewKeySet("https://keycloak.onekonsole.fr/realms/onekonsole/protocol/openid-connect/certs", http.DefaultClient)
+//
+// ===================================================================
+func NewKeySet(source string, httpClient *http.Client) (*KeySet, error) {
+	keySet := &KeySet{source: source, httpClient: httpClient}
+	if err := keySet.load(); err != nil {
+		return nil, err
+	}
+
+	return keySet, nil
+}
+
+// ===================================================================
+// Returns the key with the given ID. Keys are downloaded again when
+// the ID is unknown, so rotated keys are found without a restart.
+// Concurrent callers wait for a single download, and the JWKS is not
+// downloaded again for minRefreshInterval, even after a failure.
+//
+// Parameters:
+//
+//	(string) keyID : "kid" of the token header
+//
+// Used on:
+//
+//	(*KeySet) s : Keys of the identity provider
+//
+// Return
+//
+//	(crypto.PublicKey) : *rsa.PublicKey or *ecdsa.PublicKey
+//	(error) : ErrUnknownKey if no key has this ID
+//
+// ===================================================================
+func (s *KeySet) Key(keyID string) (crypto.PublicKey, error) {
+	if key, ok := s.lookup(keyID); ok {
+		return key, nil
+	}
+	if !s.isURL() {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, keyID)
+	}
+
+	s.refreshMutex.Lock()
+	defer s.refreshMutex.Unlock()
+
+	// Found by the refresh this caller was waiting for
+	if key, ok := s.lookup(keyID); ok {
+		return key, nil
+	}
+	if time.Since(s.attemptedAt) < minRefreshInterval {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, keyID)
+	}
+	if err := s.load(); err != nil {
+		fmt.Printf("[ERROR] Could not refresh JWKS: %s\n", err)
+	}
+
+	if key, ok := s.lookup(keyID); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownKey, keyID)
+}
+
+// lookup returns a known key
+func (s *KeySet) lookup(keyID string) (crypto.PublicKey, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	key, ok := s.keys[keyID]
+	return key, ok
+}
+
+// isURL reports whether the JWKS is downloaded
+func (s *KeySet) isURL() bool {
+	return strings.HasPrefix(s.source, "http://") || strings.HasPrefix(s.source, "https://")
+}
+
+// load reads the JWKS and replaces the known keys.
+// The attempt is recorded first, so a failing identity provider is not called on every token.
+func (s *KeySet) load() error {
+	s.attemptedAt = time.Now()
+	var content []byte
+
+	if s.isURL() {
+		res, err := s.httpClient.Get(s.source)
+		if err != nil {
+			return fmt.Errorf("could not download JWKS: %w", err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("could not download JWKS: status code %d", res.StatusCode)
+		}
+		if content, err = io.ReadAll(res.Body); err != nil {
+			return fmt.Errorf("could not download JWKS: %w", err)
+		}
+	} else {
+		file, err := os.ReadFile(s.source)
+		if err != nil {
+			return fmt.Errorf("could not read JWKS: %w", err)
+		}
+		content = file
+	}
+
+	keys, err := parseKeySet(content)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	s.keys = keys
+	s.mutex.Unlock()
+	fmt.Printf("[INFO] Loaded %d signing keys from %s\n", len(keys), s.source)
+
+	return nil
+}
+
+// parseKeySet decodes the RSA and EC signature keys of a JWKS
+func parseKeySet(content []byte) (map[string]crypto.PublicKey, error) {
+	var keySet struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(content, &keySet); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(keySet.Keys))
+	for _, jwk := range keySet.Keys {
+		// Keycloak also publishes its encryption keys
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWKS key %q: %w", jwk.KeyID, err)
+		}
+		if key != nil {
+			keys[jwk.KeyID] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("invalid JWKS: no signature key")
+	}
+
+	return keys, nil
+}
+
+// publicKey decodes a key, nil if its type is not supported
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if jwk.Curve != "P-256" {
+			return nil, nil
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve P-256")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// decodeBigInt decodes a base64url encoded big-endian integer
+func decodeBigInt(value string) (*big.Int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(decoded) == 0 {
+		return nil, fmt.Errorf("invalid base64url integer %q", value)
+	}
+	return new(big.Int).SetBytes(decoded), nil
+}
@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// jwks returns a JWKS holding the public keys of RSA keys, by key ID
+func jwks(keys map[string]*rsa.PrivateKey) []byte {
+	var set struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	for keyID, key := range keys {
+		set.Keys = append(set.Keys, map[string]string{
+			"kid": keyID,
+			"kty": "RSA",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	content, _ := json.Marshal(set)
+	return content
+}
+
+// jwksServer serves a JWKS that can be changed, and counts its downloads
+type jwksServer struct {
+	mutex     sync.Mutex
+	content   []byte
+	status    int
+	downloads int32
+}
+
+func (s *jwksServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&s.downloads, 1)
+	// Slow enough for concurrent callers to pile up
+	time.Sleep(20 * time.Millisecond)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	w.WriteHeader(s.status)
+	w.Write(s.content)
+}
+
+func (s *jwksServer) serve(status int, content []byte) {
+	s.mutex.Lock()
+	s.status = status
+	s.content = content
+	s.mutex.Unlock()
+}
+
+func newTestKeySet(t *testing.T, key *rsa.PrivateKey) (*KeySet, *jwksServer) {
+	t.Helper()
+	api := &jwksServer{status: http.StatusOK, content: jwks(map[string]*rsa.PrivateKey{"first": key})}
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+
+	keySet, err := NewKeySet(server.URL, server.Client())
+	if err != nil {
+		t.Fatalf("NewKeySet() error = %v", err)
+	}
+	return keySet, api
+}
+
+// concurrentKeys looks up a key from many goroutines at once
+func concurrentKeys(keySet *KeySet, keyID string) []error {
+	errs := make([]error, 20)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = keySet.Key(keyID)
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestKeySetFindsRotatedKey(t *testing.T) {
+	first, _ := rsa.GenerateKey(rand.Reader, 2048)
+	second, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keySet, api := newTestKeySet(t, first)
+
+	// Rotated before the refresh interval: not downloaded again
+	api.serve(http.StatusOK, jwks(map[string]*rsa.PrivateKey{"first": first, "second": second}))
+	if _, err := keySet.Key("second"); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Key() error = %v, want %v", err, ErrUnknownKey)
+	}
+
+	keySet.attemptedAt = time.Now().Add(-minRefreshInterval)
+	for _, err := range concurrentKeys(keySet, "second") {
+		if err != nil {
+			t.Fatalf("Key() error = %v", err)
+		}
+	}
+	if downloads := atomic.LoadInt32(&api.downloads); downloads != 2 {
+		t.Errorf("JWKS downloaded %d times, want 2", downloads)
+	}
+}
+
+func TestKeySetRefreshStorm(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keySet, api := newTestKeySet(t, key)
+	api.serve(http.StatusServiceUnavailable, nil)
+	keySet.attemptedAt = time.Now().Add(-minRefreshInterval)
+
+	// Tokens with an unknown kid while the identity provider is down
+	for _, err := range concurrentKeys(keySet, "unknown") {
+		if !errors.Is(err, ErrUnknownKey) {
+			t.Fatalf("Key() error = %v, want %v", err, ErrUnknownKey)
+		}
+	}
+	for _, err := range concurrentKeys(keySet, "unknown") {
+		if !errors.Is(err, ErrUnknownKey) {
+			t.Fatalf("Key() error = %v, want %v", err, ErrUnknownKey)
+		}
+	}
+	if downloads := atomic.LoadInt32(&api.downloads); downloads != 2 {
+		t.Errorf("JWKS downloaded %d times, want 2 (initial load and a single failed refresh)", downloads)
+	}
+
+	// Known keys are still served
+	if _, err := keySet.Key("first"); err != nil {
+		t.Errorf("Key() error = %v", err)
+	}
+}
+
+func TestKeySetFile(t *testing.T) {
+	_, keySet := newTestKeys(t)
+
+	// Keys of a file are never downloaded again
+	keySet.attemptedAt = time.Now().Add(-minRefreshInterval)
+	if _, err := keySet.Key("unknown"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Key() error = %v, want %v", err, ErrUnknownKey)
+	}
+}
+
+func TestParseKeySet(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	tests := []struct {
+		name     string
+		content  string
+		wantKeys int
+		wantErr  bool
+	}{
+		{name: "RSA key", content: string(jwks(map[string]*rsa.PrivateKey{"rsa": key})), wantKeys: 1},
+		{name: "encryption key skipped", content: `{"keys": [{"kid": "enc", "kty": "RSA", "use": "enc", "n": "AQAB", "e": "AQAB"}]}`, wantErr: true},
+		{name: "EC point not on curve", content: `{"keys": [{"kid": "ec", "kty": "EC", "crv": "P-256", "x": "AQ", "y": "AQ"}]}`, wantErr: true},
+		{name: "invalid base64", content: `{"keys": [{"kid": "rsa", "kty": "RSA", "n": "!!", "e": "AQAB"}]}`, wantErr: true},
+		{name: "not JSON", content: `keys`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keys, err := parseKeySet([]byte(test.content))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseKeySet() error = %v, want error %v", err, test.wantErr)
+			}
+			if len(keys) != test.wantKeys {
+				t.Errorf("parseKeySet() = %d keys, want %d", len(keys), test.wantKeys)
+			}
+		})
+	}
+}
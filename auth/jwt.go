@@ -0,0 +1,234 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Clock skew tolerated between the identity provider and the service
+const leeway = 30 * time.Second
+
+var (
+	ErrInvalidToken  = errors.New("invalid token")
+	ErrExpiredToken  = errors.New("token has expired")
+	ErrMissingClaims = errors.New("the issuer and the audience of the tokens are required")
+)
+
+// Audience is the "aud" claim, a string or a list of strings
+type Audience []string
+
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// Claims are the claims of a verified token used by the service
+type Claims struct {
+	Subject           string   `json:"sub"` // ID of the user
+	Issuer            string   `json:"iss"`
+	Audience          Audience `json:"aud"`
+	AuthorizedParty   string   `json:"azp"`
+	ExpiresAt         float64  `json:"exp"`
+	NotBefore         float64  `json:"nbf"`
+	PreferredUsername string   `json:"preferred_username"`
+	RealmAccess       struct {
+		Roles []string `json:"roles"`
+	} `json:"realm_access"` // Keycloak realm roles
+}
+
+// HasRole reports whether the user has a Keycloak realm role
+func (c *Claims) HasRole(role string) bool {
+	for _, granted := range c.RealmAccess.Roles {
+		if granted == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Verifier checks the bearer tokens sent to the service
+type Verifier struct {
+	keys     *KeySet
+	issuer   string
+	audience string
+}
+
+// ===================================================================
+// Creates a token verifier
+//
+// Parameters:
+//
+//	(*KeySet) keys : Keys of the identity provider
+//	(string) issuer : Expected "iss" claim
+//	(string) audience : Expected "aud" or "azp" claim
+//
+// Return
+//
+//	(*Verifier) : Verifier ready to be used
+//	(error) : ErrMissingClaims if the issuer or the audience is empty
+//
+// Example:
+//
+//	verifier, err := NewVerifier(keys, "https://keycloak.onekonsole.fr/realms/onekonsole", "web-billing")
+//
+// ===================================================================
+func NewVerifier(keys *KeySet, issuer string, audience string) (*Verifier, error) {
+	if issuer == "" || audience == "" {
+		return nil, ErrMissingClaims
+	}
+
+	return &Verifier{keys: keys, issuer: issuer, audience: audience}, nil
+}
+
+// ===================================================================
+// Checks the signature (RS256 or ES256) and the claims of a JWT
+//
+// Parameters:
+//
+//	(string) token : Compact serialized JWT
+//
+// Used on:
+//
+//	(*Verifier) v : Verifier of the service
+//
+// Return
+//
+//	(*Claims) : Claims of the token
+//	(error) : ErrInvalidToken, ErrExpiredToken or ErrUnknownKey
+//
+// ===================================================================
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed token", ErrInvalidToken)
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: invalid header", ErrInvalidToken)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid signature encoding", ErrInvalidToken)
+	}
+
+	key, err := v.keys.Key(header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !verifySignature(header.Algorithm, key, digest[:], signature) {
+		return nil, fmt.Errorf("%w: bad %s signature", ErrInvalidToken, header.Algorithm)
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: invalid claims", ErrInvalidToken)
+	}
+	if err := v.checkClaims(&claims, time.Now()); err != nil {
+		return nil, err
+	}
+
+	return &claims, nil
+}
+
+// verifySignature checks a signature with the algorithm of the token, which must match the key type
+func verifySignature(algorithm string, key crypto.PublicKey, digest []byte, signature []byte) bool {
+	switch algorithm {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest, signature) == nil
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		// ES256 signatures are r and s on 32 bytes each
+		if !ok || len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(ecKey, digest, r, s)
+	default:
+		// Never accept "none" or an algorithm chosen by the client
+		return false
+	}
+}
+
+// checkClaims checks the validity period, issuer and audience of a token.
+// Every token is refused by a verifier without issuer or audience.
+func (v *Verifier) checkClaims(claims *Claims, now time.Time) error {
+	if claims.Subject == "" {
+		return fmt.Errorf("%w: missing sub claim", ErrInvalidToken)
+	}
+	if claims.ExpiresAt == 0 {
+		return fmt.Errorf("%w: missing exp claim", ErrInvalidToken)
+	}
+	if now.Add(-leeway).After(time.Unix(int64(claims.ExpiresAt), 0)) {
+		return ErrExpiredToken
+	}
+	if claims.NotBefore != 0 && now.Add(leeway).Before(time.Unix(int64(claims.NotBefore), 0)) {
+		return fmt.Errorf("%w: token not valid yet", ErrInvalidToken)
+	}
+	if v.issuer == "" || claims.Issuer != v.issuer {
+		return fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, claims.Issuer)
+	}
+	if v.audience == "" || (claims.AuthorizedParty != v.audience && !claims.Audience.contains(v.audience)) {
+		return fmt.Errorf("%w: token not issued for %s", ErrInvalidToken, v.audience)
+	}
+
+	return nil
+}
+
+// contains reports whether the audience includes a client
+func (a Audience) contains(client string) bool {
+	for _, audience := range a {
+		if audience == client {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeSegment decodes a base64url JSON segment of a token
+func decodeSegment(segment string, value interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(decoded, value)
+}
+
+type contextKey struct{}
+
+// WithClaims returns a context holding the claims of the authenticated user
+func WithClaims(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, contextKey{}, claims)
+}
+
+// ClaimsFromContext returns the claims of the authenticated user, nil if the request is not authenticated
+func ClaimsFromContext(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(contextKey{}).(*Claims)
+	return claims
+}
@@ -0,0 +1,218 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://keycloak.example/realms/onekonsole"
+	testAudience = "web-billing"
+)
+
+// testKeys are the private keys whose public keys are in the key set of the tests
+type testKeys struct {
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+}
+
+func newTestKeys(t *testing.T) (*testKeys, *KeySet) {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keySet := &KeySet{
+		source: "jwks.json",
+		keys:   map[string]crypto.PublicKey{"rsa": &rsaKey.PublicKey, "ec": &ecKey.PublicKey},
+	}
+	return &testKeys{rsa: rsaKey, ec: ecKey}, keySet
+}
+
+// sign returns a token signed with the algorithm of its header
+func (k *testKeys) sign(t *testing.T, header map[string]string, claims map[string]interface{}) string {
+	t.Helper()
+	encodedHeader, _ := json.Marshal(header)
+	encodedClaims, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(encodedHeader) + "." + base64.RawURLEncoding.EncodeToString(encodedClaims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch header["alg"] {
+	case "RS256":
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, k.ec, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	case "HS256":
+		// Algorithm confusion: the public RSA key used as HMAC secret
+		secret, _ := x509.MarshalPKIXPublicKey(&k.rsa.PublicKey)
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// validClaims returns the claims of a token accepted by the test verifier
+func validClaims() map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"sub": "alice",
+		"iss": testIssuer,
+		"aud": testAudience,
+		"exp": now.Add(time.Hour).Unix(),
+		"nbf": now.Add(-time.Minute).Unix(),
+	}
+}
+
+// with returns the valid claims changed by the given ones, removed when nil
+func with(changes map[string]interface{}) map[string]interface{} {
+	claims := validClaims()
+	for name, value := range changes {
+		if value == nil {
+			delete(claims, name)
+			continue
+		}
+		claims[name] = value
+	}
+	return claims
+}
+
+func TestVerify(t *testing.T) {
+	keys, keySet := newTestKeys(t)
+	verifier, err := NewVerifier(keySet, testIssuer, testAudience)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	rs256 := map[string]string{"alg": "RS256", "kid": "rsa"}
+	es256 := map[string]string{"alg": "ES256", "kid": "ec"}
+
+	tests := []struct {
+		name    string
+		token   func() string
+		wantErr error
+	}{
+		{name: "RS256", token: func() string { return keys.sign(t, rs256, validClaims()) }},
+		{name: "ES256", token: func() string { return keys.sign(t, es256, validClaims()) }},
+		{name: "audience in a list", token: func() string {
+			return keys.sign(t, rs256, with(map[string]interface{}{"aud": []string{"account", testAudience}}))
+		}},
+		{name: "audience as authorized party", token: func() string {
+			return keys.sign(t, rs256, with(map[string]interface{}{"aud": "account", "azp": testAudience}))
+		}},
+		{name: "expired within leeway", token: func() string {
+			return keys.sign(t, rs256, with(map[string]interface{}{"exp": now.Add(-10 * time.Second).Unix()}))
+		}},
+		{name: "alg none", wantErr: ErrInvalidToken, token: func() string {
+			token := keys.sign(t, map[string]string{"alg": "none", "kid": "rsa"}, validClaims())
+			return token[:strings.LastIndex(token, ".")+1]
+		}},
+		{name: "alg confusion HS256 with the RSA public key", wantErr: ErrInvalidToken, token: func() string {
+			return keys.sign(t, map[string]string{"alg": "HS256", "kid": "rsa"}, validClaims())
+		}},
+		{name: "ES256 header on an RSA key", wantErr: ErrInvalidToken, token: func() string {
+			return keys.sign(t, map[string]string{"alg": "ES256", "kid": "rsa"}, validClaims())
+		}},
+		{name: "RS256 header on an EC key", wantErr: ErrInvalidToken, token: func() string {
+			return keys.sign(t, map[string]string{"alg": "RS256", "kid": "ec"}, validClaims())
+		}},
+		{name: "expired", wantErr: ErrExpiredToken, token: func() string {
+			return keys.sign(t, rs256, with(map[string]interface{}{"exp": now.Add(-time.Minute).Unix()}))
+		}},
+		{name: "not valid yet", wantErr: ErrInvalidToken, token: func() string {
+			return keys.sign(t, rs256, with(map[string]interface{}{"nbf": now.Add(time.Minute).Unix()}))
+		}},
+		{name: "missing exp", wantErr: ErrInvalidToken, token: func() string {
+			return keys.sign(t, rs256, with(map[string]interface{}{"exp": nil}))
+		}},
+		{name: "missing sub", wantErr: ErrInvalidToken, token: func() string {
+			return keys.sign(t, rs256, with(map[string]interface{}{"sub": nil}))
+		}},
+		{name: "wrong issuer", wantErr: ErrInvalidToken, token: func() string {
+			return keys.sign(t, rs256, with(map[string]interface{}{"iss": "https://evil.example"}))
+		}},
+		{name: "wrong audience", wantErr: ErrInvalidToken, token: func() string {
+			return keys.sign(t, rs256, with(map[string]interface{}{"aud": "another-service"}))
+		}},
+		{name: "unknown kid", wantErr: ErrUnknownKey, token: func() string {
+			return keys.sign(t, map[string]string{"alg": "RS256", "kid": "rotated"}, validClaims())
+		}},
+		{name: "tampered signature", wantErr: ErrInvalidToken, token: func() string {
+			token := []byte(keys.sign(t, rs256, validClaims()))
+			// Changes the last full character of the signature
+			if token[len(token)-2] == 'A' {
+				token[len(token)-2] = 'B'
+			} else {
+				token[len(token)-2] = 'A'
+			}
+			return string(token)
+		}},
+		{name: "tampered claims", wantErr: ErrInvalidToken, token: func() string {
+			parts := strings.Split(keys.sign(t, rs256, validClaims()), ".")
+			forged, _ := json.Marshal(with(map[string]interface{}{"sub": "mallory"}))
+			return parts[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + parts[2]
+		}},
+		{name: "malformed", wantErr: ErrInvalidToken, token: func() string { return "not-a-token" }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := verifier.Verify(test.token())
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("Verify() error = %v, want %v", err, test.wantErr)
+			}
+			if test.wantErr == nil && claims.Subject != "alice" {
+				t.Errorf("Subject = %q, want alice", claims.Subject)
+			}
+			if test.wantErr != nil && claims != nil {
+				t.Errorf("Verify() = %+v, want no claims", claims)
+			}
+		})
+	}
+}
+
+func TestNewVerifierRequiresIssuerAndAudience(t *testing.T) {
+	keys, keySet := newTestKeys(t)
+
+	for _, missing := range []struct{ issuer, audience string }{{"", testAudience}, {testIssuer, ""}, {"", ""}} {
+		if _, err := NewVerifier(keySet, missing.issuer, missing.audience); !errors.Is(err, ErrMissingClaims) {
+			t.Errorf("NewVerifier(%q, %q) error = %v, want %v", missing.issuer, missing.audience, err, ErrMissingClaims)
+		}
+	}
+
+	// A verifier built without NewVerifier refuses every token rather than skipping the checks
+	verifier := &Verifier{keys: keySet}
+	token := keys.sign(t, map[string]string{"alg": "RS256", "kid": "rsa"}, with(map[string]interface{}{"iss": nil, "aud": nil}))
+	if _, err := verifier.Verify(token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Verify() error = %v, want %v", err, ErrInvalidToken)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/OneKonsole/web-service-billing/auth"
+	helpers "github.com/OneKonsole/web-service-billing/helpers"
+	paypalOrder "github.com/OneKonsole/web-service-billing/paypal"
+)
+
+// ===========================================================================================================
+// Only lets authenticated users call a route: the request must hold a bearer JWT signed
+// by the identity provider. The claims of the token are added to the request context.
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	next (http.HandlerFunc) : Route restricted to authenticated users
+//
+// Examples:
+//
+//	a.Router.HandleFunc("/order/approve", a.authenticated(a.approveOrder))
+//
+// ===========================================================================================================
+func (a *App) authenticated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || token == "" {
+			helpers.RespondWithError(w, helpers.UnauthorizedError("Missing bearer token"))
+			return
+		}
+
+		claims, err := a.Verifier.Verify(token)
+		if err != nil {
+			fmt.Printf("[ERROR] Token refused on %s: %s\n", r.URL.Path, err)
+			message := "Invalid bearer token"
+			if errors.Is(err, auth.ErrExpiredToken) {
+				message = "Bearer token has expired"
+			}
+			helpers.RespondWithError(w, helpers.UnauthorizedError(message))
+			return
+		}
+
+		next(w, r.WithContext(auth.WithClaims(r.Context(), claims)))
+	}
+}
+
+// ===========================================================================================================
+// Only lets administrators call a route: the user must have the admin_role realm role
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	next (http.HandlerFunc) : Route restricted to administrators
+//
+// Examples:
+//
+//	a.Router.HandleFunc("/admin/prices/reload", a.adminOnly(a.reloadPrices))
+//
+// ===========================================================================================================
+func (a *App) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return a.authenticated(func(w http.ResponseWriter, r *http.Request) {
+		claims := auth.ClaimsFromContext(r.Context())
+		if !claims.HasRole(a.AppConf.AdminRole) {
+			fmt.Printf("[ERROR] User %s is not allowed on %s\n", claims.Subject, r.URL.Path)
+			helpers.RespondWithError(w, helpers.ForbiddenError("Administrator role required"))
+			return
+		}
+
+		next(w, r)
+	})
+}
+
+// isAdmin reports whether the authenticated user is an administrator
+func (a *App) isAdmin(r *http.Request) bool {
+	claims := auth.ClaimsFromContext(r.Context())
+	return claims != nil && claims.HasRole(a.AppConf.AdminRole)
+}
+
+// ===========================================================================================================
+// Checks that the authenticated user can access an order: users only access their own orders,
+// administrators access every order. Orders of other users are answered as unknown, so their
+// IDs can not be guessed.
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	r (*http.Request) : Authenticated request
+//	orderID (string) : Checkout ID of the order
+//
+// Returns:
+//
+//	(error) : *helpers.Error to answer with, or nil if the user can access the order
+//
+// ===========================================================================================================
+func (a *App) authorizeOrder(r *http.Request, orderID string) error {
+	if a.isAdmin(r) {
+		return nil
+	}
+
+	order, err := a.Store.GetOrder(orderID)
+	if errors.Is(err, paypalOrder.ErrOrderNotFound) {
+		return helpers.NotFoundError("Unknown order", err)
+	}
+	if err != nil {
+		return helpers.InternalError("Could not read order", err)
+	}
+
+	claims := auth.ClaimsFromContext(r.Context())
+	if order.Infos.Order.UserID != claims.Subject {
+		fmt.Printf("[ERROR] User %s is not allowed to access order %s\n", claims.Subject, orderID)
+		return helpers.NotFoundError("Unknown order", nil)
+	}
+
+	return nil
+}
@@ -6,11 +6,13 @@ require (
 	github.com/OneKonsole/order-model v0.0.0-20240124143047-d4a156846263
 	github.com/go-playground/validator v9.31.0+incompatible
 	github.com/gorilla/mux v1.8.1
+	go.etcd.io/bbolt v1.3.8
 )
 
 require (
 	github.com/go-playground/locales v0.14.1 // indirect
 	github.com/go-playground/universal-translator v0.18.1 // indirect
 	github.com/leodido/go-urn v1.2.4 // indirect
+	golang.org/x/sys v0.18.0 // indirect
 	gopkg.in/go-playground/assert.v1 v1.2.1 // indirect
 )
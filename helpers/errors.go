@@ -0,0 +1,145 @@
+package helpers
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Header holding the ID of a request, set on every response
+const RequestIDHeader = "X-Request-Id"
+
+// Code of an error answered by the service
+type ErrorCode string
+
+const (
+	CodeValidation          ErrorCode = "VALIDATION_FAILED"      // 400, details hold the invalid fields
+	CodeUnauthorized        ErrorCode = "UNAUTHORIZED"           // 401
+	CodePaymentRequired     ErrorCode = "PAYMENT_REQUIRED"       // 402, the payment could not be verified
+	CodeForbidden           ErrorCode = "FORBIDDEN"              // 403, the user can not access the resource
+	CodeNotFound            ErrorCode = "NOT_FOUND"              // 404
+	CodeConflict            ErrorCode = "CONFLICT"               // 409, e.g. an order already processed
+	CodeInternal            ErrorCode = "INTERNAL_ERROR"         // 500
+	CodePaymentProvider     ErrorCode = "PAYMENT_PROVIDER_ERROR" // 502, the payment provider refused the request
+	CodeUpstreamUnavailable ErrorCode = "UPSTREAM_UNAVAILABLE"   // 503, a service we depend on can not be reached
+)
+
+var statusCodes = map[ErrorCode]int{
+	CodeValidation:          http.StatusBadRequest,
+	CodeUnauthorized:        http.StatusUnauthorized,
+	CodePaymentRequired:     http.StatusPaymentRequired,
+	CodeForbidden:           http.StatusForbidden,
+	CodeNotFound:            http.StatusNotFound,
+	CodeConflict:            http.StatusConflict,
+	CodeInternal:            http.StatusInternalServerError,
+	CodePaymentProvider:     http.StatusBadGateway,
+	CodeUpstreamUnavailable: http.StatusServiceUnavailable,
+}
+
+// Error is a failure answered to the client. Its message is sent as is,
+// the error causing it is only logged.
+type Error struct {
+	Code    ErrorCode
+	Message string
+	Details interface{}
+	Err     error
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// StatusCode returns the HTTP status answered for the error
+func (e *Error) StatusCode() int {
+	if code, ok := statusCodes[e.Code]; ok {
+		return code
+	}
+	return http.StatusInternalServerError
+}
+
+// ErrorResponse is the body of every error response
+type ErrorResponse struct {
+	Code      ErrorCode   `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+}
+
+// ValidationError is returned when a request is invalid
+func ValidationError(message string, details interface{}) *Error {
+	return &Error{Code: CodeValidation, Message: message, Details: details}
+}
+
+// UnauthorizedError is returned when a request is not authenticated
+func UnauthorizedError(message string) *Error {
+	return &Error{Code: CodeUnauthorized, Message: message}
+}
+
+// ForbiddenError is returned when the authenticated user can not make a request
+func ForbiddenError(message string) *Error {
+	return &Error{Code: CodeForbidden, Message: message}
+}
+
+// PaymentRequiredError is returned when a payment has not been made as expected
+func PaymentRequiredError(message string, err error) *Error {
+	return &Error{Code: CodePaymentRequired, Message: message, Err: err}
+}
+
+// NotFoundError is returned when a requested resource does not exist
+func NotFoundError(message string, err error) *Error {
+	return &Error{Code: CodeNotFound, Message: message, Err: err}
+}
+
+// ConflictError is returned when a resource is not in a state allowing the request
+func ConflictError(message string, err error) *Error {
+	return &Error{Code: CodeConflict, Message: message, Err: err}
+}
+
+// InternalError is returned when the service itself fails
+func InternalError(message string, err error) *Error {
+	return &Error{Code: CodeInternal, Message: message, Err: err}
+}
+
+// PaymentProviderError is returned when a payment provider refuses a request
+func PaymentProviderError(message string, err error) *Error {
+	return &Error{Code: CodePaymentProvider, Message: message, Err: err}
+}
+
+// UpstreamUnavailableError is returned when a service we depend on can not be reached
+func UpstreamUnavailableError(message string, err error) *Error {
+	return &Error{Code: CodeUpstreamUnavailable, Message: message, Err: err}
+}
+
+// ===========================================================================================================
+// Helper to create a HTTP error response. The error is answered with its code,
+// message and details, errors that are not an *Error are answered as internal errors
+// without exposing them. The request ID is the one set on the response by the router.
+// Parameters:
+//
+//	w (http.ResponseWriter) : Helper object to create HTTP responses
+//	err (error) : Error to answer with
+//
+// Examples:
+//
+//	RespondWithError(w, NotFoundError("Unknown order", err))
+//
+// ===========================================================================================================
+func RespondWithError(w http.ResponseWriter, err error) {
+	var apiError *Error
+	if !errors.As(err, &apiError) {
+		apiError = InternalError("Internal error", err)
+	}
+
+	RespondWithJSON(w, apiError.StatusCode(), ErrorResponse{
+		Code:      apiError.Code,
+		Message:   apiError.Message,
+		Details:   apiError.Details,
+		RequestID: w.Header().Get(RequestIDHeader),
+	})
+}
@@ -5,27 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 
 	oko "github.com/OneKonsole/order-model"
 )
 
-// ===========================================================================================================
-// Helper to create a HTTP error message. The message will be sent as JSON
-// Parameters:
-//
-//	w (http.ResponseWriter) : Helper object to create HTTP responses
-//	code (int) : HTTP code to send
-//	message (string) : Error message to send
-//
-// Examples:
-//
-//	respondWithError(w, 500, "Couldn't process the order")
-//
-// ===========================================================================================================
-func RespondWithError(w http.ResponseWriter, code int, message string) {
-	RespondWithJSON(w, code, map[string]string{"error": message})
-}
-
 // ===========================================================================================================
 // Helper to create JSON HTTP responses
 // Parameters:
@@ -47,11 +32,22 @@ func RespondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Write(response)
 }
 
-func LaunchOrder(webOrderURL string, order *oko.Order) error {
+// ===========================================================================================================
+// Asks web order to create the cluster of a paid order
+// Parameters:
+//
+//	client (*http.Client) : Client used for the request, its timeout bounds the call
+//	webOrderURL (string) : URL of the web order service
+//	order (*oko.Order) : Order to produce
+//
+// Examples:
+//
+//	err := LaunchOrder(&http.Client{Timeout: 30 * time.Second}, "http://localhost:8010/order", &order)
+//
+// ===========================================================================================================
+func LaunchOrder(client *http.Client, webOrderURL string, order *oko.Order) error {
 	fmt.Printf("[INFO] Trying to call web order for order %d on : %s\n", order.ID, webOrderURL)
 
-	client := &http.Client{}
-
 	orderJSON, err := json.Marshal(order)
 
 	if err != nil {
@@ -78,5 +74,47 @@ func LaunchOrder(webOrderURL string, order *oko.Order) error {
 
 	defer res.Body.Close()
 
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("web order answered %d to the creation of order %s", res.StatusCode, order.PaypalID)
+	}
+
+	return nil
+}
+
+// ===========================================================================================================
+// Asks web order to decommission the cluster of a refunded order
+// Parameters:
+//
+//	client (*http.Client) : Client used for the request, its timeout bounds the call
+//	webOrderURL (string) : URL of the web order service
+//	paypalID (string) : Checkout ID of the order on its payment provider
+//
+// Examples:
+//
+//	err := DecommissionOrder(&http.Client{Timeout: 30 * time.Second}, "http://localhost:8010/order", "xyYxyZ")
+//
+// ===========================================================================================================
+func DecommissionOrder(client *http.Client, webOrderURL string, paypalID string) error {
+	fmt.Printf("[INFO] Trying to call web order to decommission order %s on : %s\n", paypalID, webOrderURL)
+
+	req, err := http.NewRequest("DELETE", strings.TrimSuffix(webOrderURL, "/")+"/"+url.PathEscape(paypalID), nil)
+	if err != nil {
+		fmt.Printf("[ERROR] Could not initiate a request to web order for order %s\n", paypalID)
+		return err
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		fmt.Printf("[ERROR] Could not make request to web order for order %s.\n", paypalID)
+		return err
+	}
+	defer res.Body.Close()
+
+	fmt.Printf("[INFO] Made decommission request to web order for order %s. Status code : %d\n", paypalID, res.StatusCode)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("web order answered %d to the decommission of order %s", res.StatusCode, paypalID)
+	}
+
 	return nil
 }
@@ -1,29 +1,141 @@
 package helpers
 
 import (
+	"fmt"
+	"reflect"
 	"regexp"
+	"strings"
 	"unicode"
 	"unicode/utf8"
 
 	"github.com/go-playground/validator"
 )
 
-func isValidClusterName(fl validator.FieldLevel) bool {
-	// Define the regular expression pattern
-	clusterNamePattern := "^[a-z0-9][a-z0-9-]*[a-z0-9]$"
+// Custom validation tags registered by NewValidator
+var customValidators = map[string]validator.Func{
+	"isvalidclustername": isValidClusterName,
+	"isuuid":             isUUID,
+	"startswithalphanum": startsWithAlphanum,
+	"endwithalphanum":    endWithAlphanum,
+}
 
-	// Compile the regular expression
-	regex := regexp.MustCompile(clusterNamePattern)
+// FieldError describes why a field of a request is invalid
+type FieldError struct {
+	Field   string `json:"field"`   // JSON path of the field, e.g. "order_details.cluster_name"
+	Rule    string `json:"rule"`    // Validation tag that failed, e.g. "isuuid"
+	Message string `json:"message"` // Human readable reason
+}
 
-	// Extract the field value
-	clusterName := fl.Field().String()
+// ===========================================================================================================
+// Creates a validator knowing the custom validation tags of the service.
+// Field errors are named after the JSON fields of the request.
+//
+// Returns:
+//
+//	(*validator.Validate) : Validator to use on request bodies
+//
+// Examples:
+//
+//	validate := NewValidator()
+//	err := validate.Struct(rules)
+//
+// ===========================================================================================================
+func NewValidator() *validator.Validate {
+	validate := validator.New()
 
+	validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	for tag, fn := range customValidators {
+		// Tags are constants, registering them can not fail
+		if err := validate.RegisterValidation(tag, fn); err != nil {
+			panic(err)
+		}
+	}
+
+	return validate
+}
+
+// ===========================================================================================================
+// Converts the error returned by a validator into per-field errors
+// Parameters:
+//
+//	err (error) : Error returned by validate.Struct
+//
+// Returns:
+//
+//	([]FieldError) : Invalid fields, empty if err is nil
+//
+// ===========================================================================================================
+func FieldErrors(err error) []FieldError {
+	validationErrors, ok := err.(validator.ValidationErrors)
+	if !ok {
+		if err == nil {
+			return nil
+		}
+		return []FieldError{{Message: err.Error()}}
+	}
+
+	fieldErrors := make([]FieldError, 0, len(validationErrors))
+	for _, fieldError := range validationErrors {
+		// Namespace starts with the name of the validated struct
+		field := fieldError.Namespace()
+		if i := strings.Index(field, "."); i >= 0 {
+			field = field[i+1:]
+		}
+		fieldErrors = append(fieldErrors, FieldError{
+			Field:   field,
+			Rule:    fieldError.Tag(),
+			Message: fieldMessage(fieldError),
+		})
+	}
+
+	return fieldErrors
+}
+
+// fieldMessage explains a failed validation tag
+func fieldMessage(fieldError validator.FieldError) string {
+	switch fieldError.Tag() {
+	case "required", "required_with":
+		return "is required"
+	case "isvalidclustername":
+		return "must only contain lowercase alphanumeric characters or '-' (RFC 1123)"
+	case "isuuid":
+		return "must follow the xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx format"
+	case "startswithalphanum":
+		return "must start with an alphanumeric character"
+	case "endwithalphanum":
+		return "must end with an alphanumeric character"
+	case "min":
+		return "must be at least " + fieldError.Param()
+	case "max":
+		return "must be at most " + fieldError.Param()
+	case "len":
+		return "must be " + fieldError.Param() + " characters long"
+	case "oneof":
+		return "must be one of " + fieldError.Param()
+	default:
+		return fmt.Sprintf("is invalid (%s)", fieldError.Tag())
+	}
+}
+
+// Cluster names are RFC 1123 labels
+var clusterNamePattern = regexp.MustCompile("^[a-z0-9]([a-z0-9-]*[a-z0-9])?$")
+
+// Expected UUID format
+var uuidPattern = regexp.MustCompile(`^[a-zA-Z0-9]{8}-[a-zA-Z0-9]{4}-[a-zA-Z0-9]{4}-[a-zA-Z0-9]{4}-[a-zA-Z0-9]{12}$`)
+
+func isValidClusterName(fl validator.FieldLevel) bool {
 	// Check if the clusterName matches the pattern
-	return regex.MatchString(clusterName)
+	return clusterNamePattern.MatchString(fl.Field().String())
 }
 
 func startsWithAlphanum(fl validator.FieldLevel) bool {
-	firstChar, _ := utf8.DecodeLastRuneInString(fl.Field().String())
+	firstChar, _ := utf8.DecodeRuneInString(fl.Field().String())
 	return unicode.IsLetter(firstChar) || unicode.IsDigit(firstChar)
 }
 
@@ -31,10 +143,8 @@ func endWithAlphanum(fl validator.FieldLevel) bool {
 	lastChar, _ := utf8.DecodeLastRuneInString(fl.Field().String())
 	return unicode.IsLetter(lastChar) || unicode.IsDigit(lastChar)
 }
-func isUUID(fl validator.FieldLevel) bool {
-	// Define the expected UUID format using a regular expression
-	uuidPattern := regexp.MustCompile(`^[a-zA-Z0-9]{8}-[a-zA-Z0-9]{4}-[a-zA-Z0-9]{4}-[a-zA-Z0-9]{4}-[a-zA-Z0-9]{12}$`)
 
+func isUUID(fl validator.FieldLevel) bool {
 	// Check if the field matches the expected UUID format
 	return uuidPattern.MatchString(fl.Field().String())
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/OneKonsole/web-service-billing/auth"
+	helpers "github.com/OneKonsole/web-service-billing/helpers"
+)
+
+// Paypal rejects PayPal-Request-Id values longer than this
+const maxIdempotencyKeyLength = 108
+
+// Interval between two purges of the expired idempotency keys
+const idempotencyPurgeInterval = time.Hour
+
+// Context key of the idempotency key forwarded to the payment providers
+type providerKeyContext struct{}
+
+// providerIdempotencyKey returns the key the payment providers receive for a request, empty without Idempotency-Key
+func providerIdempotencyKey(r *http.Request) string {
+	key, _ := r.Context().Value(providerKeyContext{}).(string)
+	return key
+}
+
+// recordingWriter keeps a copy of the response written to the client
+type recordingWriter struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+// ===========================================================================================================
+// Makes a handler idempotent with the Idempotency-Key header. The first request made with a key is
+// processed and its successful response stored. Requests replayed with the same key and body get the
+// stored response, requests with the same key and another body are refused (409). Failed requests
+// release their key so they can be retried, even when the handler panics. Requests without key are
+// processed as usual. Payment providers receive a key derived from the user, the key and the body,
+// so a key sent by a client never reaches them as is.
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	next (http.HandlerFunc) : Handler to protect
+//
+// Returns:
+//
+//	(http.HandlerFunc) : Idempotent handler
+//
+// Examples:
+//
+//	a.Router.HandleFunc("/order/create", a.authenticated(a.idempotent(a.createOrder))).Methods("POST")
+//
+// ===========================================================================================================
+func (a *App) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			helpers.RespondWithError(w, helpers.ValidationError(fmt.Sprintf("Idempotency-Key can not exceed %d characters", maxIdempotencyKeyLength), nil))
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			helpers.RespondWithError(w, helpers.ValidationError("Could not read request", nil))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// Keys of different users never collide
+		if claims := auth.ClaimsFromContext(r.Context()); claims != nil {
+			key = claims.Subject + ":" + key
+		}
+
+		hash := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+		fingerprint := hex.EncodeToString(hash[:])
+
+		previous, err := a.Store.ReserveIdempotencyKey(key, fingerprint)
+		if err != nil {
+			fmt.Printf("[ERROR] Could not reserve idempotency key %s: %s\n", key, err)
+			helpers.RespondWithError(w, helpers.InternalError("Could not process request", err))
+			return
+		}
+		switch {
+		case previous == nil:
+		case previous.Fingerprint != fingerprint:
+			helpers.RespondWithError(w, helpers.ConflictError("Idempotency-Key already used with another request", nil))
+			return
+		case previous.InProgress():
+			helpers.RespondWithError(w, helpers.ConflictError("A request with this Idempotency-Key is being processed", nil))
+			return
+		default:
+			fmt.Printf("[INFO] Replaying response of idempotency key %s\n", key)
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(previous.StatusCode)
+			w.Write(previous.Body)
+			return
+		}
+
+		providerHash := sha256.Sum256([]byte(key + "\n" + fingerprint))
+		r = r.WithContext(context.WithValue(r.Context(), providerKeyContext{}, hex.EncodeToString(providerHash[:])))
+
+		recorder := &recordingWriter{ResponseWriter: w}
+		completed := false
+		// Deferred so that a panic of the handler releases the key too
+		defer func() {
+			var err error
+			if completed && recorder.statusCode >= 200 && recorder.statusCode <= 299 {
+				err = a.Store.CompleteIdempotencyKey(key, recorder.statusCode, recorder.body.Bytes())
+			} else {
+				err = a.Store.ReleaseIdempotencyKey(key)
+			}
+			if err != nil {
+				fmt.Printf("[ERROR] Could not save idempotency key %s: %s\n", key, err)
+			}
+		}()
+
+		next(recorder, r)
+		completed = true
+	}
+}
+
+// ===========================================================================================================
+// Deletes the idempotency keys that can not be replayed anymore, every idempotencyPurgeInterval.
+// Runs until the service stops.
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Examples:
+//
+//	go a.purgeIdempotencyKeys()
+//
+// ===========================================================================================================
+func (a *App) purgeIdempotencyKeys() {
+	ticker := time.NewTicker(idempotencyPurgeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		purged, err := a.Store.PurgeIdempotencyKeys()
+		if err != nil {
+			fmt.Printf("[ERROR] Could not purge idempotency keys: %s\n", err)
+			continue
+		}
+		if purged > 0 {
+			fmt.Printf("[INFO] Purged %d expired idempotency keys\n", purged)
+		}
+	}
+}
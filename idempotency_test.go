@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/OneKonsole/web-service-billing/auth"
+	paypalOrder "github.com/OneKonsole/web-service-billing/paypal"
+)
+
+func openTestStore(t *testing.T) *paypalOrder.BoltOrderStore {
+	t.Helper()
+	store, err := paypalOrder.NewBoltOrderStore(filepath.Join(t.TempDir(), "billing.db"))
+	if err != nil {
+		t.Fatalf("NewBoltOrderStore() error = %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// idempotentRequest sends a request with an Idempotency-Key made by a user
+func idempotentRequest(handler http.Handler, userID string, key string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/order/create", strings.NewReader(body))
+	r.Header.Set("Idempotency-Key", key)
+	r = r.WithContext(auth.WithClaims(r.Context(), &auth.Claims{Subject: userID}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestIdempotentReleasesKeyOnPanic(t *testing.T) {
+	a := &App{Store: openTestStore(t)}
+	calls := 0
+	handler := withRecovery(a.idempotent(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			panic("handler failure")
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	if w := idempotentRequest(handler, "alice", "key-1", "{}"); w.Code != http.StatusInternalServerError {
+		t.Fatalf("first request status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	// Retried right away, the key must not be left in progress
+	if w := idempotentRequest(handler, "alice", "key-1", "{}"); w.Code != http.StatusOK {
+		t.Fatalf("retried request status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if calls != 2 {
+		t.Errorf("handler called %d times, want 2", calls)
+	}
+}
+
+func TestIdempotentProviderKey(t *testing.T) {
+	a := &App{Store: openTestStore(t)}
+	var providerKeys []string
+	handler := a.idempotent(func(w http.ResponseWriter, r *http.Request) {
+		providerKeys = append(providerKeys, providerIdempotencyKey(r))
+		// Released so the same key can be sent again
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	idempotentRequest(handler, "alice", "key-1", `{"cluster": "a"}`)
+	idempotentRequest(handler, "alice", "key-1", `{"cluster": "a"}`)
+	idempotentRequest(handler, "bob", "key-1", `{"cluster": "a"}`)
+	idempotentRequest(handler, "alice", "key-1", `{"cluster": "b"}`)
+
+	for _, key := range providerKeys {
+		if key == "" || strings.Contains(key, "key-1") || len(key) > maxIdempotencyKeyLength {
+			t.Fatalf("provider key %q must be derived from the client key", key)
+		}
+	}
+	if providerKeys[0] != providerKeys[1] {
+		t.Errorf("retried request got provider key %q, want %q", providerKeys[1], providerKeys[0])
+	}
+	if providerKeys[2] == providerKeys[0] {
+		t.Errorf("another user got the same provider key %q", providerKeys[2])
+	}
+	if providerKeys[3] == providerKeys[0] {
+		t.Errorf("another request body got the same provider key %q", providerKeys[3])
+	}
+
+	// No provider key without Idempotency-Key
+	r := httptest.NewRequest("POST", "/order/create", strings.NewReader("{}"))
+	if key := providerIdempotencyKey(r); key != "" {
+		t.Errorf("providerIdempotencyKey() = %q, want none", key)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+
+	helpers "github.com/OneKonsole/web-service-billing/helpers"
+)
+
+// Request IDs sent by the clients (e.g. the ingress) are kept if they look like one
+var requestIDPattern = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+
+// ===========================================================================================================
+// Gives an ID to every request, sent back in the X-Request-Id header and in error responses
+// so a failure seen by a client can be found in the logs. The ID sent by the client is kept.
+//
+// Parameters:
+//
+//	next (http.Handler) : Handler of the request
+//
+// Examples:
+//
+//	a.Router.Use(withRequestID)
+//
+// ===========================================================================================================
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(helpers.RequestIDHeader)
+		if !requestIDPattern.MatchString(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set(helpers.RequestIDHeader, requestID)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newRequestID returns a random request ID
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(id)
+}
+
+// ===========================================================================================================
+// Answers a 500 instead of dropping the connection when a handler panics.
+// The panic and its stack trace are logged with the request ID.
+//
+// Parameters:
+//
+//	next (http.Handler) : Handler of the request
+//
+// Examples:
+//
+//	a.Router.Use(withRecovery)
+//
+// ===========================================================================================================
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			// Aborting the response is how net/http expects to be interrupted
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			fmt.Printf("[ERROR] Panic on %s %s (request %s): %v\n%s\n",
+				r.Method, r.URL.Path, w.Header().Get(helpers.RequestIDHeader), recovered, debug.Stack())
+			helpers.RespondWithError(w, helpers.InternalError("Internal error", fmt.Errorf("panic: %v", recovered)))
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
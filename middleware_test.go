@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	helpers "github.com/OneKonsole/web-service-billing/helpers"
+	"github.com/gorilla/mux"
+)
+
+// newMiddlewareServer returns a router with the middlewares of the service and the given route
+func newMiddlewareServer(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	router := mux.NewRouter()
+	router.Use(withRequestID, withRecovery)
+	router.HandleFunc("/test", handler)
+
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// get calls the test route with the given request ID, and decodes the error response
+func get(t *testing.T, server *httptest.Server, requestID string) (*http.Response, helpers.ErrorResponse) {
+	t.Helper()
+	req, err := http.NewRequest("GET", server.URL+"/test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requestID != "" {
+		req.Header.Set(helpers.RequestIDHeader, requestID)
+	}
+
+	res, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var response helpers.ErrorResponse
+	json.NewDecoder(res.Body).Decode(&response)
+	return res, response
+}
+
+func TestErrorResponses(t *testing.T) {
+	cause := errors.New("connection refused")
+
+	tests := []struct {
+		err        error
+		wantStatus int
+		wantCode   helpers.ErrorCode
+	}{
+		{err: helpers.ValidationError("Invalid payload", nil), wantStatus: http.StatusBadRequest, wantCode: helpers.CodeValidation},
+		{err: helpers.UnauthorizedError("Invalid token"), wantStatus: http.StatusUnauthorized, wantCode: helpers.CodeUnauthorized},
+		{err: helpers.PaymentRequiredError("Payment not verified", cause), wantStatus: http.StatusPaymentRequired, wantCode: helpers.CodePaymentRequired},
+		{err: helpers.ForbiddenError("Administrator role required"), wantStatus: http.StatusForbidden, wantCode: helpers.CodeForbidden},
+		{err: helpers.NotFoundError("Unknown order", cause), wantStatus: http.StatusNotFound, wantCode: helpers.CodeNotFound},
+		{err: helpers.ConflictError("Order already handled", cause), wantStatus: http.StatusConflict, wantCode: helpers.CodeConflict},
+		{err: helpers.InternalError("Could not read order", cause), wantStatus: http.StatusInternalServerError, wantCode: helpers.CodeInternal},
+		{err: helpers.PaymentProviderError("Could not create order", cause), wantStatus: http.StatusBadGateway, wantCode: helpers.CodePaymentProvider},
+		{err: helpers.UpstreamUnavailableError("Could not create order", cause), wantStatus: http.StatusServiceUnavailable, wantCode: helpers.CodeUpstreamUnavailable},
+		// Errors that are not typed are answered as internal errors, without their message
+		{err: cause, wantStatus: http.StatusInternalServerError, wantCode: helpers.CodeInternal},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.wantCode), func(t *testing.T) {
+			server := newMiddlewareServer(t, func(w http.ResponseWriter, r *http.Request) {
+				helpers.RespondWithError(w, test.err)
+			})
+
+			res, response := get(t, server, "")
+			if res.StatusCode != test.wantStatus || response.Code != test.wantCode {
+				t.Errorf("response = %d %s, want %d %s", res.StatusCode, response.Code, test.wantStatus, test.wantCode)
+			}
+			if response.Message == "" || response.Message == cause.Error() {
+				t.Errorf("message = %q, want the message of the error without its cause", response.Message)
+			}
+			if contentType := res.Header.Get("Content-Type"); contentType != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", contentType)
+			}
+		})
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	server := newMiddlewareServer(t, func(w http.ResponseWriter, r *http.Request) {
+		helpers.RespondWithError(w, helpers.NotFoundError("Unknown order", nil))
+	})
+
+	tests := []struct {
+		name     string
+		sent     string
+		wantKept bool
+	}{
+		{name: "generated", sent: ""},
+		{name: "sent by the client", sent: "ingress-1234.abcd", wantKept: true},
+		{name: "invalid", sent: "id with spaces"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, response := get(t, server, test.sent)
+
+			requestID := res.Header.Get(helpers.RequestIDHeader)
+			if requestID == "" || response.RequestID != requestID {
+				t.Fatalf("request ID = %q in the header and %q in the body, want the same ID", requestID, response.RequestID)
+			}
+			if kept := requestID == test.sent; kept != test.wantKept {
+				t.Errorf("request ID = %q for %q sent, want kept: %v", requestID, test.sent, test.wantKept)
+			}
+		})
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	server := newMiddlewareServer(t, func(w http.ResponseWriter, r *http.Request) {
+		var orders map[string]string
+		orders["PAY-1"] = "CREATED"
+	})
+
+	res, response := get(t, server, "request-1")
+	if res.StatusCode != http.StatusInternalServerError || response.Code != helpers.CodeInternal {
+		t.Fatalf("response = %d %s, want %d %s", res.StatusCode, response.Code, http.StatusInternalServerError, helpers.CodeInternal)
+	}
+	if response.RequestID != "request-1" || response.Message == "" {
+		t.Errorf("response = %+v, want a message and the request ID", response)
+	}
+
+	// The server keeps answering after a panic
+	if res, _ := get(t, server, ""); res.StatusCode != http.StatusInternalServerError {
+		t.Errorf("second response = %d, want %d", res.StatusCode, http.StatusInternalServerError)
+	}
+}
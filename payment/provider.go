@@ -0,0 +1,127 @@
+package payment
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/OneKonsole/web-service-billing/pricing"
+)
+
+// State of a payment, common to every provider
+type State string
+
+const (
+	StatePending    State = "PENDING"    // Waiting for the customer
+	StateApproved   State = "APPROVED"   // Approved by the customer, not authorized yet
+	StateProcessing State = "PROCESSING" // Paid by the customer, money still being transferred (e.g. SEPA debit)
+	StateAuthorized State = "AUTHORIZED" // Money held on the customer account, not captured yet
+	StateCaptured   State = "CAPTURED"   // Money received
+	StateCancelled  State = "CANCELLED"  // Abandoned, expired or cancelled
+	StateFailed     State = "FAILED"     // Declined by the provider
+)
+
+var ErrUnknownProvider = errors.New("unknown payment provider")
+
+// StatusError is an unexpected HTTP response of a payment provider
+type StatusError struct {
+	Provider   string
+	StatusCode int
+	Operation  string // e.g. the requested path
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected %s status code %d on %s", e.Provider, e.StatusCode, e.Operation)
+}
+
+// Unavailable reports whether the provider failed on its side
+func (e *StatusError) Unavailable() bool {
+	return IsUnavailableStatus(e.StatusCode)
+}
+
+// IsUnavailableStatus reports whether an HTTP status code means the provider can not serve requests for now
+func IsUnavailableStatus(statusCode int) bool {
+	return statusCode >= http.StatusInternalServerError || statusCode == http.StatusTooManyRequests
+}
+
+// ===================================================================
+// Reports whether a provider request failed because the provider
+// could not be reached or is failing, rather than refusing it
+//
+// Parameters:
+//
+//	(error) err : Error returned by a provider
+//
+// Return:
+//
+//	(bool) : True if the request may succeed later
+//
+// ===================================================================
+func IsUnavailable(err error) bool {
+	// Network errors and timeouts of the HTTP client
+	var urlError *url.Error
+	if errors.As(err, &urlError) {
+		return true
+	}
+
+	var unavailable interface{ Unavailable() bool }
+	if errors.As(err, &unavailable) {
+		return unavailable.Unavailable()
+	}
+	return false
+}
+
+// CheckoutRequest holds what a provider needs to create a checkout
+type CheckoutRequest struct {
+	Reference   string        // Our reference of the customer, e.g. the user ID
+	Description string        // e.g. "OneKonsole cluster my-cluster"
+	Quote       pricing.Quote // Itemized price of the order
+	Amount      pricing.Money // Amount to pay, the quote gross amount
+	// Key making retries of the creation safe on the provider, may be empty
+	IdempotencyKey string
+}
+
+// Checkout is a payment created on a provider, waiting for the customer
+type Checkout struct {
+	ID          string `json:"order_id"`
+	Provider    string `json:"provider"`
+	Status      string `json:"status"`                 // Status as returned by the provider
+	ApprovalURL string `json:"approval_url,omitempty"` // Page where the customer pays
+}
+
+// Status is the state of a checkout on its provider
+type Status struct {
+	CheckoutID      string
+	ProviderStatus  string // Status as returned by the provider, e.g. "COMPLETED"
+	State           State
+	Amount          pricing.Money
+	AuthorizationID string // Set once authorized
+	CaptureID       string // Set once captured, used to refund
+}
+
+// Refund is money given back to the customer
+type Refund struct {
+	ID     string        `json:"id"`
+	Status string        `json:"status"`
+	Amount pricing.Money `json:"amount"`
+}
+
+// PaymentProvider is a payment service customers can pay their orders with
+type PaymentProvider interface {
+	// Name identifies the provider in the orders, e.g. "paypal"
+	Name() string
+	// CreateCheckout creates a payment the customer has to approve
+	CreateCheckout(request CheckoutRequest) (Checkout, error)
+	// GetStatus returns the current state of a checkout
+	GetStatus(checkoutID string) (Status, error)
+	// Authorize holds the money of an approved checkout until it is captured
+	Authorize(checkoutID string) (Status, error)
+	// Capture takes the money of an authorized checkout
+	Capture(checkoutID string) (Status, error)
+	// Refund gives back a captured payment, entirely when amount is nil.
+	// A refund retried with the same idempotency key is only made once.
+	Refund(captureID string, amount *pricing.Money, reason string, idempotencyKey string) (Refund, error)
+	// Cancel abandons a checkout that has not been paid, voiding its authorization
+	Cancel(checkoutID string) error
+}
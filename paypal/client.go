@@ -0,0 +1,323 @@
+package paypal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/OneKonsole/web-service-billing/payment"
+)
+
+// Paypal environments
+const (
+	EnvironmentSandbox = "sandbox"
+	EnvironmentLive    = "live"
+)
+
+// Timeout of the requests sent to Paypal when none is configured
+const DefaultRequestTimeout = 30 * time.Second
+
+// API base URL of each Paypal environment
+var environmentURLs = map[string]string{
+	EnvironmentSandbox: "https://api-m.sandbox.paypal.com",
+	EnvironmentLive:    "https://api-m.paypal.com",
+}
+
+var ErrUnknownEnvironment = errors.New("unknown Paypal environment")
+
+// Client sends every request made to the Paypal API
+type Client struct {
+	BaseURL     string // e.g. "https://api-m.sandbox.paypal.com"
+	Environment string // sandbox or live
+	HTTPClient  *http.Client
+	tokens      *TokenProvider
+}
+
+// ===================================================================
+// Returns a Paypal API client
+//
+// Parameters:
+//
+//	(string) environment : sandbox or live, sandbox if empty
+//	(string) baseURL : API base URL overriding the environment one, e.g. a local fake
+//	(string) clientID : Paypal Client ID (owner)
+//	(string) clientSecret : Paypal Client Secret (owner)
+//	(*http.Client) httpClient : Client used for the requests, one with DefaultRequestTimeout if nil
+//
+// Return
+//
+//	(*Client) : Client of the Paypal API
+//	(error) : ErrUnknownEnvironment or nil if no error occurs
+//
+// Example:
+//
+//	client, err := NewClient("live", "", "xxxx", "yyyy", nil)
+//
+// ===================================================================
+func NewClient(environment string, baseURL string, clientID string, clientSecret string, httpClient *http.Client) (*Client, error) {
+	if environment == "" {
+		environment = EnvironmentSandbox
+	}
+	environmentURL, ok := environmentURLs[environment]
+	if !ok {
+		return nil, fmt.Errorf("%w %q, expected %s or %s", ErrUnknownEnvironment, environment, EnvironmentSandbox, EnvironmentLive)
+	}
+	if baseURL == "" {
+		baseURL = environmentURL
+	}
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: DefaultRequestTimeout}
+	}
+
+	client := &Client{
+		BaseURL:     strings.TrimSuffix(baseURL, "/"),
+		Environment: environment,
+		HTTPClient:  httpClient,
+	}
+	client.tokens = NewTokenProvider(client.BaseURL+"/v1/oauth2/token", clientID, clientSecret, httpClient)
+
+	return client, nil
+}
+
+// ===================================================================
+// Prepares an authenticated request to the Paypal API
+//
+// Parameters:
+//
+//	(string) method : HTTP method
+//	(string) path : API path, e.g. "/v2/checkout/orders"
+//	(interface{}) body : Value sent as JSON, or nil
+//
+// Used on:
+//
+//	(*Client) c : Paypal API client
+//
+// Return
+//
+//	(*http.Request) : Request carrying the access token
+//	(error) : Error during the process or nil if no error occurs
+//
+// ===================================================================
+func (c *Client) newRequest(method string, path string, body interface{}) (*http.Request, error) {
+	accessToken, err := c.tokens.Token()
+	if err != nil {
+		fmt.Printf("[ERROR] Invalid client information for authentication : %s\n", err)
+		return nil, err
+	}
+
+	var payload io.Reader
+	if body != nil {
+		bodyJson, err := json.Marshal(body)
+		if err != nil {
+			fmt.Printf("[ERROR] Invalid payload: %s\n", err)
+			return nil, err
+		}
+		payload = bytes.NewBuffer(bodyJson)
+	}
+
+	url := path
+	if strings.HasPrefix(path, "/") {
+		url = c.BaseURL + path
+	}
+
+	req, err := http.NewRequest(method, url, payload)
+	if err != nil {
+		fmt.Printf("[ERROR] Unable to initiate http request: %s\n", err)
+		return nil, err
+	}
+
+	// Add request headers
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+
+	return req, nil
+}
+
+// ===================================================================
+// Paypal API designed request to create an order
+//
+// Parameters:
+//
+//	(payment.CheckoutRequest) request : Details about the order requested
+//
+// Used on:
+//
+//	(*Client) c : Paypal API client
+//
+// Return:
+//
+//	(PaypalOrderResponse) : Struct used to create a consistant HTTP response
+//	(error) : Error during process or nil if no error occurs
+//
+// Example:
+//
+//	orderResponse, err := client.CreateOrder(payment.CheckoutRequest{...})
+//
+// ===================================================================
+func (c *Client) CreateOrder(request payment.CheckoutRequest) (PaypalOrderResponse, error) {
+	breakdown := map[string]interface{}{
+		"item_total": request.Quote.Subtotal,
+		"tax_total":  request.Quote.Tax.Amount,
+	}
+	if request.Quote.Discount != nil {
+		breakdown["discount"] = request.Quote.Discount.Amount
+	}
+
+	bodyMap := map[string]interface{}{
+		"purchase_units": []map[string]interface{}{
+			{
+				"description": request.Description,
+				"custom_id":   request.Reference,
+				"items":       paypalItems(request.Quote),
+				"amount": map[string]interface{}{
+					"currency_code": request.Amount.Currency,
+					"value":         request.Amount.String(),
+					"breakdown":     breakdown,
+				},
+			},
+		},
+		// The payment is only captured once the cluster has been provisioned
+		"intent": "AUTHORIZE",
+	}
+
+	req, err := c.newRequest("POST", "/v2/checkout/orders", bodyMap)
+	if err != nil {
+		return PaypalOrderResponse{}, err
+	}
+	// Paypal returns the order already created when the request is retried
+	if request.IdempotencyKey != "" {
+		req.Header.Add("PayPal-Request-Id", request.IdempotencyKey)
+	}
+
+	// Actually make the request
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		fmt.Printf("[ERROR] Unable to initiate http client, %s\n", err)
+		return PaypalOrderResponse{}, err
+	}
+
+	defer res.Body.Close()
+
+	// Create an HTTP response for this order creation
+	var orderRes PaypalOrderResponse
+
+	// If the order was created, create the response.
+	// A retried request returns the order created by the first one.
+	if res.StatusCode == http.StatusCreated || res.StatusCode == http.StatusOK {
+		decoder := json.NewDecoder(res.Body)
+
+		err = decoder.Decode(&orderRes)
+		if err != nil {
+			return PaypalOrderResponse{}, err
+		}
+	} else {
+		return PaypalOrderResponse{}, &payment.StatusError{Provider: "Paypal", StatusCode: res.StatusCode, Operation: "order creation"}
+	}
+
+	return orderRes, nil
+}
+
+// ===================================================================
+// Returns the details of a Paypal order
+//
+// Parameters:
+//
+//	(string) orderID : ID of the Paypal order
+//
+// Used on:
+//
+//	(*Client) c : Paypal API client
+//
+// Return:
+//
+//	(PaypalOrderDetails) : Status, amount and payments of the order
+//	(error) : Error during process or nil if no error occurs
+//
+// Example:
+//
+//	details, err := client.GetOrder("xyYxyZ")
+//
+// ===================================================================
+func (c *Client) GetOrder(orderID string) (PaypalOrderDetails, error) {
+	req, err := c.newRequest("GET", "/v2/checkout/orders/"+orderID, nil)
+	if err != nil {
+		return PaypalOrderDetails{}, err
+	}
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return PaypalOrderDetails{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return PaypalOrderDetails{}, &payment.StatusError{Provider: "Paypal", StatusCode: res.StatusCode, Operation: "order " + orderID}
+	}
+
+	var details PaypalOrderDetails
+	if err := json.NewDecoder(res.Body).Decode(&details); err != nil {
+		return PaypalOrderDetails{}, err
+	}
+
+	return details, nil
+}
+
+// ===================================================================
+// Asks Paypal to verify the signature of a webhook event
+//
+// Parameters:
+//
+//	(string) webhookID : ID of the webhook configured on Paypal
+//	(http.Header) headers : Headers of the webhook request, carrying the signature
+//	([]byte) body : Raw event, as received
+//
+// Used on:
+//
+//	(*Client) c : Paypal API client
+//
+// Return:
+//
+//	(error) : ErrInvalidWebhookSignature, a request error or nil if the event is authentic
+//
+// ===================================================================
+func (c *Client) VerifyWebhookSignature(webhookID string, headers http.Header, body []byte) error {
+	req, err := c.newRequest("POST", "/v1/notifications/verify-webhook-signature", map[string]interface{}{
+		"auth_algo":         headers.Get("PAYPAL-AUTH-ALGO"),
+		"cert_url":          headers.Get("PAYPAL-CERT-URL"),
+		"transmission_id":   headers.Get("PAYPAL-TRANSMISSION-ID"),
+		"transmission_sig":  headers.Get("PAYPAL-TRANSMISSION-SIG"),
+		"transmission_time": headers.Get("PAYPAL-TRANSMISSION-TIME"),
+		"webhook_id":        webhookID,
+		"webhook_event":     json.RawMessage(body),
+	})
+	if err != nil {
+		return err
+	}
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return &payment.StatusError{Provider: "Paypal", StatusCode: res.StatusCode, Operation: "webhook signature verification"}
+	}
+
+	var verification struct {
+		Status string `json:"verification_status"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&verification); err != nil {
+		return err
+	}
+	if verification.Status != "SUCCESS" {
+		return fmt.Errorf("%w (%s)", ErrInvalidWebhookSignature, verification.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package paypal
+
+import (
+	"encoding/json"
+
+	"github.com/OneKonsole/web-service-billing/pricing"
+	bolt "go.etcd.io/bbolt"
+)
+
+// couponRedemptionsRecord counts the redemptions of a coupon
+type couponRedemptionsRecord struct {
+	Total  int            `json:"total"`
+	ByUser map[string]int `json:"by_user"`
+}
+
+// releasesCoupon reports whether an order reaching a status gives its coupon redemption back:
+// the order ended without being paid, or its payment was given back
+func releasesCoupon(status OrderStatus) bool {
+	switch status {
+	case StatusExpired, StatusCancelled, StatusFailed, StatusRefunded:
+		return true
+	default:
+		return false
+	}
+}
+
+// CouponRedemptions returns the redemptions of a coupon, in total and by a user
+func (s *BoltOrderStore) CouponRedemptions(code string, userID string) (int, int, error) {
+	var record *couponRedemptionsRecord
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		found, err := getCouponRedemptions(tx, code)
+		record = found
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return record.Total, record.ByUser[userID], nil
+}
+
+// ===================================================================
+// Counts a redemption of a coupon if its limits allow it. The counters
+// are checked and incremented in a single transaction, so concurrent
+// orders can not exceed the limits.
+//
+// Parameters:
+//
+//	(string) code : Normalized coupon code
+//	(string) userID : ID of the user ordering
+//	(func(int, int) error) check : Checks the current total and user counters
+//
+// Used on:
+//
+//	(*BoltOrderStore) s : Store counting the redemptions
+//
+// Return
+//
+//	(error) : Error returned by check, store error or nil if the redemption is counted
+//
+// Example:
+//
+//	err := store.RedeemCoupon("WELCOME10", "xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx", coupon.checkLimits)
+//
+// ===================================================================
+func (s *BoltOrderStore) RedeemCoupon(code string, userID string, check func(total int, byUser int) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		record, err := getCouponRedemptions(tx, code)
+		if err != nil {
+			return err
+		}
+		if err := check(record.Total, record.ByUser[userID]); err != nil {
+			return err
+		}
+
+		record.Total++
+		record.ByUser[userID]++
+		return putCouponRedemptions(tx, code, record)
+	})
+}
+
+// ReleaseCoupon cancels a redemption of a coupon
+func (s *BoltOrderStore) ReleaseCoupon(code string, userID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return releaseCouponTx(tx, code, userID)
+	})
+}
+
+// releaseCouponTx decrements the counters of a coupon, never below zero
+func releaseCouponTx(tx *bolt.Tx, code string, userID string) error {
+	record, err := getCouponRedemptions(tx, code)
+	if err != nil {
+		return err
+	}
+
+	if record.Total > 0 {
+		record.Total--
+	}
+	if record.ByUser[userID] > 1 {
+		record.ByUser[userID]--
+	} else {
+		delete(record.ByUser, userID)
+	}
+	return putCouponRedemptions(tx, code, record)
+}
+
+// releaseOrderCoupon gives back the coupon redemption of an order that just reached a status
+// releasing it. Final statuses are reached once, so the redemption is released once.
+func releaseOrderCoupon(tx *bolt.Tx, previous OrderStatus, order *OrderRecord) error {
+	if order.Infos.CouponCode == "" || previous == order.Status || !releasesCoupon(order.Status) {
+		return nil
+	}
+
+	return releaseCouponTx(tx, pricing.NormalizeCouponCode(order.Infos.CouponCode), order.Infos.Order.UserID)
+}
+
+func getCouponRedemptions(tx *bolt.Tx, code string) (*couponRedemptionsRecord, error) {
+	record := &couponRedemptionsRecord{}
+	if value := tx.Bucket(couponRedemptionsBucket).Get([]byte(code)); value != nil {
+		if err := json.Unmarshal(value, record); err != nil {
+			return nil, err
+		}
+	}
+	if record.ByUser == nil {
+		record.ByUser = make(map[string]int)
+	}
+
+	return record, nil
+}
+
+func putCouponRedemptions(tx *bolt.Tx, code string, record *couponRedemptionsRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(couponRedemptionsBucket).Put([]byte(code), value)
+}
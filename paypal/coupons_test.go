@@ -0,0 +1,106 @@
+package paypal
+
+import (
+	"errors"
+	"testing"
+)
+
+var errLimit = errors.New("limit reached")
+
+// maxOne accepts a redemption only if the coupon has never been redeemed
+func maxOne(total int, byUser int) error {
+	if total >= 1 {
+		return errLimit
+	}
+	return nil
+}
+
+func TestCouponRedemptionsSurviveRestart(t *testing.T) {
+	store, path := openTestStore(t)
+
+	if err := store.RedeemCoupon("LAUNCH", "alice", maxOne); err != nil {
+		t.Fatalf("RedeemCoupon() error = %v", err)
+	}
+	store.Close()
+
+	reopened, err := NewBoltOrderStore(path)
+	if err != nil {
+		t.Fatalf("NewBoltOrderStore() error = %v", err)
+	}
+	defer reopened.Close()
+
+	total, byUser, err := reopened.CouponRedemptions("LAUNCH", "alice")
+	if err != nil || total != 1 || byUser != 1 {
+		t.Fatalf("CouponRedemptions() = %d, %d, %v, want 1, 1", total, byUser, err)
+	}
+	if err := reopened.RedeemCoupon("LAUNCH", "bob", maxOne); !errors.Is(err, errLimit) {
+		t.Fatalf("RedeemCoupon() error = %v, want %v", err, errLimit)
+	}
+}
+
+func TestCouponReleasedWhenOrderEndsUnpaid(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        []OrderStatus
+		wantCounted int
+	}{
+		{name: "expired", path: []OrderStatus{StatusExpired}, wantCounted: 0},
+		{name: "cancelled", path: []OrderStatus{StatusApproved, StatusCancelled}, wantCounted: 0},
+		{name: "failed", path: []OrderStatus{StatusApproved, StatusFailed}, wantCounted: 0},
+		{name: "refunded", path: []OrderStatus{StatusApproved, StatusCaptured, StatusRefunded}, wantCounted: 0},
+		{name: "partially refunded", path: []OrderStatus{StatusApproved, StatusCaptured, StatusPartiallyRefunded}, wantCounted: 1},
+		{name: "provisioned", path: []OrderStatus{StatusApproved, StatusAuthorized, StatusProvisioningRequested, StatusProvisioned}, wantCounted: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store, _ := openTestStore(t)
+			if err := store.RedeemCoupon("LAUNCH", "alice", maxOne); err != nil {
+				t.Fatal(err)
+			}
+			order := NewOrderRecord("PAY-1", PaypalOrderInfos{CouponCode: " launch "})
+			order.Infos.Order.UserID = "alice"
+			if err := store.SaveOrder(order); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, status := range test.path {
+				_, err := store.UpdateOrder(order.ID, func(order *OrderRecord) error {
+					return order.Transition(status, "")
+				})
+				if err != nil {
+					t.Fatalf("transition to %s: %v", status, err)
+				}
+			}
+			// Updating a final order again must not release the coupon twice
+			if _, err := store.UpdateOrder(order.ID, func(order *OrderRecord) error { return nil }); err != nil {
+				t.Fatal(err)
+			}
+
+			total, byUser, err := store.CouponRedemptions("LAUNCH", "alice")
+			if err != nil || total != test.wantCounted || byUser != test.wantCounted {
+				t.Errorf("CouponRedemptions() = %d, %d, %v, want %d", total, byUser, err, test.wantCounted)
+			}
+		})
+	}
+}
+
+func TestCouponNotReleasedWhenUpdateFails(t *testing.T) {
+	store, _ := openTestStore(t)
+	store.RedeemCoupon("LAUNCH", "alice", maxOne)
+	order := NewOrderRecord("PAY-1", PaypalOrderInfos{CouponCode: "LAUNCH"})
+	order.Infos.Order.UserID = "alice"
+	store.SaveOrder(order)
+
+	_, err := store.UpdateOrder(order.ID, func(order *OrderRecord) error {
+		order.Transition(StatusExpired, "")
+		return errLimit
+	})
+	if !errors.Is(err, errLimit) {
+		t.Fatalf("UpdateOrder() error = %v, want %v", err, errLimit)
+	}
+
+	if total, _, _ := store.CouponRedemptions("LAUNCH", "alice"); total != 1 {
+		t.Errorf("total redemptions = %d, want 1", total)
+	}
+}
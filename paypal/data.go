@@ -2,15 +2,23 @@ package paypal
 
 import (
 	"sync"
+	"time"
 
 	oko "github.com/OneKonsole/order-model"
+	"github.com/OneKonsole/web-service-billing/payment"
+	"github.com/OneKonsole/web-service-billing/pricing"
 )
 
 // Paypal related
 type PaypalOrderInfos struct {
-	Order          oko.Order `json:"order_details"`
-	CurrencyCode   string    `json:"currency"`
-	MaxAmountValue string    `json:"amount"`
+	Order          oko.Order     `json:"order_details"`
+	CurrencyCode   string        `json:"currency"`
+	Country        string        `json:"country"`
+	VATNumber      string        `json:"vat_number"`
+	CouponCode     string        `json:"coupon_code"`
+	Provider       string        `json:"provider"` // Payment provider, "paypal" (default) or "stripe"
+	MaxAmountValue pricing.Money `json:"amount"`
+	Quote          pricing.Quote `json:"-"`
 }
 type PaypalOrderResponse struct {
 	OrderID string            `json:"id"`
@@ -18,6 +26,37 @@ type PaypalOrderResponse struct {
 	Links   []PaypalOrderLink `json:"links"`
 }
 
+// Order as returned by Paypal GET /v2/checkout/orders/{id}
+type PaypalOrderDetails struct {
+	ID            string               `json:"id"`
+	Intent        string               `json:"intent"`
+	Status        string               `json:"status"`
+	PurchaseUnits []PaypalPurchaseUnit `json:"purchase_units"`
+}
+
+type PaypalPurchaseUnit struct {
+	Amount   pricing.Money  `json:"amount"`
+	Payments PaypalPayments `json:"payments"`
+}
+
+type PaypalPayments struct {
+	Authorizations []PaypalPayment `json:"authorizations"`
+	Captures       []PaypalPayment `json:"captures"`
+}
+
+type PaypalPayment struct {
+	ID     string        `json:"id"`
+	Status string        `json:"status"`
+	Amount pricing.Money `json:"amount"`
+}
+
+type PaypalItem struct {
+	Name       string        `json:"name"`
+	Quantity   string        `json:"quantity"`
+	UnitAmount pricing.Money `json:"unit_amount"`
+	Category   string        `json:"category"`
+}
+
 type PaypalOrderLink struct {
 	Href   string `json:"href"`
 	Rel    string `json:"rel"`
@@ -26,6 +65,14 @@ type PaypalOrderLink struct {
 
 // Generic order related
 type OrderOrchestrator struct {
-	approvalChans map[string]chan bool
-	mutex         sync.Mutex
+	approvalChans     map[string]chan payment.Status
+	securing          map[string]bool // Orders whose payment is being secured
+	mutex             sync.Mutex
+	refundMutex       sync.Mutex
+	provisioningMutex sync.Mutex
+	outboxWake        chan struct{}
+	store             OrderStore
+	paypal            *Client
+	providers         map[string]payment.PaymentProvider
+	approvalTimeout   time.Duration
 }
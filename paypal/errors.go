@@ -0,0 +1,60 @@
+package paypal
+
+import (
+	"errors"
+
+	helpers "github.com/OneKonsole/web-service-billing/helpers"
+	"github.com/OneKonsole/web-service-billing/payment"
+)
+
+// ===================================================================
+// Converts an error of the orchestrator into the error answered to
+// the client. Errors of the order lifecycle keep their message,
+// others are answered with the given message.
+//
+// Parameters:
+//
+//	(string) message : Message answered for provider and internal errors
+//	(error) err : Error returned by the orchestrator
+//
+// Return:
+//
+//	(*helpers.Error) : Error to answer with
+//
+// Example:
+//
+//	helpers.RespondWithError(w, apiError("Could not refund order", err))
+//
+// ===================================================================
+func apiError(message string, err error) *helpers.Error {
+	var transitionError *TransitionError
+	var providerError interface{ Unavailable() bool }
+
+	switch {
+	case errors.Is(err, ErrOrderNotFound):
+		return helpers.NotFoundError("Unknown order", err)
+	case errors.Is(err, ErrMessageNotFound):
+		return helpers.NotFoundError("Unknown outbox message", err)
+	case errors.Is(err, ErrOrderAlreadyHandled),
+		errors.Is(err, ErrNotRefundable),
+		errors.Is(err, ErrRefundPending),
+		errors.Is(err, ErrProvisioningConflict),
+		errors.Is(err, ErrNotProvisioning),
+		errors.Is(err, ErrNotDeadLetter),
+		errors.As(err, &transitionError):
+		return helpers.ConflictError(err.Error(), err)
+	case errors.Is(err, ErrInvalidRefundAmount),
+		errors.Is(err, ErrInvalidProvisioningStatus),
+		errors.Is(err, ErrInvalidCursor),
+		errors.Is(err, payment.ErrUnknownProvider):
+		return &helpers.Error{Code: helpers.CodeValidation, Message: err.Error(), Err: err}
+	case errors.Is(err, ErrPaymentNotVerified):
+		return helpers.PaymentRequiredError(err.Error(), err)
+	case payment.IsUnavailable(err):
+		return helpers.UpstreamUnavailableError(message, err)
+	case errors.As(err, &providerError):
+		return helpers.PaymentProviderError(message, err)
+	default:
+		return helpers.InternalError(message, err)
+	}
+}
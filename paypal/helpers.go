@@ -1,7 +1,32 @@
 package paypal
 
-func NewOrderOchestrator() *OrderOrchestrator {
+import (
+	"time"
+
+	"github.com/OneKonsole/web-service-billing/payment"
+)
+
+// Approval timeout used when none is configured. Paypal itself drops
+// the orders that are not approved within 3 hours.
+const DefaultApprovalTimeout = 3 * time.Hour
+
+func NewOrderOchestrator(store OrderStore, paypal *Client, approvalTimeout time.Duration) *OrderOrchestrator {
+	if approvalTimeout <= 0 {
+		approvalTimeout = DefaultApprovalTimeout
+	}
+
 	return &OrderOrchestrator{
-		approvalChans: make(map[string]chan bool),
+		approvalChans:   make(map[string]chan payment.Status),
+		securing:        make(map[string]bool),
+		store:           store,
+		paypal:          paypal,
+		providers:       map[string]payment.PaymentProvider{ProviderName: paypal},
+		outboxWake:      make(chan struct{}, 1),
+		approvalTimeout: approvalTimeout,
 	}
 }
+
+// RegisterProvider makes a payment provider available to the orders
+func (o *OrderOrchestrator) RegisterProvider(provider payment.PaymentProvider) {
+	o.providers[provider.Name()] = provider
+}
@@ -0,0 +1,181 @@
+package paypal
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// How long a request can be replayed with the same Idempotency-Key
+const IdempotencyKeyTTL = 24 * time.Hour
+
+// How long a request can hold an Idempotency-Key without completing
+// it. Once the lease expires, e.g. the service stopped during the
+// request, the same request can take the key over.
+const IdempotencyLeaseDuration = 5 * time.Minute
+
+// IdempotencyRecord is a request made with an Idempotency-Key and its response
+type IdempotencyRecord struct {
+	Fingerprint string    `json:"fingerprint"`           // Hash of the request body
+	StatusCode  int       `json:"status_code,omitempty"` // 0 while the request is processed
+	Body        []byte    `json:"body,omitempty"`
+	LockedUntil time.Time `json:"locked_until,omitempty"` // End of the lease of the request processing it
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// InProgress reports whether the request is still being processed
+func (r *IdempotencyRecord) InProgress() bool {
+	return r.StatusCode == 0
+}
+
+// expired reports whether the key can be used by any request again
+func (r *IdempotencyRecord) expired(now time.Time) bool {
+	return now.Sub(r.CreatedAt) >= IdempotencyKeyTTL
+}
+
+// abandoned reports whether the request processing the key stopped without completing or releasing it
+func (r *IdempotencyRecord) abandoned(now time.Time) bool {
+	return r.InProgress() && now.After(r.LockedUntil)
+}
+
+// ===================================================================
+// Reserves an Idempotency-Key for a request, unless a request already
+// used it. Keys older than IdempotencyKeyTTL can be reused, and the
+// same request takes over a key whose lease has expired.
+//
+// Parameters:
+//
+//	(string) key : Idempotency-Key sent by the client
+//	(string) fingerprint : Hash of the request body
+//
+// Used on:
+//
+//	(*BoltOrderStore) s : Store persisting the keys
+//
+// Return
+//
+//	(*IdempotencyRecord) : Request that already used the key, nil if the key is now reserved
+//	(error) : Error while reading or saving or nil if no error occurs
+//
+// Example:
+//
+//	previous, err := store.ReserveIdempotencyKey("3f0c...", "9a1b...")
+//
+// ===================================================================
+func (s *BoltOrderStore) ReserveIdempotencyKey(key string, fingerprint string) (*IdempotencyRecord, error) {
+	var previous *IdempotencyRecord
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(idempotencyBucket)
+
+		now := time.Now().UTC()
+		if value := bucket.Get([]byte(key)); value != nil {
+			record := &IdempotencyRecord{}
+			if err := json.Unmarshal(value, record); err != nil {
+				return err
+			}
+			takeOver := record.Fingerprint == fingerprint && record.abandoned(now)
+			if !record.expired(now) && !takeOver {
+				previous = record
+				return nil
+			}
+			if takeOver {
+				fmt.Printf("[INFO] Taking over idempotency key %s, its lease expired at %s\n", key, record.LockedUntil)
+			}
+		}
+
+		value, err := json.Marshal(IdempotencyRecord{
+			Fingerprint: fingerprint,
+			LockedUntil: now.Add(IdempotencyLeaseDuration),
+			CreatedAt:   now,
+		})
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), value)
+	})
+
+	return previous, err
+}
+
+// CompleteIdempotencyKey stores the response of the request that reserved a key
+func (s *BoltOrderStore) CompleteIdempotencyKey(key string, statusCode int, body []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(idempotencyBucket)
+
+		record := &IdempotencyRecord{}
+		if value := bucket.Get([]byte(key)); value != nil {
+			if err := json.Unmarshal(value, record); err != nil {
+				return err
+			}
+		}
+		record.StatusCode = statusCode
+		record.Body = body
+		record.LockedUntil = time.Time{}
+
+		value, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), value)
+	})
+}
+
+// ReleaseIdempotencyKey forgets a key, so that a failed request can be retried with it
+func (s *BoltOrderStore) ReleaseIdempotencyKey(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(idempotencyBucket).Delete([]byte(key))
+	})
+}
+
+// ===================================================================
+// Deletes the keys that can not be replayed anymore: keys older than
+// IdempotencyKeyTTL and keys whose request stopped without releasing
+// them before the end of its lease.
+//
+// Used on:
+//
+//	(*BoltOrderStore) s : Store persisting the keys
+//
+// Return
+//
+//	(int) : Number of keys deleted
+//	(error) : Error while reading or deleting or nil if no error occurs
+//
+// ===================================================================
+func (s *BoltOrderStore) PurgeIdempotencyKeys() (int, error) {
+	purged := 0
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(idempotencyBucket)
+		now := time.Now().UTC()
+
+		var keys [][]byte
+		err := bucket.ForEach(func(key []byte, value []byte) error {
+			record := &IdempotencyRecord{}
+			if err := json.Unmarshal(value, record); err != nil {
+				return err
+			}
+			if record.expired(now) || record.abandoned(now) {
+				keys = append(keys, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// Keys can not be deleted while iterating over the bucket
+		for _, key := range keys {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		purged = len(keys)
+		return nil
+	})
+
+	return purged, err
+}
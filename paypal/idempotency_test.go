@@ -0,0 +1,134 @@
+package paypal
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// putIdempotencyRecord saves a key as left by an earlier request
+func putIdempotencyRecord(t *testing.T, store *BoltOrderStore, key string, record IdempotencyRecord) {
+	t.Helper()
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		value, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(idempotencyBucket).Put([]byte(key), value)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReserveIdempotencyKey(t *testing.T) {
+	now := time.Now().UTC()
+	locked := now.Add(IdempotencyLeaseDuration)
+
+	tests := []struct {
+		name         string
+		previous     *IdempotencyRecord // Saved before the reservation
+		wantReserved bool
+	}{
+		{name: "new key", wantReserved: true},
+		{
+			name:     "request in progress",
+			previous: &IdempotencyRecord{Fingerprint: "body", LockedUntil: locked, CreatedAt: now},
+		},
+		{
+			name:         "lease expired",
+			previous:     &IdempotencyRecord{Fingerprint: "body", LockedUntil: now.Add(-time.Second), CreatedAt: now.Add(-time.Hour)},
+			wantReserved: true,
+		},
+		{
+			name:     "lease expired on another request",
+			previous: &IdempotencyRecord{Fingerprint: "other body", LockedUntil: now.Add(-time.Second), CreatedAt: now.Add(-time.Hour)},
+		},
+		{
+			name:     "request completed",
+			previous: &IdempotencyRecord{Fingerprint: "body", StatusCode: 200, Body: []byte(`{}`), CreatedAt: now.Add(-time.Hour)},
+		},
+		{
+			name:         "key expired",
+			previous:     &IdempotencyRecord{Fingerprint: "other body", StatusCode: 200, CreatedAt: now.Add(-IdempotencyKeyTTL)},
+			wantReserved: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store, _ := openTestStore(t)
+			if test.previous != nil {
+				putIdempotencyRecord(t, store, "alice:key-1", *test.previous)
+			}
+
+			previous, err := store.ReserveIdempotencyKey("alice:key-1", "body")
+			if err != nil {
+				t.Fatalf("ReserveIdempotencyKey() error = %v", err)
+			}
+			if reserved := previous == nil; reserved != test.wantReserved {
+				t.Fatalf("ReserveIdempotencyKey() = %+v, want reserved: %v", previous, test.wantReserved)
+			}
+			if !test.wantReserved {
+				return
+			}
+
+			// The new reservation holds a lease, the same request is refused until it ends
+			again, err := store.ReserveIdempotencyKey("alice:key-1", "body")
+			if err != nil || again == nil || !again.InProgress() || !again.LockedUntil.After(time.Now()) {
+				t.Errorf("ReserveIdempotencyKey() again = %+v, %v, want the reservation in progress", again, err)
+			}
+		})
+	}
+}
+
+func TestCompleteIdempotencyKeyEndsLease(t *testing.T) {
+	store, _ := openTestStore(t)
+	if _, err := store.ReserveIdempotencyKey("alice:key-1", "body"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CompleteIdempotencyKey("alice:key-1", 200, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	previous, err := store.ReserveIdempotencyKey("alice:key-1", "body")
+	if err != nil || previous == nil || previous.InProgress() || !previous.LockedUntil.IsZero() {
+		t.Errorf("ReserveIdempotencyKey() = %+v, %v, want the completed request without lease", previous, err)
+	}
+}
+
+func TestPurgeIdempotencyKeys(t *testing.T) {
+	store, _ := openTestStore(t)
+	now := time.Now().UTC()
+
+	records := map[string]IdempotencyRecord{
+		"in-progress": {Fingerprint: "body", LockedUntil: now.Add(IdempotencyLeaseDuration), CreatedAt: now},
+		"completed":   {Fingerprint: "body", StatusCode: 200, CreatedAt: now.Add(-time.Hour)},
+		"abandoned":   {Fingerprint: "body", LockedUntil: now.Add(-time.Minute), CreatedAt: now.Add(-time.Hour)},
+		"expired":     {Fingerprint: "body", StatusCode: 200, CreatedAt: now.Add(-IdempotencyKeyTTL - time.Minute)},
+	}
+	for key, record := range records {
+		putIdempotencyRecord(t, store, key, record)
+	}
+
+	purged, err := store.PurgeIdempotencyKeys()
+	if err != nil {
+		t.Fatalf("PurgeIdempotencyKeys() error = %v", err)
+	}
+	if purged != 2 {
+		t.Errorf("PurgeIdempotencyKeys() = %d, want 2", purged)
+	}
+
+	for key, wantKept := range map[string]bool{"in-progress": true, "completed": true, "abandoned": false, "expired": false} {
+		var kept bool
+		store.db.View(func(tx *bolt.Tx) error {
+			kept = tx.Bucket(idempotencyBucket).Get([]byte(key)) != nil
+			return nil
+		})
+		if kept != wantKept {
+			t.Errorf("key %s kept = %v, want %v", key, kept, wantKept)
+		}
+	}
+}
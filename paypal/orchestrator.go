@@ -0,0 +1,523 @@
+package paypal
+
+import (
+	"expvar"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/OneKonsole/web-service-billing/payment"
+)
+
+// Counters published on /debug/vars, used to follow the checkout abandonment rate
+var (
+	ordersCreated  = expvar.NewInt("orders_created")
+	ordersApproved = expvar.NewInt("orders_approved")
+	ordersExpired  = expvar.NewInt("orders_expired")
+)
+
+// Payments still being transferred are checked again at this interval
+var settlementPollInterval = 15 * time.Minute
+
+// provider returns the payment provider of an order, Paypal for the
+// orders created before providers could be chosen
+func (o *OrderOrchestrator) provider(name string) (payment.PaymentProvider, error) {
+	if name == "" {
+		name = ProviderName
+	}
+	provider, ok := o.providers[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", payment.ErrUnknownProvider, name)
+	}
+
+	return provider, nil
+}
+
+// registerApproval creates the channel used to signal the approval of an order,
+// carrying the checkout status verified on its provider.
+// The channel is buffered so an approval never blocks once the order has expired.
+func (o *OrderOrchestrator) registerApproval(orderID string) chan payment.Status {
+	approvalChannel := make(chan payment.Status, 1)
+
+	// Ensures synchronisation on approvalChans var (only 1 function can write at a time)
+	o.mutex.Lock()
+	o.approvalChans[orderID] = approvalChannel
+	o.mutex.Unlock()
+
+	return approvalChannel
+}
+
+// ===================================================================
+// Waits for the client approval of an order, then launches it.
+// The order expires when it is not approved before the approval
+// timeout, counted from its creation.
+//
+// Parameters:
+//
+//	(*OrderRecord) order : Order waiting for approval
+//	(chan payment.Status) approvalChannel : Channel receiving the verified approval
+//
+// Used on:
+//
+//	(*OrderOrchestrator) o : Object that permits asynchronous management of the order
+//
+// ===================================================================
+func (o *OrderOrchestrator) waitForApproval(order *OrderRecord, approvalChannel chan payment.Status) {
+	timer := time.NewTimer(time.Until(order.CreatedAt.Add(o.approvalTimeout)))
+	defer timer.Stop()
+
+	var status payment.Status
+	select {
+	case status = <-approvalChannel:
+	case <-timer.C:
+		// Remove the channel so no approval can be sent anymore.
+		// If it is already gone, an approval has just been sent.
+		o.mutex.Lock()
+		_, pending := o.approvalChans[order.ID]
+		delete(o.approvalChans, order.ID)
+		o.mutex.Unlock()
+
+		if pending {
+			o.expireOrder(order)
+			return
+		}
+		status = <-approvalChannel
+	}
+
+	fmt.Printf("[INFO] Received order %s approval (%s status %s)\n", order.ID, order.Infos.Provider, status.ProviderStatus)
+
+	defer o.claimPayment(order.ID)()
+	if err := o.updateStatus(order, StatusApproved, "approved by the client"); err != nil {
+		fmt.Printf("[ERROR] Could not approve order %s: %s\n", order.ID, err)
+		return
+	}
+	ordersApproved.Add(1)
+
+	o.securePayment(order, status)
+}
+
+// ===================================================================
+// Makes sure the payment of an approved order is authorized, then
+// launches the order. Payments already captured (e.g. SEPA debits or
+// orders paid before authorizations were used) are launched as is,
+// payments still being transferred once they are received.
+//
+// Parameters:
+//
+//	(*OrderRecord) order : Approved order
+//	(payment.Status) status : Checkout status verified on its provider
+//
+// Used on:
+//
+//	(*OrderOrchestrator) o : Object that permits asynchronous management of the order
+//
+// ===================================================================
+func (o *OrderOrchestrator) securePayment(order *OrderRecord, status payment.Status) {
+	provider, err := o.provider(order.Infos.Provider)
+	if err != nil {
+		fmt.Printf("[ERROR] %s\n", err)
+		return
+	}
+
+	if status.State == payment.StateApproved {
+		authorized, err := provider.Authorize(order.ID)
+		if err != nil {
+			fmt.Printf("[ERROR] Could not authorize order %s: %s\n", order.ID, err)
+			if err := o.updateStatus(order, StatusFailed, "payment authorization failed"); err != nil {
+				fmt.Printf("[ERROR] Could not update order %s: %s\n", order.ID, err)
+			}
+			return
+		}
+		status = authorized
+	}
+	if status.State == payment.StateProcessing {
+		status = o.waitForSettlement(order, provider)
+	}
+
+	switch status.State {
+	case payment.StateAuthorized:
+		err = o.updateStatus(order, StatusAuthorized, "payment authorized", func(order *OrderRecord) {
+			order.AuthorizationID = status.AuthorizationID
+		})
+	case payment.StateCaptured:
+		err = o.updateStatus(order, StatusCaptured, "captured by the client", func(order *OrderRecord) {
+			order.CaptureID = status.CaptureID
+		})
+	default:
+		err = o.updateStatus(order, StatusFailed, "payment "+status.ProviderStatus+" on "+provider.Name())
+		if err != nil {
+			fmt.Printf("[ERROR] Could not update order %s: %s\n", order.ID, err)
+		}
+		return
+	}
+	if err != nil {
+		fmt.Printf("[ERROR] Could not update order %s: %s\n", order.ID, err)
+		return
+	}
+
+	o.launchOrder(order)
+}
+
+// ===================================================================
+// Marks the payment of an order as being secured, until the returned
+// function is called. Webhook events leave such orders to
+// securePayment, which reads their payment state from the provider.
+//
+// Parameters:
+//
+//	(string) orderID : Checkout ID of the order
+//
+// Used on:
+//
+//	(*OrderOrchestrator) o : Object that permits asynchronous management of the order
+//
+// Return:
+//
+//	(func()) : Releases the order
+//
+// Example:
+//
+//	defer o.claimPayment(order.ID)()
+//
+// ===================================================================
+func (o *OrderOrchestrator) claimPayment(orderID string) func() {
+	o.mutex.Lock()
+	o.securing[orderID] = true
+	o.mutex.Unlock()
+
+	return func() {
+		o.mutex.Lock()
+		delete(o.securing, orderID)
+		o.mutex.Unlock()
+	}
+}
+
+// isSecuringPayment reports whether securePayment is running for an order
+func (o *OrderOrchestrator) isSecuringPayment(orderID string) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return o.securing[orderID]
+}
+
+// ===================================================================
+// Waits for a payment still being transferred (e.g. a SEPA debit,
+// which takes a few days) to be received or to fail. The order stays
+// approved meanwhile, so it is checked again after a restart.
+//
+// Parameters:
+//
+//	(*OrderRecord) order : Approved order
+//	(payment.PaymentProvider) provider : Provider of the order
+//
+// Used on:
+//
+//	(*OrderOrchestrator) o : Object that permits asynchronous management of the order
+//
+// Return:
+//
+//	(payment.Status) : Checkout status once the payment is no longer processing
+//
+// ===================================================================
+func (o *OrderOrchestrator) waitForSettlement(order *OrderRecord, provider payment.PaymentProvider) payment.Status {
+	fmt.Printf("[INFO] Order %s payment is processing on %s, waiting for it\n", order.ID, provider.Name())
+
+	ticker := time.NewTicker(settlementPollInterval)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+		status, err := provider.GetStatus(order.ID)
+		if err != nil {
+			fmt.Printf("[ERROR] Could not get %s checkout %s: %s\n", provider.Name(), order.ID, err)
+			continue
+		}
+		if status.State != payment.StateProcessing {
+			return status
+		}
+	}
+}
+
+// ===================================================================
+// Marks an order that was never approved as expired, and cancels it
+// on its payment provider when possible.
+//
+// Parameters:
+//
+//	(*OrderRecord) order : Order not approved in time
+//
+// Used on:
+//
+//	(*OrderOrchestrator) o : Object that permits asynchronous management of the order
+//
+// ===================================================================
+func (o *OrderOrchestrator) expireOrder(order *OrderRecord) {
+	// e.g. expire the Stripe Checkout Session so it can not be paid anymore
+	if provider, err := o.provider(order.Infos.Provider); err == nil {
+		if err := provider.Cancel(order.ID); err != nil {
+			fmt.Printf("[ERROR] Could not cancel order %s on %s: %s\n", order.ID, provider.Name(), err)
+		}
+	}
+
+	reason := fmt.Sprintf("not approved within %s", o.approvalTimeout)
+	if err := o.updateStatus(order, StatusExpired, reason); err != nil {
+		fmt.Printf("[ERROR] Could not expire order %s: %s\n", order.ID, err)
+		return
+	}
+	ordersExpired.Add(1)
+}
+
+// ===================================================================
+// Queues the production of a paid order: the order change and the
+// message to web-order are saved together in the outbox, delivered by
+// the outbox dispatcher. The payment is then handled once web-order
+// reports the result of the cluster creation (see ReportProvisioning).
+//
+// Parameters:
+//
+//	(*OrderRecord) order : Authorized or captured order
+//
+// Used on:
+//
+//	(*OrderOrchestrator) o : Object that permits asynchronous management of the order
+//
+// ===================================================================
+func (o *OrderOrchestrator) launchOrder(order *OrderRecord) {
+	orderInfos := order.Infos
+
+	fmt.Printf("\n[INFO] Order %s creation requested by %s\n   ---> Cluster name : %s\n   ---> Control plane : %s\n   ---> Monitoring : %s - %d Go\n   ---> Images storage : %d\n   ---> Alerting : %s\n\n",
+		orderInfos.Order.PaypalID,
+		orderInfos.Order.UserID,
+		orderInfos.Order.ClusterName,
+		strconv.FormatBool(orderInfos.Order.HasControlPlane),
+		strconv.FormatBool(orderInfos.Order.HasMonitoring),
+		orderInfos.Order.MonitoringStorage,
+		orderInfos.Order.ImageStorage,
+		strconv.FormatBool(orderInfos.Order.HasAlerting),
+	)
+
+	updated, err := o.store.UpdateOrderWithOutbox(order.ID, func(stored *OrderRecord) ([]OutboxMessage, error) {
+		// Already queued before a restart
+		if stored.Status == StatusProvisioningRequested {
+			return nil, nil
+		}
+		if err := stored.Transition(StatusProvisioningRequested, "queued for web-order"); err != nil {
+			return nil, err
+		}
+		return []OutboxMessage{newOutboxMessage(MessageLaunchOrder, stored)}, nil
+	})
+	if err != nil {
+		fmt.Printf("[ERROR] Could not queue order %s: %s\n", order.ID, err)
+		return
+	}
+	*order = *updated
+	fmt.Printf("[INFO] Order %s is now %s\n", order.ID, order.Status)
+
+	o.wakeOutbox()
+}
+
+// ===================================================================
+// Captures the payment of an order whose cluster has been created,
+// then marks it as provisioned. An order that can not be captured
+// fails and its cluster is decommissioned through the outbox.
+//
+// Parameters:
+//
+//	(*OrderRecord) order : Order sent to web-order
+//
+// Used on:
+//
+//	(*OrderOrchestrator) o : Object that permits asynchronous management of the order
+//
+// ===================================================================
+func (o *OrderOrchestrator) completeOrder(order *OrderRecord) {
+	if order.CaptureID != "" {
+		if err := o.updateStatus(order, StatusProvisioned, "cluster created"); err != nil {
+			fmt.Printf("[ERROR] Could not update order %s: %s\n", order.ID, err)
+		}
+		return
+	}
+
+	provider, err := o.provider(order.Infos.Provider)
+	if err != nil {
+		fmt.Printf("[ERROR] %s\n", err)
+		return
+	}
+
+	status, err := provider.Capture(order.ID)
+	if err == nil && status.State != payment.StateCaptured {
+		err = fmt.Errorf("capture is %s", status.ProviderStatus)
+	}
+	if err != nil {
+		fmt.Printf("[ERROR] Could not capture order %s: %s\n", order.ID, err)
+		_, err := o.store.UpdateOrderWithOutbox(order.ID, func(stored *OrderRecord) ([]OutboxMessage, error) {
+			if err := stored.Transition(StatusFailed, "payment capture failed"); err != nil {
+				return nil, err
+			}
+			return []OutboxMessage{newOutboxMessage(MessageDecommissionOrder, stored)}, nil
+		})
+		if err != nil {
+			fmt.Printf("[ERROR] Could not update order %s: %s\n", order.ID, err)
+		}
+		o.wakeOutbox()
+		return
+	}
+
+	err = o.updateStatus(order, StatusProvisioned, "cluster created, payment captured", func(order *OrderRecord) {
+		order.CaptureID = status.CaptureID
+	})
+	if err != nil {
+		fmt.Printf("[ERROR] Could not update order %s: %s\n", order.ID, err)
+	}
+}
+
+// ===================================================================
+// Gives the money of an order that could not be produced back:
+// its authorization is voided, or its capture refunded
+//
+// Parameters:
+//
+//	(*OrderRecord) order : Order that could not be produced
+//	(string) reason : Why the order is aborted
+//
+// Used on:
+//
+//	(*OrderOrchestrator) o : Object that permits asynchronous management of the order
+//
+// ===================================================================
+func (o *OrderOrchestrator) abortOrder(order *OrderRecord, reason string) {
+	if order.CaptureID != "" {
+		// No cluster to decommission, web-order is not called again
+		refunded, err := o.refund(order.ID, RefundRequest{Reason: reason}, false)
+		if err != nil {
+			fmt.Printf("[ERROR] Could not refund order %s: %s\n", order.ID, err)
+			return
+		}
+		*order = *refunded
+		return
+	}
+
+	provider, err := o.provider(order.Infos.Provider)
+	if err != nil {
+		fmt.Printf("[ERROR] %s\n", err)
+		return
+	}
+	if err := provider.Cancel(order.ID); err != nil {
+		fmt.Printf("[ERROR] Could not void order %s authorization: %s\n", order.ID, err)
+		return
+	}
+
+	if err := o.updateStatus(order, StatusCancelled, reason+", authorization voided"); err != nil {
+		fmt.Printf("[ERROR] Could not update order %s: %s\n", order.ID, err)
+	}
+}
+
+// ===================================================================
+// Moves an order to a new status and persists it. The order is read
+// again from the store, so changes made concurrently (e.g. by a
+// webhook) are kept, then the given order is refreshed.
+//
+// Parameters:
+//
+//	(*OrderRecord) order : Order changing status
+//	(OrderStatus) to : New status of the order
+//	(string) reason : Why the status changed
+//	(...func(*OrderRecord)) changes : Other changes to save with the status
+//
+// Used on:
+//
+//	(*OrderOrchestrator) o : Object that permits asynchronous management of the order
+//
+// Return:
+//
+//	(error) : *TransitionError if the change is not allowed, or a store error
+//
+// ===================================================================
+func (o *OrderOrchestrator) updateStatus(order *OrderRecord, to OrderStatus, reason string, changes ...func(order *OrderRecord)) error {
+	updated, err := o.store.UpdateOrder(order.ID, func(stored *OrderRecord) error {
+		for _, change := range changes {
+			change(stored)
+		}
+		// Already done concurrently, e.g. by a webhook
+		if stored.Status == to {
+			return nil
+		}
+		return stored.Transition(to, reason)
+	})
+	if err != nil {
+		return err
+	}
+	*order = *updated
+	fmt.Printf("[INFO] Order %s is now %s\n", order.ID, to)
+
+	return nil
+}
+
+// ===================================================================
+// Reloads the orders that were still being processed when the service
+// stopped. Orders waiting for approval wait again, approved orders
+// are queued for web-order, and the payments of orders web-order
+// reported are captured, voided or refunded.
+//
+// Used on:
+//
+//	(*OrderOrchestrator) o : Object that permits asynchronous management of the order
+//
+// Return:
+//
+//	(error) : Error while reading the order store or nil if no error occurs
+//
+// Example:
+//
+//	err := orderOrchestrator.ResumeOrders()
+//
+// ===================================================================
+func (o *OrderOrchestrator) ResumeOrders() error {
+	orders, err := o.store.ListOrdersByStatus(StatusCreated, StatusApproved, StatusAuthorized, StatusCaptured, StatusProvisioningRequested)
+	if err != nil {
+		return err
+	}
+
+	for _, order := range orders {
+		fmt.Printf("[INFO] Resuming order %s (%s)\n", order.ID, order.Status)
+
+		switch order.Status {
+		case StatusCreated:
+			approvalChannel := o.registerApproval(order.ID)
+			go o.waitForApproval(order, approvalChannel)
+		case StatusApproved:
+			go o.resumePayment(order)
+		case StatusAuthorized, StatusCaptured:
+			go o.launchOrder(order)
+		case StatusProvisioningRequested:
+			// Orders without a report keep waiting for web-order
+			switch order.Provisioning.Status {
+			case ProvisioningSucceeded:
+				go o.completeOrder(order)
+			case ProvisioningFailed:
+				go o.abortOrder(order, "web-order could not create the cluster")
+			}
+		}
+	}
+
+	return nil
+}
+
+// resumePayment secures the payment of an order approved before a restart
+func (o *OrderOrchestrator) resumePayment(order *OrderRecord) {
+	defer o.claimPayment(order.ID)()
+
+	provider, err := o.provider(order.Infos.Provider)
+	if err != nil {
+		fmt.Printf("[ERROR] %s\n", err)
+		return
+	}
+
+	status, err := provider.GetStatus(order.ID)
+	if err != nil {
+		fmt.Printf("[ERROR] Could not get %s checkout %s: %s\n", provider.Name(), order.ID, err)
+		return
+	}
+
+	o.securePayment(order, status)
+}
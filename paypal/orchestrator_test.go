@@ -0,0 +1,370 @@
+package paypal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OneKonsole/web-service-billing/payment"
+	"github.com/OneKonsole/web-service-billing/pricing"
+	"github.com/OneKonsole/web-service-billing/stripe"
+)
+
+// fakeProvider is a payment provider answering the statuses it is given
+type fakeProvider struct {
+	mutex       sync.Mutex
+	statuses    []payment.Status // Returned in turn by GetStatus, the last one is kept
+	checkout    payment.Checkout // Returned by every CreateCheckout, like a retried creation
+	captures    int
+	cancels     int
+	refunds     map[string]payment.Refund // Refunds made, by idempotency key
+	refundError error                     // Returned once by Refund once the refund is made, like a lost response
+}
+
+func (p *fakeProvider) Name() string {
+	return "fake"
+}
+
+func (p *fakeProvider) CreateCheckout(request payment.CheckoutRequest) (payment.Checkout, error) {
+	if p.checkout.ID == "" {
+		return payment.Checkout{}, errors.New("not supported")
+	}
+	return p.checkout, nil
+}
+
+func (p *fakeProvider) GetStatus(checkoutID string) (payment.Status, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	status := p.statuses[0]
+	if len(p.statuses) > 1 {
+		p.statuses = p.statuses[1:]
+	}
+	status.CheckoutID = checkoutID
+	return status, nil
+}
+
+func (p *fakeProvider) Authorize(checkoutID string) (payment.Status, error) {
+	return p.GetStatus(checkoutID)
+}
+
+func (p *fakeProvider) Capture(checkoutID string) (payment.Status, error) {
+	p.mutex.Lock()
+	p.captures++
+	p.mutex.Unlock()
+
+	return payment.Status{CheckoutID: checkoutID, State: payment.StateCaptured, CaptureID: "CAPTURE-" + checkoutID}, nil
+}
+
+func (p *fakeProvider) Refund(captureID string, amount *pricing.Money, reason string, idempotencyKey string) (payment.Refund, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.refunds == nil {
+		p.refunds = make(map[string]payment.Refund)
+	}
+	refund, found := p.refunds[idempotencyKey]
+	if !found {
+		refund = payment.Refund{ID: fmt.Sprintf("REFUND-%d", len(p.refunds)+1), Status: "COMPLETED"}
+		if amount != nil {
+			refund.Amount = *amount
+		}
+		p.refunds[idempotencyKey] = refund
+	}
+
+	if err := p.refundError; err != nil {
+		p.refundError = nil
+		return payment.Refund{}, err
+	}
+	return refund, nil
+}
+
+func (p *fakeProvider) Cancel(checkoutID string) error {
+	p.mutex.Lock()
+	p.cancels++
+	p.mutex.Unlock()
+
+	return nil
+}
+
+var testAmount = pricing.NewMoneyFromMinor(1200, "EUR")
+
+// newTestOrchestrator returns an orchestrator paid through a fake provider answering the given statuses
+func newTestOrchestrator(t *testing.T, statuses ...payment.Status) (*OrderOrchestrator, *BoltOrderStore) {
+	t.Helper()
+	store, _ := openTestStore(t)
+	orchestrator := NewOrderOchestrator(store, nil, time.Minute)
+	orchestrator.RegisterProvider(&fakeProvider{statuses: statuses})
+	return orchestrator, store
+}
+
+// createTestOrder stores an order waiting for its approval
+func createTestOrder(t *testing.T, orchestrator *OrderOrchestrator, store *BoltOrderStore, id string) {
+	t.Helper()
+	order := NewOrderRecord(id, PaypalOrderInfos{Provider: "fake", Quote: pricing.Quote{Gross: testAmount}})
+	if err := store.SaveOrder(order); err != nil {
+		t.Fatal(err)
+	}
+	go orchestrator.waitForApproval(order, orchestrator.registerApproval(id))
+}
+
+// waitForStatus fails the test if the order does not reach the status in time
+func waitForStatus(t *testing.T, store *BoltOrderStore, id string, want OrderStatus) *OrderRecord {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		order, err := store.GetOrder(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if order.Status == want {
+			return order
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("order %s is %s, want %s", id, order.Status, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestApproveProcessingPayment(t *testing.T) {
+	previous := settlementPollInterval
+	settlementPollInterval = time.Millisecond
+	defer func() { settlementPollInterval = previous }()
+
+	processing := payment.Status{State: payment.StateProcessing, ProviderStatus: "processing", Amount: testAmount}
+	tests := []struct {
+		name    string
+		settled payment.Status
+		want    OrderStatus
+	}{
+		{
+			name:    "debit received",
+			settled: payment.Status{State: payment.StateCaptured, ProviderStatus: "succeeded", Amount: testAmount, CaptureID: "pi_1"},
+			want:    StatusProvisioningRequested,
+		},
+		{
+			name:    "debit failed",
+			settled: payment.Status{State: payment.StatePending, ProviderStatus: "requires_payment_method", Amount: testAmount},
+			want:    StatusFailed,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			orchestrator, store := newTestOrchestrator(t, processing, processing, processing, test.settled)
+			createTestOrder(t, orchestrator, store, "cs_1")
+
+			if err := orchestrator.approve("cs_1"); err != nil {
+				t.Fatalf("approve() error = %v", err)
+			}
+			order := waitForStatus(t, store, "cs_1", test.want)
+			if order.CaptureID != test.settled.CaptureID {
+				t.Errorf("CaptureID = %q, want %q", order.CaptureID, test.settled.CaptureID)
+			}
+		})
+	}
+}
+
+func TestApproveStripeCardPayment(t *testing.T) {
+	// A card session created with a manual capture, paid by the customer
+	intent := `{"id": "pi_1", "status": "requires_capture", "amount": 1200, "currency": "eur"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /v1/checkout/sessions/cs_1":
+			fmt.Fprintf(w, `{"id": "cs_1", "status": "complete", "amount_total": 1200, "currency": "eur", "payment_intent": %s}`, intent)
+		case "POST /v1/payment_intents/pi_1/capture":
+			intent = `{"id": "pi_1", "status": "succeeded", "amount": 1200, "currency": "eur"}`
+			fmt.Fprint(w, intent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	client := stripe.NewClient("sk_test", "", "", server.Client())
+	client.BaseURL = server.URL
+
+	store, _ := openTestStore(t)
+	orchestrator := NewOrderOchestrator(store, nil, time.Minute)
+	orchestrator.RegisterProvider(client)
+	order := NewOrderRecord("cs_1", PaypalOrderInfos{Provider: stripe.ProviderName, Quote: pricing.Quote{Gross: testAmount}})
+	if err := store.SaveOrder(order); err != nil {
+		t.Fatal(err)
+	}
+	go orchestrator.waitForApproval(order, orchestrator.registerApproval(order.ID))
+
+	if err := orchestrator.approve("cs_1"); err != nil {
+		t.Fatalf("approve() error = %v", err)
+	}
+	order = waitForStatus(t, store, "cs_1", StatusProvisioningRequested)
+	if order.AuthorizationID != "pi_1" || order.CaptureID != "" {
+		t.Fatalf("AuthorizationID = %q, CaptureID = %q, want an authorization only", order.AuthorizationID, order.CaptureID)
+	}
+
+	// Captured once web-order has created the cluster
+	orchestrator.completeOrder(order)
+	if order.Status != StatusProvisioned || order.CaptureID != "pi_1" {
+		t.Errorf("order is %s with capture %q, want %s with capture pi_1", order.Status, order.CaptureID, StatusProvisioned)
+	}
+}
+
+func TestCreateOrderReturnedByProviderAgain(t *testing.T) {
+	store, _ := openTestStore(t)
+	orchestrator := NewOrderOchestrator(store, nil, time.Minute)
+	orchestrator.RegisterProvider(&fakeProvider{checkout: payment.Checkout{ID: "cs_1", Provider: "fake"}})
+
+	create := func(userID string) (*httptest.ResponseRecorder, error) {
+		infos := PaypalOrderInfos{Provider: "fake", Quote: pricing.Quote{Gross: testAmount}}
+		infos.Order.UserID = userID
+		w := httptest.NewRecorder()
+		return w, orchestrator.CreateOrder(w, infos, "derived-key")
+	}
+
+	if w, err := create("alice"); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("CreateOrder() = %d, %v, want a new order", w.Code, err)
+	}
+	// Nothing new is stored, the caller must release what it reserved for the order
+	if w, err := create("alice"); !errors.Is(err, ErrCheckoutReplayed) || w.Code != http.StatusOK {
+		t.Errorf("replayed CreateOrder() = %d, %v, want %d, %v", w.Code, err, http.StatusOK, ErrCheckoutReplayed)
+	}
+	if w, err := create("mallory"); !errors.Is(err, ErrCheckoutOwner) || w.Code != http.StatusForbidden {
+		t.Errorf("CreateOrder() of another user = %d, %v, want %d, %v", w.Code, err, http.StatusForbidden, ErrCheckoutOwner)
+	}
+
+	order, err := store.GetOrder("cs_1")
+	if err != nil || order.Infos.Order.UserID != "alice" {
+		t.Errorf("stored order = %+v, %v, want the order of alice", order, err)
+	}
+}
+
+func TestOrderExpiresAfterApprovalTimeout(t *testing.T) {
+	store, _ := openTestStore(t)
+	provider := &fakeProvider{statuses: []payment.Status{{State: payment.StateApproved, Amount: testAmount}}}
+	orchestrator := NewOrderOchestrator(store, nil, 50*time.Millisecond)
+	orchestrator.RegisterProvider(provider)
+
+	created := time.Now()
+	createTestOrder(t, orchestrator, store, "PAY-1")
+	order := waitForStatus(t, store, "PAY-1", StatusExpired)
+	if elapsed := time.Since(created); elapsed < 50*time.Millisecond {
+		t.Errorf("order expired after %s, want at least the approval timeout", elapsed)
+	}
+
+	orchestrator.mutex.Lock()
+	_, pending := orchestrator.approvalChans["PAY-1"]
+	orchestrator.mutex.Unlock()
+	if pending {
+		t.Error("approval channel kept after the expiry")
+	}
+	provider.mutex.Lock()
+	cancels := provider.cancels
+	provider.mutex.Unlock()
+	if cancels != 1 {
+		t.Errorf("order cancelled %d times on its provider, want 1", cancels)
+	}
+	if last := order.History[len(order.History)-1]; last.To != StatusExpired || last.Reason == "" {
+		t.Errorf("last status change = %+v, want the expiry with its reason", last)
+	}
+
+	// A late approval is refused
+	if err := orchestrator.approve("PAY-1"); !errors.Is(err, ErrOrderAlreadyHandled) {
+		t.Errorf("approve() error = %v, want %v", err, ErrOrderAlreadyHandled)
+	}
+}
+
+func TestOrderApprovedBeforeTimeoutDoesNotExpire(t *testing.T) {
+	orchestrator, store := newTestOrchestrator(t, payment.Status{State: payment.StateCaptured, Amount: testAmount, CaptureID: "CAPTURE-1"})
+	orchestrator.approvalTimeout = 100 * time.Millisecond
+	createTestOrder(t, orchestrator, store, "PAY-1")
+
+	if err := orchestrator.approve("PAY-1"); err != nil {
+		t.Fatalf("approve() error = %v", err)
+	}
+	waitForStatus(t, store, "PAY-1", StatusProvisioningRequested)
+
+	time.Sleep(150 * time.Millisecond)
+	if order, err := store.GetOrder("PAY-1"); err != nil || order.Status != StatusProvisioningRequested {
+		t.Errorf("order = %+v, %v, want it still %s after the approval timeout", order, err, StatusProvisioningRequested)
+	}
+}
+
+func TestResumeOrders(t *testing.T) {
+	previous := settlementPollInterval
+	settlementPollInterval = time.Millisecond
+	defer func() { settlementPollInterval = previous }()
+
+	// The payment of the approved order was still being transferred before the restart
+	processing := payment.Status{State: payment.StateProcessing, ProviderStatus: "processing", Amount: testAmount}
+	received := payment.Status{State: payment.StateCaptured, ProviderStatus: "succeeded", Amount: testAmount, CaptureID: "pi_1"}
+	orchestrator, store := newTestOrchestrator(t, processing, processing, received)
+
+	save := func(id string, statuses ...OrderStatus) {
+		order := NewOrderRecord(id, PaypalOrderInfos{Provider: "fake", Quote: pricing.Quote{Gross: testAmount}})
+		for _, status := range statuses {
+			if err := order.Transition(status, ""); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.SaveOrder(order); err != nil {
+			t.Fatal(err)
+		}
+	}
+	save("APPROVED-1", StatusApproved)
+	save("AUTHORIZED-1", StatusApproved, StatusAuthorized)
+	save("CAPTURED-1", StatusApproved, StatusCaptured)
+	save("PROVISIONED-1", StatusApproved, StatusAuthorized, StatusProvisioningRequested, StatusProvisioned)
+
+	if err := orchestrator.ResumeOrders(); err != nil {
+		t.Fatalf("ResumeOrders() error = %v", err)
+	}
+
+	order := waitForStatus(t, store, "APPROVED-1", StatusProvisioningRequested)
+	if order.CaptureID != "pi_1" {
+		t.Errorf("CaptureID = %q, want the capture of the received payment", order.CaptureID)
+	}
+	waitForStatus(t, store, "AUTHORIZED-1", StatusProvisioningRequested)
+	waitForStatus(t, store, "CAPTURED-1", StatusProvisioningRequested)
+
+	// Each launched order has its message to web-order, the finished one is left alone
+	messages, err := store.ListOutboxMessages(OutboxPending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	launched := make(map[string]int)
+	for _, message := range messages {
+		if message.Kind == MessageLaunchOrder {
+			launched[message.OrderID]++
+		}
+	}
+	for _, id := range []string{"APPROVED-1", "AUTHORIZED-1", "CAPTURED-1"} {
+		if launched[id] != 1 {
+			t.Errorf("order %s has %d launch messages, want 1", id, launched[id])
+		}
+	}
+	if launched["PROVISIONED-1"] != 0 {
+		t.Errorf("provisioned order launched again")
+	}
+	if order, err := store.GetOrder("PROVISIONED-1"); err != nil || order.Status != StatusProvisioned {
+		t.Errorf("order = %+v, %v, want it still %s", order, err, StatusProvisioned)
+	}
+}
+
+func TestResumeOrdersExpiresLateOrders(t *testing.T) {
+	orchestrator, store := newTestOrchestrator(t, payment.Status{State: payment.StateApproved, Amount: testAmount})
+
+	// Created before the restart, its approval timeout is already over
+	order := NewOrderRecord("PAY-1", PaypalOrderInfos{Provider: "fake", Quote: pricing.Quote{Gross: testAmount}})
+	order.CreatedAt = time.Now().Add(-2 * orchestrator.approvalTimeout)
+	if err := store.SaveOrder(order); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := orchestrator.ResumeOrders(); err != nil {
+		t.Fatalf("ResumeOrders() error = %v", err)
+	}
+	waitForStatus(t, store, "PAY-1", StatusExpired)
+}
@@ -0,0 +1,179 @@
+package paypal
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/OneKonsole/web-service-billing/pricing"
+)
+
+// Status of an order during its lifecycle
+type OrderStatus string
+
+const (
+	StatusCreated               OrderStatus = "CREATED"
+	StatusApproved              OrderStatus = "APPROVED"
+	StatusAuthorized            OrderStatus = "AUTHORIZED"
+	StatusCaptured              OrderStatus = "CAPTURED"
+	StatusProvisioningRequested OrderStatus = "PROVISIONING_REQUESTED"
+	StatusProvisioned           OrderStatus = "PROVISIONED"
+	StatusCancelled             OrderStatus = "CANCELLED"
+	StatusExpired               OrderStatus = "EXPIRED"
+	StatusFailed                OrderStatus = "FAILED"
+	StatusPartiallyRefunded     OrderStatus = "PARTIALLY_REFUNDED"
+	StatusRefunded              OrderStatus = "REFUNDED"
+)
+
+// Statuses an order can move to from each status.
+// Statuses absent from this map are final.
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	StatusCreated:               {StatusApproved, StatusCancelled, StatusExpired, StatusFailed},
+	StatusApproved:              {StatusAuthorized, StatusCaptured, StatusCancelled, StatusFailed},
+	StatusAuthorized:            {StatusProvisioningRequested, StatusCancelled, StatusFailed},
+	StatusCaptured:              {StatusProvisioningRequested, StatusFailed, StatusPartiallyRefunded, StatusRefunded},
+	StatusProvisioningRequested: {StatusProvisioned, StatusCancelled, StatusFailed, StatusPartiallyRefunded, StatusRefunded},
+	StatusProvisioned:           {StatusPartiallyRefunded, StatusRefunded},
+	StatusPartiallyRefunded:     {StatusPartiallyRefunded, StatusRefunded},
+}
+
+var (
+	ErrOrderAlreadyHandled = errors.New("order can not be approved anymore")
+	ErrPaymentNotVerified  = errors.New("payment could not be verified")
+	ErrCheckoutReplayed    = errors.New("checkout already created by a previous request")
+	ErrCheckoutOwner       = errors.New("checkout belongs to another user")
+)
+
+// StatusChange is an entry of the order status history
+type StatusChange struct {
+	From   OrderStatus `json:"from,omitempty"`
+	To     OrderStatus `json:"to"`
+	At     time.Time   `json:"at"`
+	Reason string      `json:"reason,omitempty"`
+}
+
+// RefundRecord is money given back to the customer for an order
+type RefundRecord struct {
+	ID             string        `json:"id"` // Refund ID on the payment provider
+	Status         string        `json:"status"`
+	Amount         pricing.Money `json:"amount"`
+	Reason         string        `json:"reason,omitempty"`
+	IdempotencyKey string        `json:"idempotency_key,omitempty"` // Empty for refunds notified by a webhook
+	CreatedAt      time.Time     `json:"created_at"`
+}
+
+// RefundAttempt is a refund sent to the payment provider whose result
+// is not recorded yet. A retry sends it again with the same key, so
+// that the provider does not refund the customer twice.
+type RefundAttempt struct {
+	IdempotencyKey string        `json:"idempotency_key"`
+	Amount         pricing.Money `json:"amount"`
+	Reason         string        `json:"reason,omitempty"`
+	CreatedAt      time.Time     `json:"created_at"`
+}
+
+// TransitionError is returned when an order can not move to a status
+type TransitionError struct {
+	OrderID string
+	From    OrderStatus
+	To      OrderStatus
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("order %s can not go from %s to %s", e.OrderID, e.From, e.To)
+}
+
+// OrderRecord is an order as persisted in the order store
+type OrderRecord struct {
+	ID              string           `json:"id"` // Checkout ID on the payment provider, e.g. Paypal order ID
+	Infos           PaypalOrderInfos `json:"infos"`
+	Quote           pricing.Quote    `json:"quote"`
+	Status          OrderStatus      `json:"status"`
+	History         []StatusChange   `json:"history"`
+	AuthorizationID string           `json:"authorization_id,omitempty"`
+	CaptureID       string           `json:"capture_id,omitempty"`
+	Refunds         []RefundRecord   `json:"refunds,omitempty"`
+	PendingRefund   *RefundAttempt   `json:"pending_refund,omitempty"`
+	Provisioning    Provisioning     `json:"provisioning"`
+	CreatedAt       time.Time        `json:"created_at"`
+	UpdatedAt       time.Time        `json:"updated_at"`
+}
+
+// ===================================================================
+// Creates a new order in the CREATED status
+//
+// Parameters:
+//
+//	(string) id : Checkout ID on the payment provider, e.g. Paypal order ID
+//	(PaypalOrderInfos) orderInfos : Information about the order
+//
+// Return
+//
+//	(*OrderRecord) : Order with its first history entry
+//
+// ===================================================================
+func NewOrderRecord(id string, orderInfos PaypalOrderInfos) *OrderRecord {
+	now := time.Now().UTC()
+
+	return &OrderRecord{
+		ID:        id,
+		Infos:     orderInfos,
+		Quote:     orderInfos.Quote,
+		Status:    StatusCreated,
+		History:   []StatusChange{{To: StatusCreated, At: now}},
+		CreatedAt: now,
+	}
+}
+
+// CanTransition reports whether the order can move to the given status
+func (order *OrderRecord) CanTransition(to OrderStatus) bool {
+	for _, allowed := range orderTransitions[order.Status] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// IsFinal reports whether the order can not change status anymore
+func (order *OrderRecord) IsFinal() bool {
+	return len(orderTransitions[order.Status]) == 0
+}
+
+// ===================================================================
+// Moves the order to a new status and records the change in its
+// history. The order must still be saved in the store.
+//
+// Parameters:
+//
+//	(OrderStatus) to : New status of the order
+//	(string) reason : Why the status changed, may be empty
+//
+// Used on:
+//
+//	(*OrderRecord) order : Order changing status
+//
+// Return
+//
+//	(error) : *TransitionError if the change is not allowed
+//
+// Example:
+//
+//	err := order.Transition(StatusApproved, "approved by the client")
+//
+// ===================================================================
+func (order *OrderRecord) Transition(to OrderStatus, reason string) error {
+	if !order.CanTransition(to) {
+		return &TransitionError{OrderID: order.ID, From: order.Status, To: to}
+	}
+
+	order.History = append(order.History, StatusChange{
+		From:   order.Status,
+		To:     to,
+		At:     time.Now().UTC(),
+		Reason: reason,
+	})
+	order.Status = to
+
+	return nil
+}
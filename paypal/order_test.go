@@ -0,0 +1,154 @@
+package paypal
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+var allStatuses = []OrderStatus{
+	StatusCreated, StatusApproved, StatusAuthorized, StatusCaptured, StatusProvisioningRequested,
+	StatusProvisioned, StatusCancelled, StatusExpired, StatusFailed, StatusPartiallyRefunded, StatusRefunded,
+}
+
+// Written out rather than read from orderTransitions, so that changing the
+// lifecycle has to be done on purpose
+var wantTransitions = map[OrderStatus][]OrderStatus{
+	StatusCreated:               {StatusApproved, StatusCancelled, StatusExpired, StatusFailed},
+	StatusApproved:              {StatusAuthorized, StatusCaptured, StatusCancelled, StatusFailed},
+	StatusAuthorized:            {StatusProvisioningRequested, StatusCancelled, StatusFailed},
+	StatusCaptured:              {StatusProvisioningRequested, StatusFailed, StatusPartiallyRefunded, StatusRefunded},
+	StatusProvisioningRequested: {StatusProvisioned, StatusCancelled, StatusFailed, StatusPartiallyRefunded, StatusRefunded},
+	StatusProvisioned:           {StatusPartiallyRefunded, StatusRefunded},
+	StatusPartiallyRefunded:     {StatusPartiallyRefunded, StatusRefunded},
+}
+
+func TestCanTransition(t *testing.T) {
+	for _, from := range allStatuses {
+		order := &OrderRecord{ID: "ORDER-1", Status: from}
+		if final := len(wantTransitions[from]) == 0; order.IsFinal() != final {
+			t.Errorf("%s: IsFinal() = %v, want %v", from, order.IsFinal(), final)
+		}
+
+		for _, to := range allStatuses {
+			allowed := false
+			for _, status := range wantTransitions[from] {
+				allowed = allowed || status == to
+			}
+			if order.CanTransition(to) != allowed {
+				t.Errorf("%s -> %s: CanTransition() = %v, want %v", from, to, order.CanTransition(to), allowed)
+			}
+		}
+	}
+}
+
+func TestTransition(t *testing.T) {
+	order := NewOrderRecord("ORDER-1", PaypalOrderInfos{})
+
+	steps := []struct {
+		to      OrderStatus
+		reason  string
+		refused bool
+	}{
+		{to: StatusCaptured, refused: true},
+		{to: StatusApproved, reason: "approved by the client"},
+		{to: StatusApproved, refused: true},
+		{to: StatusProvisioningRequested, refused: true},
+		{to: StatusAuthorized, reason: "payment authorized"},
+		{to: StatusCreated, refused: true},
+		{to: StatusProvisioningRequested},
+		{to: StatusProvisioned, reason: "cluster provisioned"},
+		{to: StatusCancelled, refused: true},
+		{to: StatusPartiallyRefunded, reason: "refund of 5.00 EUR"},
+		{to: StatusPartiallyRefunded, reason: "refund of 2.00 EUR"},
+		{to: StatusRefunded, reason: "refund of 5.00 EUR"},
+		{to: StatusProvisioned, refused: true},
+	}
+
+	want := []StatusChange{{To: StatusCreated}}
+	for _, step := range steps {
+		from := order.Status
+		err := order.Transition(step.to, step.reason)
+
+		if !step.refused {
+			if err != nil {
+				t.Fatalf("%s -> %s: Transition() error = %v", from, step.to, err)
+			}
+			want = append(want, StatusChange{From: from, To: step.to, Reason: step.reason})
+			continue
+		}
+
+		var transitionErr *TransitionError
+		if !errors.As(err, &transitionErr) || *transitionErr != (TransitionError{OrderID: "ORDER-1", From: from, To: step.to}) {
+			t.Fatalf("%s -> %s: Transition() error = %v, want a TransitionError", from, step.to, err)
+		}
+		if order.Status != from {
+			t.Errorf("%s -> %s: refused transition changed the status to %s", from, step.to, order.Status)
+		}
+	}
+
+	if len(order.History) != len(want) {
+		t.Fatalf("History = %+v, want %d entries", order.History, len(want))
+	}
+	for i, change := range order.History {
+		if change.From != want[i].From || change.To != want[i].To || change.Reason != want[i].Reason {
+			t.Errorf("History[%d] = %+v, want %+v", i, change, want[i])
+		}
+		if change.At.IsZero() || (i > 0 && change.At.Before(order.History[i-1].At)) {
+			t.Errorf("History[%d] at %s, want a time after the previous change", i, change.At)
+		}
+	}
+}
+
+func TestOrderHistoryStored(t *testing.T) {
+	store, err := NewBoltOrderStore(filepath.Join(t.TempDir(), "billing.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	order := NewOrderRecord("ORDER-1", PaypalOrderInfos{})
+	if err := order.Transition(StatusApproved, "approved by the client"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveOrder(order); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := store.GetOrder("ORDER-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != StatusApproved || len(stored.History) != 2 || stored.History[1].Reason != "approved by the client" {
+		t.Errorf("GetOrder() = %s with history %+v, want APPROVED with its approval", stored.Status, stored.History)
+	}
+}
+
+func TestUpdateOrderRefusedTransition(t *testing.T) {
+	store, err := NewBoltOrderStore(filepath.Join(t.TempDir(), "billing.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if err := store.SaveOrder(NewOrderRecord("ORDER-1", PaypalOrderInfos{})); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.UpdateOrder("ORDER-1", func(order *OrderRecord) error {
+		return order.Transition(StatusProvisioned, "")
+	})
+	var transitionErr *TransitionError
+	if !errors.As(err, &transitionErr) {
+		t.Fatalf("UpdateOrder() error = %v, want a TransitionError", err)
+	}
+
+	// Nothing is saved when the transition is refused
+	stored, err := store.GetOrder("ORDER-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != StatusCreated || len(stored.History) != 1 {
+		t.Errorf("order saved as %s with %d history entries, want CREATED with 1", stored.Status, len(stored.History))
+	}
+}
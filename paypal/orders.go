@@ -0,0 +1,88 @@
+package paypal
+
+import (
+	"net/http"
+
+	helpers "github.com/OneKonsole/web-service-billing/helpers"
+	"github.com/OneKonsole/web-service-billing/pricing"
+)
+
+// OrderView is an order as answered by GET /order/{id} and GET /orders
+type OrderView struct {
+	*OrderRecord
+	PaypalID string        `json:"paypal_id,omitempty"` // Paypal order ID, empty for the orders paid with another provider
+	Refunded pricing.Money `json:"refunded"`
+}
+
+// newOrderView adds the fields computed from the stored order
+func newOrderView(order *OrderRecord) OrderView {
+	view := OrderView{OrderRecord: order, Refunded: order.RefundedAmount()}
+	if order.Infos.Provider == "" || order.Infos.Provider == ProviderName {
+		view.PaypalID = order.ID
+	}
+
+	return view
+}
+
+// ===================================================================
+// Answers with an order: its price breakdown, status history,
+// provisioning status and refunds
+//
+// Parameters:
+//
+//	(http.ResponseWriter) w : Used to generate HTTP responses (retrieved by the router)
+//	(string) orderID : Checkout ID of the order, e.g. Paypal order ID
+//
+// Used on:
+//
+//	(*OrderOrchestrator) o : Object that permits asynchronous management of the order
+//
+// Example:
+//
+//	orderOrchestrator.GetOrder(w, "xyYxyZ")
+//
+// ===================================================================
+func (o *OrderOrchestrator) GetOrder(w http.ResponseWriter, orderID string) {
+	order, err := o.store.GetOrder(orderID)
+	if err != nil {
+		helpers.RespondWithError(w, apiError("Could not read order", err))
+		return
+	}
+
+	helpers.RespondWithJSON(w, http.StatusOK, newOrderView(order))
+}
+
+// ===================================================================
+// Answers with a page of orders, the most recent first
+//
+// Parameters:
+//
+//	(http.ResponseWriter) w : Used to generate HTTP responses (retrieved by the router)
+//	(OrderFilter) filter : Orders to list and page to return
+//
+// Used on:
+//
+//	(*OrderOrchestrator) o : Object that permits asynchronous management of the order
+//
+// Example:
+//
+//	orderOrchestrator.ListOrders(w, OrderFilter{UserID: "xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx", Limit: 20})
+//
+// ===================================================================
+func (o *OrderOrchestrator) ListOrders(w http.ResponseWriter, filter OrderFilter) {
+	page, err := o.store.ListOrders(filter)
+	if err != nil {
+		helpers.RespondWithError(w, apiError("Could not list orders", err))
+		return
+	}
+
+	views := make([]OrderView, 0, len(page.Orders))
+	for _, order := range page.Orders {
+		views = append(views, newOrderView(order))
+	}
+
+	helpers.RespondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"orders":      views,
+		"next_cursor": page.NextCursor,
+	})
+}
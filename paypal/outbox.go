@@ -0,0 +1,358 @@
+package paypal
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	oko "github.com/OneKonsole/order-model"
+	helpers "github.com/OneKonsole/web-service-billing/helpers"
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Kinds of messages sent to web-order
+const (
+	MessageLaunchOrder       = "LAUNCH_ORDER"       // Create the cluster of a paid order
+	MessageDecommissionOrder = "DECOMMISSION_ORDER" // Delete the cluster of a refunded order
+)
+
+// Delivery status of an outbox message
+type OutboxStatus string
+
+const (
+	OutboxPending    OutboxStatus = "PENDING"
+	OutboxDeadLetter OutboxStatus = "DEAD_LETTER" // Given up after too many attempts, waiting for a replay
+)
+
+// Outbox settings used when none are configured
+const (
+	DefaultOutboxMaxAttempts = 10
+	DefaultOutboxBaseDelay   = 5 * time.Second
+	DefaultOutboxMaxDelay    = 10 * time.Minute
+	DefaultWebOrderTimeout   = 30 * time.Second
+	outboxPollInterval       = 5 * time.Second
+)
+
+var (
+	ErrMessageNotFound = errors.New("outbox message not found")
+	ErrNotDeadLetter   = errors.New("outbox message is not a dead letter")
+)
+
+// Counters published on /debug/vars
+var (
+	outboxDelivered   = expvar.NewInt("outbox_delivered")
+	outboxDeadLetters = expvar.NewInt("outbox_dead_letters")
+)
+
+// OutboxMessage is a call to web-order waiting to be delivered
+type OutboxMessage struct {
+	ID            uint64       `json:"id"`
+	OrderID       string       `json:"order_id"`
+	Kind          string       `json:"kind"`
+	Order         oko.Order    `json:"order"`
+	Status        OutboxStatus `json:"status"`
+	Attempts      int          `json:"attempts"`
+	LastError     string       `json:"last_error,omitempty"`
+	NextAttemptAt time.Time    `json:"next_attempt_at"`
+	CreatedAt     time.Time    `json:"created_at"`
+}
+
+// OutboxSettings controls the retries of the outbox dispatcher
+type OutboxSettings struct {
+	MaxAttempts int           // Attempts before a message becomes a dead letter
+	BaseDelay   time.Duration // Delay before the first retry, doubled at each attempt
+	MaxDelay    time.Duration // Longest delay between two attempts
+	HTTPClient  *http.Client  // Client calling web-order, its timeout bounds each attempt
+}
+
+// newOutboxMessage returns a message to deliver right away
+func newOutboxMessage(kind string, order *OrderRecord) OutboxMessage {
+	now := time.Now().UTC()
+
+	return OutboxMessage{
+		OrderID:       order.ID,
+		Kind:          kind,
+		Order:         order.Infos.Order,
+		Status:        OutboxPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	}
+}
+
+// outboxKey returns the key of a message, sorted by creation
+func outboxKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+// putOutboxMessage saves a message, giving an ID to new ones
+func putOutboxMessage(bucket *bolt.Bucket, message OutboxMessage) error {
+	if message.ID == 0 {
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		message.ID = id
+	}
+
+	value, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(outboxKey(message.ID), value)
+}
+
+// ListOutboxMessages returns the messages in one of the given statuses, oldest first
+func (s *BoltOrderStore) ListOutboxMessages(statuses ...OutboxStatus) ([]*OutboxMessage, error) {
+	var messages []*OutboxMessage
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(outboxBucket).ForEach(func(_, value []byte) error {
+			message := &OutboxMessage{}
+			if err := json.Unmarshal(value, message); err != nil {
+				return err
+			}
+			for _, status := range statuses {
+				if message.Status == status {
+					messages = append(messages, message)
+				}
+			}
+			return nil
+		})
+	})
+
+	return messages, err
+}
+
+// UpdateOutboxMessage reads, updates and saves a message in a single transaction
+func (s *BoltOrderStore) UpdateOutboxMessage(id uint64, update func(message *OutboxMessage) error) (*OutboxMessage, error) {
+	message := &OutboxMessage{}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(outboxBucket)
+
+		value := bucket.Get(outboxKey(id))
+		if value == nil {
+			return ErrMessageNotFound
+		}
+		if err := json.Unmarshal(value, message); err != nil {
+			return err
+		}
+		if err := update(message); err != nil {
+			return err
+		}
+		return putOutboxMessage(bucket, *message)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// DeleteOutboxMessage removes a delivered message
+func (s *BoltOrderStore) DeleteOutboxMessage(id uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(outboxBucket).Delete(outboxKey(id))
+	})
+}
+
+// ===================================================================
+// Starts the background dispatcher delivering the outbox messages to
+// web-order. Failed deliveries (including non-2xx responses) are
+// retried with an exponential backoff, then parked as dead letters.
+//
+// Parameters:
+//
+//	(string) webOrderURL : Used to contact web-order service.
+//	(OutboxSettings) settings : Retries of the deliveries, defaults for zero values
+//
+// Used on:
+//
+//	(*OrderOrchestrator) o : Object that permits asynchronous management of the order
+//
+// Example:
+//
+//	orderOrchestrator.StartOutbox("http://localhost:8010/order", OutboxSettings{MaxAttempts: 5})
+//
+// ===================================================================
+func (o *OrderOrchestrator) StartOutbox(webOrderURL string, settings OutboxSettings) {
+	if settings.MaxAttempts <= 0 {
+		settings.MaxAttempts = DefaultOutboxMaxAttempts
+	}
+	if settings.BaseDelay <= 0 {
+		settings.BaseDelay = DefaultOutboxBaseDelay
+	}
+	if settings.MaxDelay <= 0 {
+		settings.MaxDelay = DefaultOutboxMaxDelay
+	}
+	// A hung web-order must not block the dispatcher
+	if settings.HTTPClient == nil {
+		settings.HTTPClient = &http.Client{Timeout: DefaultWebOrderTimeout}
+	}
+
+	go func() {
+		ticker := time.NewTicker(outboxPollInterval)
+		defer ticker.Stop()
+
+		for {
+			o.dispatchOutbox(webOrderURL, settings)
+
+			select {
+			case <-ticker.C:
+			case <-o.outboxWake:
+			}
+		}
+	}()
+}
+
+// wakeOutbox asks the dispatcher to deliver the new messages right away
+func (o *OrderOrchestrator) wakeOutbox() {
+	select {
+	case o.outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatchOutbox delivers the pending messages that are due
+func (o *OrderOrchestrator) dispatchOutbox(webOrderURL string, settings OutboxSettings) {
+	messages, err := o.store.ListOutboxMessages(OutboxPending)
+	if err != nil {
+		fmt.Printf("[ERROR] Could not read outbox: %s\n", err)
+		return
+	}
+
+	now := time.Now()
+	for _, message := range messages {
+		if message.NextAttemptAt.After(now) {
+			continue
+		}
+
+		err := deliverMessage(settings.HTTPClient, webOrderURL, message)
+		if err == nil {
+			if err := o.store.DeleteOutboxMessage(message.ID); err != nil {
+				fmt.Printf("[ERROR] Could not remove delivered message %d: %s\n", message.ID, err)
+			}
+			outboxDelivered.Add(1)
+			o.messageDelivered(message)
+			continue
+		}
+
+		fmt.Printf("[ERROR] Could not deliver message %d (%s of order %s): %s\n", message.ID, message.Kind, message.OrderID, err)
+		updated, updateErr := o.store.UpdateOutboxMessage(message.ID, func(message *OutboxMessage) error {
+			message.Attempts++
+			message.LastError = err.Error()
+			if message.Attempts >= settings.MaxAttempts {
+				message.Status = OutboxDeadLetter
+				return nil
+			}
+			message.NextAttemptAt = time.Now().UTC().Add(backoff(message.Attempts, settings))
+			return nil
+		})
+		if updateErr != nil {
+			fmt.Printf("[ERROR] Could not update message %d: %s\n", message.ID, updateErr)
+			continue
+		}
+		if updated.Status == OutboxDeadLetter {
+			fmt.Printf("[ERROR] Message %d moved to dead letters after %d attempts\n", message.ID, updated.Attempts)
+			outboxDeadLetters.Add(1)
+		}
+	}
+}
+
+// backoff returns the delay before the next attempt, doubled at each attempt
+func backoff(attempts int, settings OutboxSettings) time.Duration {
+	delay := settings.BaseDelay
+	for i := 1; i < attempts && delay < settings.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > settings.MaxDelay {
+		delay = settings.MaxDelay
+	}
+
+	return delay
+}
+
+// deliverMessage calls web-order for a message
+func deliverMessage(client *http.Client, webOrderURL string, message *OutboxMessage) error {
+	switch message.Kind {
+	case MessageLaunchOrder:
+		return helpers.LaunchOrder(client, webOrderURL, &message.Order)
+	case MessageDecommissionOrder:
+		return helpers.DecommissionOrder(client, webOrderURL, message.Order.PaypalID)
+	default:
+		return fmt.Errorf("unknown message kind %q", message.Kind)
+	}
+}
+
+// messageDelivered records on the order that web-order got its message.
+// The payment is captured once web-order reports the cluster created.
+func (o *OrderOrchestrator) messageDelivered(message *OutboxMessage) {
+	if message.Kind != MessageLaunchOrder {
+		return
+	}
+	o.markOrderSent(message.OrderID)
+}
+
+// ListDeadLetters answers with the messages web-order never accepted
+func (o *OrderOrchestrator) ListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	messages, err := o.store.ListOutboxMessages(OutboxDeadLetter)
+	if err != nil {
+		fmt.Printf("[ERROR] Could not read outbox: %s\n", err)
+		helpers.RespondWithError(w, helpers.InternalError("Could not read outbox", err))
+		return
+	}
+	if messages == nil {
+		messages = []*OutboxMessage{}
+	}
+
+	helpers.RespondWithJSON(w, http.StatusOK, messages)
+}
+
+// ===================================================================
+// Sends a dead letter again: its attempts are reset and it is
+// delivered right away
+//
+// Parameters:
+//
+//	(http.ResponseWriter) w : Used to generate HTTP responses (retrieved by the router)
+//	(*http.Request) r : HTTP request holding the message ID in its path
+//
+// Used on:
+//
+//	(*OrderOrchestrator) o : Object that permits asynchronous management of the order
+//
+// ===================================================================
+func (o *OrderOrchestrator) ReplayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		helpers.RespondWithError(w, helpers.ValidationError("Invalid message ID", nil))
+		return
+	}
+
+	message, err := o.store.UpdateOutboxMessage(id, func(message *OutboxMessage) error {
+		if message.Status != OutboxDeadLetter {
+			return fmt.Errorf("%w: message %d is %s", ErrNotDeadLetter, message.ID, message.Status)
+		}
+		message.Status = OutboxPending
+		message.Attempts = 0
+		message.NextAttemptAt = time.Now().UTC()
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("[ERROR] Could not replay message %d: %s\n", id, err)
+		helpers.RespondWithError(w, apiError("Could not replay message", err))
+		return
+	}
+	fmt.Printf("[INFO] Replaying message %d (%s of order %s)\n", message.ID, message.Kind, message.OrderID)
+	o.wakeOutbox()
+
+	helpers.RespondWithJSON(w, http.StatusOK, message)
+}
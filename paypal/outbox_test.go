@@ -0,0 +1,166 @@
+package paypal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// saveOutboxMessage saves an order with a message of the given kind in the outbox
+func saveOutboxMessage(t *testing.T, store *BoltOrderStore, kind string) {
+	t.Helper()
+	order := NewOrderRecord("PAY-1", PaypalOrderInfos{})
+	if err := store.SaveOrder(order); err != nil {
+		t.Fatal(err)
+	}
+	_, err := store.UpdateOrderWithOutbox(order.ID, func(stored *OrderRecord) ([]OutboxMessage, error) {
+		return []OutboxMessage{newOutboxMessage(kind, stored)}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDispatchOutboxTimesOut(t *testing.T) {
+	// web-order accepts the connection but never answers
+	hung := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	defer server.Close()
+	defer close(hung)
+
+	store, _ := openTestStore(t)
+	orchestrator := NewOrderOchestrator(store, nil, time.Minute)
+	saveOutboxMessage(t, store, MessageLaunchOrder)
+
+	settings := OutboxSettings{
+		MaxAttempts: 3,
+		BaseDelay:   time.Minute,
+		MaxDelay:    time.Minute,
+		HTTPClient:  &http.Client{Timeout: 50 * time.Millisecond},
+	}
+	done := make(chan struct{})
+	go func() {
+		orchestrator.dispatchOutbox(server.URL, settings)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("dispatcher blocked by a hung web-order")
+	}
+
+	messages, err := store.ListOutboxMessages(OutboxPending)
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("ListOutboxMessages() = %d messages, %v, want 1", len(messages), err)
+	}
+	if messages[0].Attempts != 1 || messages[0].LastError == "" {
+		t.Errorf("message has %d attempts and error %q, want a failed attempt to retry", messages[0].Attempts, messages[0].LastError)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	settings := OutboxSettings{BaseDelay: 5 * time.Second, MaxDelay: time.Minute}
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 1, want: 5 * time.Second},
+		{attempts: 2, want: 10 * time.Second},
+		{attempts: 3, want: 20 * time.Second},
+		{attempts: 4, want: 40 * time.Second},
+		{attempts: 5, want: time.Minute},
+		{attempts: 100, want: time.Minute},
+	}
+	for _, test := range tests {
+		if got := backoff(test.attempts, settings); got != test.want {
+			t.Errorf("backoff(%d) = %s, want %s", test.attempts, got, test.want)
+		}
+	}
+}
+
+func TestDispatchOutboxRetriesThenDeadLetters(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	store, _ := openTestStore(t)
+	orchestrator := NewOrderOchestrator(store, nil, time.Minute)
+	saveOutboxMessage(t, store, MessageDecommissionOrder)
+	settings := OutboxSettings{MaxAttempts: 3, BaseDelay: time.Minute, MaxDelay: time.Hour, HTTPClient: server.Client()}
+
+	for attempt := 1; attempt <= settings.MaxAttempts; attempt++ {
+		orchestrator.dispatchOutbox(server.URL, settings)
+		if got := int(calls.Load()); got != attempt {
+			t.Fatalf("web-order called %d times, want %d", got, attempt)
+		}
+
+		pending, err := store.ListOutboxMessages(OutboxPending)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attempt == settings.MaxAttempts {
+			if len(pending) != 0 {
+				t.Fatalf("message still pending after %d attempts", attempt)
+			}
+			break
+		}
+		if len(pending) != 1 || pending[0].Attempts != attempt {
+			t.Fatalf("pending messages = %+v, want the message with %d attempts", pending, attempt)
+		}
+		wait := time.Until(pending[0].NextAttemptAt)
+		if want := backoff(attempt, settings); wait > want || wait < want-5*time.Second {
+			t.Errorf("next attempt in %s, want %s", wait, want)
+		}
+
+		// Not due yet: web-order is not called again
+		orchestrator.dispatchOutbox(server.URL, settings)
+		if got := int(calls.Load()); got != attempt {
+			t.Fatalf("web-order called %d times before the next attempt is due, want %d", got, attempt)
+		}
+		if _, err := store.UpdateOutboxMessage(pending[0].ID, func(message *OutboxMessage) error {
+			message.NextAttemptAt = time.Now().UTC()
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadLetters, err := store.ListOutboxMessages(OutboxDeadLetter)
+	if err != nil || len(deadLetters) != 1 {
+		t.Fatalf("ListOutboxMessages() = %d dead letters, %v, want 1", len(deadLetters), err)
+	}
+	if deadLetters[0].Attempts != settings.MaxAttempts || deadLetters[0].LastError == "" {
+		t.Errorf("dead letter has %d attempts and error %q, want %d attempts and the last error",
+			deadLetters[0].Attempts, deadLetters[0].LastError, settings.MaxAttempts)
+	}
+
+	// Dead letters wait for a replay
+	orchestrator.dispatchOutbox(server.URL, settings)
+	if got := int(calls.Load()); got != settings.MaxAttempts {
+		t.Errorf("web-order called %d times, want no delivery of the dead letter", got)
+	}
+}
+
+func TestDispatchOutboxDeletesDeliveredMessages(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	store, _ := openTestStore(t)
+	orchestrator := NewOrderOchestrator(store, nil, time.Minute)
+	saveOutboxMessage(t, store, MessageDecommissionOrder)
+
+	orchestrator.dispatchOutbox(server.URL, OutboxSettings{MaxAttempts: 3, BaseDelay: time.Minute, MaxDelay: time.Hour, HTTPClient: server.Client()})
+
+	messages, err := store.ListOutboxMessages(OutboxPending, OutboxDeadLetter)
+	if err != nil || len(messages) != 0 {
+		t.Errorf("ListOutboxMessages() = %+v, %v, want the delivered message removed", messages, err)
+	}
+}
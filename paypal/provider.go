@@ -0,0 +1,338 @@
+package paypal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/OneKonsole/web-service-billing/payment"
+	"github.com/OneKonsole/web-service-billing/pricing"
+)
+
+// Name of the Paypal payment provider
+const ProviderName = "paypal"
+
+// Name identifies Paypal in the orders
+func (c *Client) Name() string {
+	return ProviderName
+}
+
+// ===================================================================
+// Creates a Paypal order the customer approves on Paypal
+//
+// Parameters:
+//
+//	(payment.CheckoutRequest) request : Details about the order requested
+//
+// Used on:
+//
+//	(*Client) c : Paypal API client
+//
+// Return:
+//
+//	(payment.Checkout) : Created Paypal order and its approval link
+//	(error) : Error during process or nil if no error occurs
+//
+// ===================================================================
+func (c *Client) CreateCheckout(request payment.CheckoutRequest) (payment.Checkout, error) {
+	createdOrder, err := c.CreateOrder(request)
+	if err != nil {
+		return payment.Checkout{}, err
+	}
+
+	checkout := payment.Checkout{
+		ID:       createdOrder.OrderID,
+		Provider: ProviderName,
+		Status:   createdOrder.Status,
+	}
+	for _, link := range createdOrder.Links {
+		if link.Rel == "approve" || link.Rel == "payer-action" {
+			checkout.ApprovalURL = link.Href
+		}
+	}
+
+	return checkout, nil
+}
+
+// GetStatus returns the state of a Paypal order
+func (c *Client) GetStatus(checkoutID string) (payment.Status, error) {
+	details, err := c.GetOrder(checkoutID)
+	if err != nil {
+		return payment.Status{}, err
+	}
+
+	return details.paymentStatus(), nil
+}
+
+// ===================================================================
+// Authorizes the payment of an approved Paypal order. The money is
+// held on the customer account until it is captured or voided.
+//
+// Parameters:
+//
+//	(string) checkoutID : ID of the Paypal order
+//
+// Used on:
+//
+//	(*Client) c : Paypal API client
+//
+// Return:
+//
+//	(payment.Status) : State of the order once authorized
+//	(error) : Error during process or nil if no error occurs
+//
+// Example:
+//
+//	status, err := client.Authorize("xyYxyZxxxxYZxZ")
+//
+// ===================================================================
+func (c *Client) Authorize(checkoutID string) (payment.Status, error) {
+	fmt.Printf("[INFO] Authorizing Paypal order %s....\n", checkoutID)
+
+	var details PaypalOrderDetails
+	if err := c.post("/v2/checkout/orders/"+checkoutID+"/authorize", nil, "", &details); err != nil {
+		return payment.Status{}, err
+	}
+	fmt.Printf("[INFO] Order %s authorized !\n", checkoutID)
+
+	return details.paymentStatus(), nil
+}
+
+// ===================================================================
+// Captures the payment of a Paypal order: its authorization, or the
+// order itself for orders created with the CAPTURE intent. Capturing
+// an order again returns its existing capture.
+//
+// Parameters:
+//
+//	(string) checkoutID : ID of the Paypal order
+//
+// Used on:
+//
+//	(*Client) c : Paypal API client
+//
+// Return:
+//
+//	(payment.Status) : State of the order once captured
+//	(error) : Error during process or nil if no error occurs
+//
+// Example:
+//
+//	status, err := client.Capture("xyYxyZxxxxYZxZ")
+//
+// ===================================================================
+func (c *Client) Capture(checkoutID string) (payment.Status, error) {
+	fmt.Printf("[INFO] Capturing Paypal order %s....\n", checkoutID)
+
+	details, err := c.GetOrder(checkoutID)
+	if err != nil {
+		return payment.Status{}, err
+	}
+
+	authorization := details.authorization()
+	// Captured by a previous attempt whose result was not saved
+	if authorization != nil && authorization.Status == "CAPTURED" {
+		fmt.Printf("[INFO] Order %s already captured\n", checkoutID)
+		return details.paymentStatus(), nil
+	}
+
+	// The same request ID makes Paypal answer a retried capture with the first one
+	requestID := "capture-" + checkoutID
+	if authorization == nil {
+		var captured PaypalOrderDetails
+		if err := c.post("/v2/checkout/orders/"+checkoutID+"/capture", nil, requestID, &captured); err != nil {
+			return payment.Status{}, err
+		}
+		fmt.Printf("[INFO] Order %s captured !\n", checkoutID)
+		return captured.paymentStatus(), nil
+	}
+
+	var capture PaypalPayment
+	body := map[string]interface{}{"final_capture": true}
+	if err := c.post("/v2/payments/authorizations/"+authorization.ID+"/capture", body, requestID, &capture); err != nil {
+		return payment.Status{}, err
+	}
+	fmt.Printf("[INFO] Order %s captured !\n", checkoutID)
+
+	status := details.paymentStatus()
+	status.ProviderStatus = capture.Status
+	status.CaptureID = capture.ID
+	status.State = payment.StateCaptured
+	if capture.Status == "DECLINED" {
+		status.State = payment.StateFailed
+	}
+
+	return status, nil
+}
+
+// ===================================================================
+// Refunds a captured Paypal payment
+//
+// Parameters:
+//
+//	(string) captureID : ID of the Paypal capture
+//	(*pricing.Money) amount : Amount to refund, the whole capture if nil
+//	(string) reason : Note sent to the customer
+//	(string) idempotencyKey : Sent as PayPal-Request-Id, a retry with the same key returns the first refund
+//
+// Used on:
+//
+//	(*Client) c : Paypal API client
+//
+// Return:
+//
+//	(payment.Refund) : Refund created on Paypal
+//	(error) : Error during process or nil if no error occurs
+//
+// ===================================================================
+func (c *Client) Refund(captureID string, amount *pricing.Money, reason string, idempotencyKey string) (payment.Refund, error) {
+	body := map[string]interface{}{}
+	if amount != nil {
+		body["amount"] = amount.Round()
+	}
+	if reason != "" {
+		body["note_to_payer"] = reason
+	}
+
+	req, err := c.newRequest("POST", "/v2/payments/captures/"+captureID+"/refund", body)
+	if err != nil {
+		return payment.Refund{}, err
+	}
+	// Paypal only returns the refunded amount with the full representation
+	req.Header.Add("Prefer", "return=representation")
+	if idempotencyKey != "" {
+		req.Header.Add("PayPal-Request-Id", idempotencyKey)
+	}
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return payment.Refund{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated && res.StatusCode != http.StatusOK {
+		return payment.Refund{}, &payment.StatusError{Provider: "Paypal", StatusCode: res.StatusCode, Operation: "capture " + captureID + " refund"}
+	}
+
+	var refund payment.Refund
+	if err := json.NewDecoder(res.Body).Decode(&refund); err != nil {
+		return payment.Refund{}, err
+	}
+
+	return refund, nil
+}
+
+// ===================================================================
+// Voids the authorization of a Paypal order. Paypal offers no way to
+// void an order that has not been authorized, it is dropped on their
+// side once it expires.
+//
+// Parameters:
+//
+//	(string) checkoutID : ID of the Paypal order
+//
+// Used on:
+//
+//	(*Client) c : Paypal API client
+//
+// Return:
+//
+//	(error) : Error during process or nil if no error occurs
+//
+// ===================================================================
+func (c *Client) Cancel(checkoutID string) error {
+	details, err := c.GetOrder(checkoutID)
+	if err != nil {
+		return err
+	}
+
+	authorization := details.authorization()
+	if authorization == nil || authorization.Status != "CREATED" {
+		return nil
+	}
+
+	fmt.Printf("[INFO] Voiding authorization %s of order %s\n", authorization.ID, checkoutID)
+	return c.post("/v2/payments/authorizations/"+authorization.ID+"/void", nil, "void-"+checkoutID, nil)
+}
+
+// post sends a POST request to the Paypal API and decodes its response in result, if any.
+// Paypal processes a request ID only once, it may be empty.
+func (c *Client) post(path string, body interface{}, requestID string, result interface{}) error {
+	req, err := c.newRequest("POST", path, body)
+	if err != nil {
+		return err
+	}
+	if requestID != "" {
+		req.Header.Add("PayPal-Request-Id", requestID)
+	}
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return &payment.StatusError{Provider: "Paypal", StatusCode: res.StatusCode, Operation: path}
+	}
+	if result == nil || res.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+// paymentStatus converts a Paypal order into a provider independent state
+func (details PaypalOrderDetails) paymentStatus() payment.Status {
+	status := payment.Status{
+		CheckoutID:     details.ID,
+		ProviderStatus: details.Status,
+		State:          payment.StatePending,
+		CaptureID:      details.captureID(),
+	}
+	authorization := details.authorization()
+	if authorization != nil {
+		status.AuthorizationID = authorization.ID
+	}
+	if len(details.PurchaseUnits) == 1 {
+		status.Amount = details.PurchaseUnits[0].Amount
+	}
+
+	switch details.Status {
+	case "APPROVED":
+		status.State = payment.StateApproved
+	case "COMPLETED":
+		status.State = paymentState(details.capture(), authorization)
+	case "VOIDED":
+		status.State = payment.StateCancelled
+	}
+
+	return status
+}
+
+// paymentState returns the state of a completed Paypal order from its payments
+func paymentState(capture *PaypalPayment, authorization *PaypalPayment) payment.State {
+	if capture != nil {
+		if capture.Status == "DECLINED" || capture.Status == "FAILED" {
+			return payment.StateFailed
+		}
+		return payment.StateCaptured
+	}
+	if authorization == nil {
+		// A completed CAPTURE intent order always has a capture
+		return payment.StateCaptured
+	}
+
+	switch authorization.Status {
+	case "CREATED":
+		return payment.StateAuthorized
+	case "CAPTURED", "PARTIALLY_CAPTURED":
+		return payment.StateCaptured
+	case "DENIED":
+		return payment.StateFailed
+	case "VOIDED", "EXPIRED":
+		return payment.StateCancelled
+	default:
+		return payment.StatePending
+	}
+}
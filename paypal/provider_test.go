@@ -0,0 +1,128 @@
+package paypal
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/OneKonsole/web-service-billing/payment"
+)
+
+// paypalServer is a Paypal API holding a single authorized order, recording the POST requests
+type paypalServer struct {
+	mutex               sync.Mutex
+	authorizationStatus string
+	requestIDs          map[string]string // PayPal-Request-Id of each POST path
+}
+
+func (s *paypalServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if r.Method == "POST" && r.URL.Path != "/v1/oauth2/token" {
+		s.requestIDs[r.URL.Path] = r.Header.Get("PayPal-Request-Id")
+	}
+
+	switch r.Method + " " + r.URL.Path {
+	case "POST /v1/oauth2/token":
+		fmt.Fprint(w, `{"access_token": "token", "expires_in": 32400}`)
+	case "GET /v2/checkout/orders/ORDER-1":
+		captures := `[]`
+		if s.authorizationStatus == "CAPTURED" {
+			captures = `[{"id": "CAPTURE-1", "status": "COMPLETED"}]`
+		}
+		fmt.Fprintf(w, `{"id": "ORDER-1", "status": "COMPLETED", "purchase_units": [{
+			"amount": {"currency_code": "EUR", "value": "12.00"},
+			"payments": {"authorizations": [{"id": "AUTH-1", "status": %q}], "captures": %s}}]}`,
+			s.authorizationStatus, captures)
+	case "POST /v2/payments/authorizations/AUTH-1/capture":
+		s.authorizationStatus = "CAPTURED"
+		fmt.Fprint(w, `{"id": "CAPTURE-1", "status": "COMPLETED"}`)
+	case "POST /v2/payments/captures/CAPTURE-1/refund":
+		fmt.Fprint(w, `{"id": "REFUND-1", "status": "COMPLETED", "amount": {"currency_code": "EUR", "value": "12.00"}}`)
+	case "POST /v2/payments/authorizations/AUTH-1/void":
+		s.authorizationStatus = "VOIDED"
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestPaypalClient(t *testing.T, authorizationStatus string) (*Client, *paypalServer) {
+	t.Helper()
+	api := &paypalServer{authorizationStatus: authorizationStatus, requestIDs: make(map[string]string)}
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+
+	client, err := NewClient(EnvironmentSandbox, server.URL, "id", "secret", server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, api
+}
+
+func TestCapture(t *testing.T) {
+	tests := []struct {
+		name                string
+		authorizationStatus string
+		wantRequestID       string // Empty if no capture must be requested
+	}{
+		{name: "authorized", authorizationStatus: "CREATED", wantRequestID: "capture-ORDER-1"},
+		{name: "already captured", authorizationStatus: "CAPTURED"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, api := newTestPaypalClient(t, test.authorizationStatus)
+
+			status, err := client.Capture("ORDER-1")
+			if err != nil {
+				t.Fatalf("Capture() error = %v", err)
+			}
+			if status.State != payment.StateCaptured || status.CaptureID != "CAPTURE-1" {
+				t.Errorf("Capture() = %s with capture %q, want %s with capture CAPTURE-1", status.State, status.CaptureID, payment.StateCaptured)
+			}
+
+			requestID, captured := api.requestIDs["/v2/payments/authorizations/AUTH-1/capture"]
+			if captured != (test.wantRequestID != "") || requestID != test.wantRequestID {
+				t.Errorf("capture requested = %v with PayPal-Request-Id %q, want %q", captured, requestID, test.wantRequestID)
+			}
+		})
+	}
+}
+
+func TestCancelVoidsAuthorization(t *testing.T) {
+	client, api := newTestPaypalClient(t, "CREATED")
+
+	if err := client.Cancel("ORDER-1"); err != nil {
+		t.Fatalf("Cancel() error = %v", err)
+	}
+	if requestID := api.requestIDs["/v2/payments/authorizations/AUTH-1/void"]; requestID != "void-ORDER-1" {
+		t.Errorf("PayPal-Request-Id = %q, want void-ORDER-1", requestID)
+	}
+
+	// Nothing left to void
+	if err := client.Cancel("ORDER-1"); err != nil {
+		t.Fatalf("Cancel() error = %v", err)
+	}
+	if len(api.requestIDs) != 1 {
+		t.Errorf("%d requests sent, want 1", len(api.requestIDs))
+	}
+}
+
+func TestRefundSendsIdempotencyKey(t *testing.T) {
+	client, api := newTestPaypalClient(t, "CAPTURED")
+
+	refund, err := client.Refund("CAPTURE-1", nil, "cluster unavailable", "refund-ORDER-1-1")
+	if err != nil {
+		t.Fatalf("Refund() error = %v", err)
+	}
+	if refund.ID != "REFUND-1" || refund.Amount != testAmount {
+		t.Errorf("Refund() = %+v, want REFUND-1 of %s", refund, testAmount)
+	}
+	if requestID := api.requestIDs["/v2/payments/captures/CAPTURE-1/refund"]; requestID != "refund-ORDER-1-1" {
+		t.Errorf("PayPal-Request-Id = %q, want refund-ORDER-1-1", requestID)
+	}
+}
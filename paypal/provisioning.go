@@ -0,0 +1,146 @@
+package paypal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	helpers "github.com/OneKonsole/web-service-billing/helpers"
+)
+
+// Provisioning results reported by web-order
+const (
+	ProvisioningSucceeded = "PROVISIONED"
+	ProvisioningFailed    = "FAILED"
+)
+
+var (
+	ErrInvalidProvisioningStatus = errors.New("provisioning status must be PROVISIONED or FAILED")
+	ErrProvisioningConflict      = errors.New("provisioning already reported with another status")
+	ErrNotProvisioning           = errors.New("order is not waiting for its provisioning")
+)
+
+// ProvisioningReport is the body of POST /order/{id}/provisioning
+type ProvisioningReport struct {
+	Status  string `json:"status"`
+	Details string `json:"details"`
+}
+
+// Provisioning follows the creation of the cluster of an order by web-order
+type Provisioning struct {
+	SentAt     *time.Time `json:"sent_at,omitempty"` // Web-order accepted the order
+	Status     string     `json:"status,omitempty"`  // As reported by web-order, PROVISIONED or FAILED
+	Details    string     `json:"details,omitempty"`
+	ReportedAt *time.Time `json:"reported_at,omitempty"`
+}
+
+// ===================================================================
+// Handles the result of a cluster creation reported by web-order.
+// A created cluster gets its payment captured, a failed one gets its
+// authorization voided, or its payment refunded if it was already
+// captured. Reporting the same result again replays the follow-up
+// if it did not succeed, e.g. when the payment provider was down.
+//
+// Parameters:
+//
+//	(http.ResponseWriter) w : Used to generate HTTP responses (retrieved by the router)
+//	(string) orderID : Checkout ID of the order
+//	(ProvisioningReport) report : Result of the cluster creation
+//
+// Used on:
+//
+//	(*OrderOrchestrator) o : Object that permits asynchronous management of the order
+//
+// Example:
+//
+//	orderOrchestrator.ReportProvisioning(w, "xyYxyZ", ProvisioningReport{Status: ProvisioningSucceeded})
+//
+// ===================================================================
+func (o *OrderOrchestrator) ReportProvisioning(w http.ResponseWriter, orderID string, report ProvisioningReport) {
+	order, err := o.reportProvisioning(orderID, report)
+	if err != nil {
+		helpers.RespondWithError(w, apiError("Could not process provisioning report", err))
+		return
+	}
+
+	helpers.RespondWithJSON(w, http.StatusOK, order)
+}
+
+// ===================================================================
+// Records the provisioning result on the order then captures, voids
+// or refunds its payment
+//
+// Parameters:
+//
+//	(string) orderID : Checkout ID of the order
+//	(ProvisioningReport) report : Result of the cluster creation
+//
+// Used on:
+//
+//	(*OrderOrchestrator) o : Object that permits asynchronous management of the order
+//
+// Return:
+//
+//	(*OrderRecord) : Order once the follow-up is done
+//	(error) : ErrOrderNotFound, ErrInvalidProvisioningStatus, ErrProvisioningConflict,
+//		ErrNotProvisioning or a store error
+//
+// ===================================================================
+func (o *OrderOrchestrator) reportProvisioning(orderID string, report ProvisioningReport) (*OrderRecord, error) {
+	if report.Status != ProvisioningSucceeded && report.Status != ProvisioningFailed {
+		return nil, ErrInvalidProvisioningStatus
+	}
+
+	// Reports of the same order must not capture or refund it twice
+	o.provisioningMutex.Lock()
+	defer o.provisioningMutex.Unlock()
+
+	order, err := o.store.UpdateOrder(orderID, func(order *OrderRecord) error {
+		if order.Provisioning.Status != "" {
+			if order.Provisioning.Status != report.Status {
+				return fmt.Errorf("%w: %s", ErrProvisioningConflict, order.Provisioning.Status)
+			}
+			return nil
+		}
+		if order.Status != StatusProvisioningRequested {
+			return fmt.Errorf("%w: order is %s", ErrNotProvisioning, order.Status)
+		}
+
+		now := time.Now().UTC()
+		order.Provisioning.Status = report.Status
+		order.Provisioning.Details = report.Details
+		order.Provisioning.ReportedAt = &now
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("[ERROR] Could not record provisioning of order %s: %s\n", orderID, err)
+		return nil, err
+	}
+	fmt.Printf("[INFO] Web-order reported order %s %s (%s)\n", orderID, report.Status, report.Details)
+
+	// Follow-up already done by a previous report
+	if order.Status != StatusProvisioningRequested {
+		return order, nil
+	}
+
+	if report.Status == ProvisioningSucceeded {
+		o.completeOrder(order)
+	} else {
+		o.abortOrder(order, "web-order could not create the cluster")
+	}
+
+	return order, nil
+}
+
+// markOrderSent records that web-order accepted the order
+func (o *OrderOrchestrator) markOrderSent(orderID string) {
+	_, err := o.store.UpdateOrder(orderID, func(order *OrderRecord) error {
+		now := time.Now().UTC()
+		order.Provisioning.SentAt = &now
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("[ERROR] Could not update order %s: %s\n", orderID, err)
+	}
+}
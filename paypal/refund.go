@@ -0,0 +1,330 @@
+package paypal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+
+	helpers "github.com/OneKonsole/web-service-billing/helpers"
+	"github.com/OneKonsole/web-service-billing/payment"
+	"github.com/OneKonsole/web-service-billing/pricing"
+)
+
+var (
+	ErrNotRefundable       = errors.New("order can not be refunded")
+	ErrInvalidRefundAmount = errors.New("invalid refund amount")
+	ErrRefundPending       = errors.New("another refund of the order is pending")
+)
+
+// RefundRequest is the body of POST /order/{id}/refund
+type RefundRequest struct {
+	Amount *pricing.Decimal `json:"amount"` // In the order currency, the remaining amount if nil
+	Reason string           `json:"reason"`
+}
+
+// RefundedAmount returns the sum of the refunds of the order
+func (order *OrderRecord) RefundedAmount() pricing.Money {
+	refunded := pricing.NewMoney(0, order.Quote.Gross.Currency)
+	for _, refund := range order.Refunds {
+		refunded = refunded.Add(refund.Amount)
+	}
+
+	return refunded
+}
+
+// ===================================================================
+// Refunds a captured order, entirely or partially, on its payment
+// provider. Once the order is entirely refunded, web-order is asked
+// to decommission its cluster through the outbox.
+//
+// Parameters:
+//
+//	(http.ResponseWriter) w : Used to generate HTTP responses (retrieved by the router)
+//	(string) orderID : Checkout ID of the order
+//	(RefundRequest) request : Amount and reason of the refund
+//
+// Used on:
+//
+//	(*OrderOrchestrator) o : Object that permits asynchronous management of the order
+//
+// Example:
+//
+//	orderOrchestrator.RefundOrder(w, "xyYxyZ", RefundRequest{Reason: "cluster unavailable"})
+//
+// ===================================================================
+func (o *OrderOrchestrator) RefundOrder(w http.ResponseWriter, orderID string, request RefundRequest) {
+	order, err := o.refund(orderID, request, true)
+	if err != nil {
+		helpers.RespondWithError(w, apiError("Could not refund order", err))
+		return
+	}
+
+	helpers.RespondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"order_id": order.ID,
+		"status":   order.Status,
+		"refunded": order.RefundedAmount(),
+		"refunds":  order.Refunds,
+	})
+}
+
+// ===================================================================
+// Checks the refund, sends it to the payment provider and records it.
+// The attempt is saved on the order with its idempotency key before
+// the provider is called: when its result is lost (e.g. timeout), the
+// retried refund is sent with the same key and not made twice.
+//
+// Parameters:
+//
+//	(string) orderID : Checkout ID of the order
+//	(RefundRequest) request : Amount and reason of the refund
+//	(bool) decommission : Whether the cluster is decommissioned once the order is entirely refunded
+//
+// Used on:
+//
+//	(*OrderOrchestrator) o : Object that permits asynchronous management of the order
+//
+// Return:
+//
+//	(*OrderRecord) : Order once refunded
+//	(error) : ErrOrderNotFound, ErrNotRefundable, ErrInvalidRefundAmount,
+//		ErrRefundPending or a provider request error
+//
+// ===================================================================
+func (o *OrderOrchestrator) refund(orderID string, request RefundRequest, decommission bool) (*OrderRecord, error) {
+	// Refunds of the same order are checked against each other's amounts
+	o.refundMutex.Lock()
+	defer o.refundMutex.Unlock()
+
+	order, err := o.store.GetOrder(orderID)
+	if err != nil {
+		return nil, err
+	}
+	if order.CaptureID == "" || !order.CanTransition(StatusRefunded) {
+		return nil, fmt.Errorf("%w: order is %s", ErrNotRefundable, order.Status)
+	}
+
+	remaining := order.Quote.Gross.Amount.Sub(order.RefundedAmount().Amount)
+	amount := pricing.NewMoney(remaining, order.Quote.Gross.Currency)
+	if request.Amount != nil {
+		amount = pricing.NewMoney(*request.Amount, order.Quote.Gross.Currency)
+	}
+	if amount.Round() != amount {
+		return nil, fmt.Errorf("%w: %s has too many decimals for %s", ErrInvalidRefundAmount, amount.Amount, amount.Currency)
+	}
+	if amount.Amount <= 0 || amount.Amount > remaining {
+		return nil, fmt.Errorf("%w: must be between 0 and %s %s", ErrInvalidRefundAmount,
+			pricing.NewMoney(remaining, amount.Currency), amount.Currency)
+	}
+
+	provider, err := o.provider(order.Infos.Provider)
+	if err != nil {
+		return nil, err
+	}
+
+	attempt := order.PendingRefund
+	if attempt != nil && attempt.Amount != amount {
+		return nil, fmt.Errorf("%w: the refund of %s %s must be retried first", ErrRefundPending, attempt.Amount, attempt.Amount.Currency)
+	}
+	if attempt == nil {
+		attempt = &RefundAttempt{
+			IdempotencyKey: newRefundKey(orderID),
+			Amount:         amount,
+			Reason:         request.Reason,
+			CreatedAt:      time.Now().UTC(),
+		}
+		_, err := o.store.UpdateOrder(orderID, func(order *OrderRecord) error {
+			order.PendingRefund = attempt
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Refunding the remaining amount without giving it refunds the whole capture
+	var refundAmount *pricing.Money
+	if amount.Amount != remaining || len(order.Refunds) > 0 {
+		refundAmount = &amount
+	}
+
+	fmt.Printf("[INFO] Refunding %s %s of order %s (%s, key %s)\n", amount, amount.Currency, orderID, attempt.Reason, attempt.IdempotencyKey)
+	refund, err := provider.Refund(order.CaptureID, refundAmount, attempt.Reason, attempt.IdempotencyKey)
+	if err != nil {
+		fmt.Printf("[ERROR] Could not refund order %s on %s: %s\n", orderID, provider.Name(), err)
+		// The provider answers a refused refund the same way when its key is sent again
+		if !payment.IsUnavailable(err) {
+			o.clearPendingRefund(orderID, attempt.IdempotencyKey)
+		}
+		return nil, err
+	}
+	// Providers may not return the amount of a full refund
+	if refund.Amount.Amount == 0 {
+		refund.Amount = amount
+	}
+
+	return o.recordRefund(orderID, RefundRecord{
+		ID:             refund.ID,
+		Status:         refund.Status,
+		Amount:         refund.Amount,
+		Reason:         attempt.Reason,
+		IdempotencyKey: attempt.IdempotencyKey,
+		CreatedAt:      time.Now().UTC(),
+	}, decommission)
+}
+
+// newRefundKey returns a random idempotency key for a refund of the order
+func newRefundKey(orderID string) string {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		// Still unique, refunds of an order are made one at a time
+		return fmt.Sprintf("refund-%s-%d", orderID, time.Now().UnixNano())
+	}
+	return "refund-" + orderID + "-" + hex.EncodeToString(random)
+}
+
+// clearPendingRefund forgets a refund attempt refused by the provider,
+// the next refund of the order gets a new key
+func (o *OrderOrchestrator) clearPendingRefund(orderID string, idempotencyKey string) {
+	_, err := o.store.UpdateOrder(orderID, func(order *OrderRecord) error {
+		if order.PendingRefund != nil && order.PendingRefund.IdempotencyKey == idempotencyKey {
+			order.PendingRefund = nil
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("[ERROR] Could not clear refund attempt of order %s: %s\n", orderID, err)
+	}
+}
+
+// ===================================================================
+// Saves a refund on its order and updates the order status. Refunds
+// already recorded are ignored, e.g. when notified by a webhook after
+// being made through the API. The pending attempt the refund results
+// from is cleared. Once the order is entirely refunded, a
+// message asking web-order to decommission its cluster is added to
+// the outbox with the order change.
+//
+// Parameters:
+//
+//	(string) orderID : Checkout ID of the order
+//	(RefundRecord) refund : Refund made on the payment provider
+//	(bool) decommission : Whether the cluster is decommissioned once the order is entirely refunded
+//
+// Used on:
+//
+//	(*OrderOrchestrator) o : Object that permits asynchronous management of the order
+//
+// Return:
+//
+//	(*OrderRecord) : Order with the refund
+//	(error) : Store error or nil if no error occurs
+//
+// ===================================================================
+func (o *OrderOrchestrator) recordRefund(orderID string, refund RefundRecord, decommission bool) (*OrderRecord, error) {
+	order, err := o.store.UpdateOrderWithOutbox(orderID, func(order *OrderRecord) ([]OutboxMessage, error) {
+		// Refunds notified by a webhook carry no key, they are matched by amount
+		if pending := order.PendingRefund; pending != nil &&
+			(pending.IdempotencyKey == refund.IdempotencyKey || (refund.IdempotencyKey == "" && pending.Amount == refund.Amount)) {
+			order.PendingRefund = nil
+		}
+		for _, recorded := range order.Refunds {
+			if recorded.ID == refund.ID {
+				return nil, nil
+			}
+		}
+		order.Refunds = append(order.Refunds, refund)
+
+		to := StatusPartiallyRefunded
+		if order.RefundedAmount().Amount >= order.Quote.Gross.Amount {
+			to = StatusRefunded
+		}
+		reason := fmt.Sprintf("refunded %s %s", refund.Amount, refund.Amount.Currency)
+		if refund.Reason != "" {
+			reason += ": " + refund.Reason
+		}
+		if err := order.Transition(to, reason); err != nil {
+			return nil, err
+		}
+
+		if to == StatusRefunded && decommission {
+			return []OutboxMessage{newOutboxMessage(MessageDecommissionOrder, order)}, nil
+		}
+		return nil, nil
+	})
+	if err != nil {
+		fmt.Printf("[ERROR] Could not record refund %s of order %s: %s\n", refund.ID, orderID, err)
+		return nil, err
+	}
+	fmt.Printf("[INFO] Order %s is now %s\n", order.ID, order.Status)
+	o.wakeOutbox()
+
+	return order, nil
+}
+
+// refundResource is the refund sent with PAYMENT.CAPTURE.REFUNDED events
+type refundResource struct {
+	ID          string            `json:"id"`
+	Status      string            `json:"status"`
+	Amount      pricing.Money     `json:"amount"`
+	NoteToPayer string            `json:"note_to_payer"`
+	Links       []PaypalOrderLink `json:"links"`
+}
+
+// ===================================================================
+// Records a refund notified by Paypal, e.g. made from the Paypal
+// dashboard. The order is found through the capture the refund
+// belongs to.
+//
+// Parameters:
+//
+//	(json.RawMessage) resource : Refund sent with the event
+//
+// Used on:
+//
+//	(*OrderOrchestrator) o : Object that permits asynchronous management of the order
+//
+// Return:
+//
+//	(error) : Error worth a new delivery of the event, or nil
+//
+// ===================================================================
+func (o *OrderOrchestrator) handleRefundEvent(resource json.RawMessage) error {
+	var refund refundResource
+	if err := json.Unmarshal(resource, &refund); err != nil {
+		return fmt.Errorf("invalid refund resource: %w", err)
+	}
+
+	var captureID string
+	for _, link := range refund.Links {
+		if link.Rel == "up" {
+			// e.g. https://api-m.paypal.com/v2/payments/captures/xyYxyZ
+			captureID = path.Base(link.Href)
+		}
+	}
+
+	orders, err := o.store.ListOrdersByStatus(StatusCaptured, StatusProvisioningRequested, StatusProvisioned, StatusPartiallyRefunded)
+	if err != nil {
+		return err
+	}
+	for _, order := range orders {
+		if captureID == "" || order.CaptureID != captureID {
+			continue
+		}
+		_, err := o.recordRefund(order.ID, RefundRecord{
+			ID:        refund.ID,
+			Status:    refund.Status,
+			Amount:    refund.Amount,
+			Reason:    refund.NoteToPayer,
+			CreatedAt: time.Now().UTC(),
+		}, true)
+		return err
+	}
+
+	fmt.Printf("[INFO] Ignoring refund %s of unknown capture %s\n", refund.ID, captureID)
+	return nil
+}
@@ -0,0 +1,89 @@
+package paypal
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/OneKonsole/web-service-billing/payment"
+	"github.com/OneKonsole/web-service-billing/pricing"
+)
+
+// newRefundTestOrchestrator returns an orchestrator holding an order captured through the provider
+func newRefundTestOrchestrator(t *testing.T, provider *fakeProvider) (*OrderOrchestrator, *BoltOrderStore) {
+	t.Helper()
+	store, _ := openTestStore(t)
+	orchestrator := NewOrderOchestrator(store, nil, time.Minute)
+	orchestrator.RegisterProvider(provider)
+
+	order := NewOrderRecord("ORDER-1", PaypalOrderInfos{Provider: "fake", Quote: pricing.Quote{Gross: testAmount}})
+	for _, status := range []OrderStatus{StatusApproved, StatusCaptured} {
+		if err := order.Transition(status, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	order.CaptureID = "CAPTURE-1"
+	if err := store.SaveOrder(order); err != nil {
+		t.Fatal(err)
+	}
+	return orchestrator, store
+}
+
+func TestRefundRetriedWithSameKey(t *testing.T) {
+	// The refund is made but its response never comes back
+	timeout := &url.Error{Op: "Post", URL: "/refund", Err: errors.New("timeout")}
+	provider := &fakeProvider{refundError: timeout}
+	orchestrator, store := newRefundTestOrchestrator(t, provider)
+
+	if _, err := orchestrator.refund("ORDER-1", RefundRequest{Reason: "cluster unavailable"}, false); !payment.IsUnavailable(err) {
+		t.Fatalf("refund() error = %v, want the timeout", err)
+	}
+	order, err := store.GetOrder("ORDER-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.PendingRefund == nil || order.PendingRefund.IdempotencyKey == "" || len(order.Refunds) != 0 {
+		t.Fatalf("order has pending refund %+v and refunds %+v, want a pending attempt only", order.PendingRefund, order.Refunds)
+	}
+	key := order.PendingRefund.IdempotencyKey
+
+	order, err = orchestrator.refund("ORDER-1", RefundRequest{Reason: "cluster unavailable"}, false)
+	if err != nil {
+		t.Fatalf("retried refund() error = %v", err)
+	}
+	if len(provider.refunds) != 1 {
+		t.Errorf("provider made %d refunds, want 1", len(provider.refunds))
+	}
+	if order.Status != StatusRefunded || len(order.Refunds) != 1 || order.Refunds[0].IdempotencyKey != key {
+		t.Errorf("order is %s with refunds %+v, want %s with one refund sent with key %s", order.Status, order.Refunds, StatusRefunded, key)
+	}
+	if order.PendingRefund != nil {
+		t.Errorf("PendingRefund = %+v, want nil once recorded", order.PendingRefund)
+	}
+}
+
+func TestRefundPendingAttemptFirst(t *testing.T) {
+	timeout := &url.Error{Op: "Post", URL: "/refund", Err: errors.New("timeout")}
+	provider := &fakeProvider{refundError: timeout}
+	orchestrator, _ := newRefundTestOrchestrator(t, provider)
+
+	partial := pricing.NewDecimalFromInt(5)
+	if _, err := orchestrator.refund("ORDER-1", RefundRequest{Amount: &partial}, false); err == nil {
+		t.Fatal("refund() error = nil, want the timeout")
+	}
+
+	// Another amount could refund the customer on top of the lost refund
+	other := pricing.NewDecimalFromInt(2)
+	if _, err := orchestrator.refund("ORDER-1", RefundRequest{Amount: &other}, false); !errors.Is(err, ErrRefundPending) {
+		t.Errorf("refund() of another amount error = %v, want %v", err, ErrRefundPending)
+	}
+	if len(provider.refunds) != 1 {
+		t.Errorf("provider made %d refunds, want 1", len(provider.refunds))
+	}
+
+	order, err := orchestrator.refund("ORDER-1", RefundRequest{Amount: &partial}, false)
+	if err != nil || order.Status != StatusPartiallyRefunded || order.RefundedAmount() != pricing.NewMoney(partial, "EUR") {
+		t.Errorf("retried refund() = %+v, %v, want %s of 5.00 EUR", order, err, StatusPartiallyRefunded)
+	}
+}
@@ -1,82 +1,18 @@
 package paypal
 
 import (
-	"bytes"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"strconv"
-	"strings"
 
 	helpers "github.com/OneKonsole/web-service-billing/helpers"
+	"github.com/OneKonsole/web-service-billing/payment"
+	"github.com/OneKonsole/web-service-billing/pricing"
 )
 
 // ===================================================================
-// Returns owner paypal access token
-//
-// Parameters:
-//
-//	(string) clientID : Paypal Client ID (owner)
-//	(string) clientSecret : Paypal Client Secret (owner)
-//
-// Return
-//
-//	(string) : The access token retrieved or empty if an error occurs
-//	(error) : Error during the process or nil if no error occurs
-//
-// Example:
-//
-//	accessToken, err := GetAccessToken("xxxx", "yyyy")
-//
-// ===================================================================
-func GetAccessToken(clientID string, clientSecret string) (string, error) {
-	url := "https://api-m.sandbox.paypal.com/v1/oauth2/token"
-
-	client := &http.Client{}
-
-	// Paypal necessary items to add in request payload
-	payload := strings.NewReader("grant_type=client_credentials&ignoreCache=true&return_authn_schemes=true&return_client_metadata=true&return_unconsented_scopes=true")
-
-	req, err := http.NewRequest("POST", url, payload)
-	if err != nil {
-		fmt.Printf("[ERROR] Could not initialize request to get access token : %s\n", err)
-		return "", err
-	}
-
-	// Add HTTP headers to the request
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Add("Authorization", "Basic "+helpers.AggregateClientInformation(clientID, clientSecret))
-
-	res, err := client.Do(req)
-	if err != nil {
-		fmt.Printf("[ERROR] Could not make request to get access token : %s\n", err)
-		return "", err
-	}
-	defer res.Body.Close()
-
-	// Parse response json body
-	decoder := json.NewDecoder(res.Body)
-	parsedBody := make(map[string]json.RawMessage)
-
-	if err := decoder.Decode(&parsedBody); err != nil {
-		fmt.Printf("[ERROR] Invalid payload: %s\n", err)
-		return "", err
-	}
-
-	// Retrieve the access token from the parsed response body
-	accessToken := string(parsedBody["access_token"])
-
-	// When parsing json.RawMessage into string, double quotes are put
-	// at the beginning and at the end of the string.
-	accessToken = accessToken[1 : len(accessToken)-1]
-
-	return accessToken, nil
-}
-
-// ===================================================================
-// Create a Paypal order based on the order details requested.
+// Create a checkout on the payment provider chosen for the order.
 // Asynchronously wait for paiement approval then capture it.
 // Calls web-order service in order to produce the order.
 //
@@ -84,93 +20,92 @@ func GetAccessToken(clientID string, clientSecret string) (string, error) {
 //
 //	(http.ResponseWriter) w : Used to generate HTTP responses (retrieved by the router)
 //	(PaypalOrderInfos) orderInfos : Information about the order to create
-//	(string) clientID : Paypal Client ID (owner). Used to retrieve the access token.
-//	(string) clientSecret : Paypal Client Secret (owner). Used to retrieve the access token.
-//	(string) webOrderUrl : Used to contact web-order service.
+//	(string) idempotencyKey : Idempotency-Key of the request, forwarded to the provider, may be empty
 //
 // Used on:
 //
 //	(*OrderOrchestrator) o : Object that permits asynchronous management of the order
 //
+// Return:
+//
+//	(error) : Error if the checkout could not be created, ErrCheckoutReplayed if it
+//		was created by a previous request, or nil if a new order is stored
+//
 // Example:
 //
-//	orderOrchestrator.CreateOrder(w, PaypalOrderInfos{...}, "xxxx", "xxxx", "http://localhost:8010/order")
+//	err := orderOrchestrator.CreateOrder(w, PaypalOrderInfos{...}, "")
 //
 // ===================================================================
 func (o *OrderOrchestrator) CreateOrder(
 	w http.ResponseWriter,
 	orderInfos PaypalOrderInfos,
-	clientID string,
-	clientSecret string,
-	webOrderURL string,
-) {
-	accessToken, err := GetAccessToken(clientID, clientSecret)
-
-	fmt.Print("[INFO] Access token retrieved\n")
+	idempotencyKey string,
+) error {
+	if orderInfos.Provider == "" {
+		orderInfos.Provider = ProviderName
+	}
+	provider, err := o.provider(orderInfos.Provider)
 	if err != nil {
-		fmt.Printf("[ERROR] Invalid client information for authentication : %s\n", err)
+		helpers.RespondWithError(w, apiError("Could not select payment provider", err))
+		return err
 	}
 
-	createdOrder, err := createPaypalOrder("https://api-m.sandbox.paypal.com/v2/checkout/orders", accessToken, orderInfos)
+	checkout, err := provider.CreateCheckout(payment.CheckoutRequest{
+		Reference:      orderInfos.Order.UserID,
+		Description:    "OneKonsole cluster " + orderInfos.Order.ClusterName,
+		Quote:          orderInfos.Quote,
+		Amount:         orderInfos.MaxAmountValue,
+		IdempotencyKey: idempotencyKey,
+	})
 	if err != nil {
-		panic(err)
+		fmt.Printf("[ERROR] Could not create %s checkout: %s\n", provider.Name(), err)
+		helpers.RespondWithError(w, apiError("Could not create "+provider.Name()+" checkout", err))
+		return err
+	}
+	fmt.Printf("[INFO] %s checkout %s created ! \n", provider.Name(), checkout.ID)
+
+	// A retried creation returns the checkout created by the first attempt
+	if stored, err := o.store.GetOrder(checkout.ID); err == nil {
+		if stored.Infos.Order.UserID != orderInfos.Order.UserID {
+			fmt.Printf("[ERROR] Checkout %s of user %s returned to user %s\n", checkout.ID, stored.Infos.Order.UserID, orderInfos.Order.UserID)
+			helpers.RespondWithError(w, helpers.ForbiddenError(ErrCheckoutOwner.Error()))
+			return ErrCheckoutOwner
+		}
+		fmt.Printf("[INFO] Checkout %s already stored, not processed again\n", checkout.ID)
+		helpers.RespondWithJSON(w, http.StatusOK, checkout)
+		return ErrCheckoutReplayed
 	}
-	fmt.Printf("[INFO] Paypal order created ! \n")
-	approvalChannel := make(chan bool)
-
-	// Ensures synchronisation on approvalChans var (only 1 function can write at a time)
-	o.mutex.Lock()
-	o.approvalChans[createdOrder.OrderID] = approvalChannel
-	o.mutex.Unlock()
 
-	// Needed to capture the order later
-	var captureURL string
+	// The order model only knows Paypal, it holds the checkout ID of any provider
+	orderInfos.Order.PaypalID = checkout.ID
 
-	for _, link := range createdOrder.Links {
-		if link.Rel == "capture" {
-			captureURL = link.Href
-		}
+	// Persist the order before answering, so it survives a restart
+	// while the client is approving it
+	order := NewOrderRecord(checkout.ID, orderInfos)
+	if err := o.store.SaveOrder(order); err != nil {
+		fmt.Printf("[ERROR] Could not store order %s: %s\n", order.ID, err)
+		helpers.RespondWithError(w, helpers.InternalError("Could not store order", err))
+		return err
 	}
 
+	approvalChannel := o.registerApproval(order.ID)
+	ordersCreated.Add(1)
+
 	// Create HTTP response for the created order
 	// before waiting for client's approval
-	helpers.RespondWithJSON(w, http.StatusOK, map[string]string{
-		"order_id": createdOrder.OrderID,
-		"status":   createdOrder.Status,
-	})
-
-	orderInfos.Order.PaypalID = createdOrder.OrderID
+	helpers.RespondWithJSON(w, http.StatusOK, checkout)
 
 	// Goroutine that waits for client approval
-	go func(clientCaptureURL string) {
-		approved := <-approvalChannel
-		if approved {
-			fmt.Printf("[INFO] Received order approval, capturing on :  %s\n", captureURL)
-			// This code has been commented since Frontend Paypal SDK manages it
-			// err := captureOrder(accessToken, clientCaptureURL)
-			if err != nil {
-				fmt.Printf("[ERROR] Could not capture order: %s\n", err)
-			}
-			fmt.Printf("\n[INFO] Order %s creation requested by %s\n   ---> Cluster name : %s\n   ---> Control plane : %s\n   ---> Monitoring : %s - %d Go\n   ---> Images storage : %d\n   ---> Alerting : %s\n\n",
-				orderInfos.Order.PaypalID,
-				orderInfos.Order.UserID,
-				orderInfos.Order.ClusterName,
-				strconv.FormatBool(orderInfos.Order.HasControlPlane),
-				strconv.FormatBool(orderInfos.Order.HasControlPlane),
-				orderInfos.Order.MonitoringStorage,
-				orderInfos.Order.ImageStorage,
-				strconv.FormatBool(orderInfos.Order.HasAlerting),
-			)
-			err = helpers.LaunchOrder(webOrderURL, &orderInfos.Order)
-			if err != nil {
-				fmt.Printf("[ERROR] %s\n", err)
-			}
-		}
-	}(captureURL)
+	go o.waitForApproval(order, approvalChannel)
+
+	return nil
 }
 
 // ===================================================================
 // Signal the order creation that the client has approved the order.
+// The order is first checked on its provider: it must be approved (or
+// already authorized, being paid or captured) for the amount calculated
+// at its creation.
 //
 // Parameters:
 //
@@ -184,7 +119,7 @@ func (o *OrderOrchestrator) CreateOrder(
 //
 // Example:
 //
-//	orderOrchestrator.ApproveOrder("xyYxyZ",w, r)
+//	orderOrchestrator.ApproveOrder("xyYxyZ", w, r)
 //
 // ===================================================================
 func (orderOrchestrator *OrderOrchestrator) ApproveOrder(
@@ -192,166 +127,176 @@ func (orderOrchestrator *OrderOrchestrator) ApproveOrder(
 	w http.ResponseWriter,
 	r *http.Request,
 ) {
-	// Lock orderOrchestrator operations for other go routines (integrity)
-
-	// TODO : Validate order status
-	if approvalChannel, ok := orderOrchestrator.approvalChans[orderID]; ok {
-		fmt.Printf("[INFO] Launching order %s approval via channel.\n", orderID)
-		// Sends approval signal to channel for this order
-		orderOrchestrator.mutex.Lock()
-		approvalChannel <- true
-		fmt.Printf("[INFO] Deleting order %s approval channel.\n", orderID)
-		// Remove this channel since it has been processed
-		delete(orderOrchestrator.approvalChans, orderID)
-		orderOrchestrator.mutex.Unlock()
+	if err := orderOrchestrator.approve(orderID); err != nil {
+		helpers.RespondWithError(w, apiError("Could not verify order on its payment provider", err))
+		return
 	}
-	// Unlock orderOrchestrator operations for other go routines
 
 	// HTTP Response
 	helpers.RespondWithJSON(w, http.StatusOK, PaypalOrderResponse{
-		Status:  "APPROVED",
+		Status:  string(StatusApproved),
 		OrderID: orderID,
 	})
 }
 
 // ===================================================================
-// Capture the paiement once approved by the client
+// Verifies an order on its payment provider then signals its approval to the
+// goroutine waiting for it. Used by ApproveOrder and the webhook.
 //
 // Parameters:
 //
-//	(string) accessToken : Paypal merchnat access token
-//	(string) captureURL : Paypal API URL used to capture the paiement
+//	(string) orderID : ID of the created Paypal Order
 //
-// Return:
+// Used on:
 //
-//	(error) : Error during process or nil if no error occurs
+//	(*OrderOrchestrator) o : Object that permits asynchronous management of the order
 //
-// Example:
+// Return:
 //
-//	_ := captureOrder("xyYxyZxxxxYZxZ", "https://api.sandbox.paypal.com/v2/checkout/orders/xyYxyZxxxxYZxZ/capture")
+//	(error) : ErrOrderNotFound, ErrOrderAlreadyHandled, ErrPaymentNotVerified
+//		or a provider request error
 //
 // ===================================================================
-func CaptureOrder(accessToken string, captureURL string) error {
-	fmt.Printf("[INFO] Setting up order capture on %s\n", captureURL)
-	client := &http.Client{}
-
-	req, err := http.NewRequest("POST", captureURL, nil)
+func (orderOrchestrator *OrderOrchestrator) approve(orderID string) error {
+	order, err := orderOrchestrator.store.GetOrder(orderID)
+	if errors.Is(err, ErrOrderNotFound) {
+		fmt.Printf("[ERROR] Approval received for unknown order %s\n", orderID)
+		return err
+	}
 	if err != nil {
+		fmt.Printf("[ERROR] Could not read order %s: %s\n", orderID, err)
 		return err
 	}
+	fmt.Printf("[INFO] Approving order %s for user %s...\n", orderID, order.Infos.Order.UserID)
+	if !order.CanTransition(StatusApproved) {
+		fmt.Printf("[ERROR] Approval received for order %s already %s\n", orderID, order.Status)
+		return fmt.Errorf("%w: order is already %s", ErrOrderAlreadyHandled, order.Status)
+	}
 
-	// Add HTTP headers to the request
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Authorization", "Bearer "+accessToken)
-
-	// Actually make the request
-	res, err := client.Do(req)
+	provider, err := orderOrchestrator.provider(order.Infos.Provider)
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("[INFO] Capturing order....\n")
-
-	body, _ := io.ReadAll(res.Body)
-	fmt.Printf("[DEBUG] Paypal capture status code :%d\n", res.StatusCode)
-	fmt.Printf("[DEBUG] Paypal capture response : \n%s\n", string(body))
-
-	// Validate response status code
-	if res.StatusCode != http.StatusCreated {
-		return errors.New("external error capturing order")
+	// Never trust the frontend: check the payment on the provider
+	status, err := provider.GetStatus(orderID)
+	if err != nil {
+		fmt.Printf("[ERROR] Could not get %s checkout %s: %s\n", provider.Name(), orderID, err)
+		return err
+	}
+	if err := verifyPayment(order, status); err != nil {
+		fmt.Printf("[ERROR] Order %s approval refused: %s\n", orderID, err)
+		return fmt.Errorf("%w: %s", ErrPaymentNotVerified, err)
 	}
 
-	fmt.Printf("[INFO] Order captured !\n")
+	// Lock orderOrchestrator operations for other go routines (integrity)
+	// Removing the channel ensures a single approval is processed per order
+	orderOrchestrator.mutex.Lock()
+	approvalChannel, ok := orderOrchestrator.approvalChans[orderID]
+	delete(orderOrchestrator.approvalChans, orderID)
+	orderOrchestrator.mutex.Unlock()
+
+	if !ok {
+		fmt.Printf("[ERROR] Order %s is already being approved or has expired\n", orderID)
+		return ErrOrderAlreadyHandled
+	}
 
-	defer res.Body.Close()
+	fmt.Printf("[INFO] Launching order %s approval via channel.\n", orderID)
+	// Sends approval signal to channel for this order
+	approvalChannel <- status
 
 	return nil
 }
 
 // ===================================================================
-// Paypal API designed request to create an order
+// Checks that a checkout has been paid as calculated by the service
 //
 // Parameters:
 //
-//		(string) url : Paypal API URL used to create the order
-//		(string) accessToken : Paypal merchant access token
-//	 (PaypalOrderInfos) : Details about the order requested
+//	(*OrderRecord) order : Order stored at its creation
+//	(payment.Status) status : Checkout as returned by its provider
 //
 // Return:
 //
-//	(PaypalOrderResponse) : Struct used to create a consistant HTTP response
-//	(error) : Error during process or nil if no error occurs
-//
-// Example:
-//
-//	orderResponse, err := captureOrder(
-//		"https://api.sandbox.paypal.com/v2/checkout/orders/xyYxyZxxxxYZxZ/capture",
-//		"xyYxyZxxxxYZxZ",
-//		PaypalOrderInfos{...})
+//	(error) : Reason why the order can not be approved or nil if it is valid
 //
 // ===================================================================
-func createPaypalOrder(
-	url string,
-	accessToken string,
-	orderInfos PaypalOrderInfos,
-) (PaypalOrderResponse, error) {
-	currencyCode := orderInfos.CurrencyCode
-	amountValue := orderInfos.MaxAmountValue
-
-	bodyMap := map[string]interface{}{
-		"purchase_units": []map[string]interface{}{
-			{
-				"amount": map[string]interface{}{
-					"currency_code": currencyCode,
-					"value":         amountValue,
-				},
-			},
-		},
-		"intent": "CAPTURE",
+func verifyPayment(order *OrderRecord, status payment.Status) error {
+	switch status.State {
+	case payment.StateApproved, payment.StateAuthorized, payment.StateProcessing, payment.StateCaptured:
+	default:
+		return fmt.Errorf("order has not been paid (status %s)", status.ProviderStatus)
 	}
 
-	bodyJson, err := json.Marshal(bodyMap)
-	if err != nil {
-		fmt.Printf("[ERROR] Invalid payload: %s\n", err)
-		return PaypalOrderResponse{}, err
+	paid := status.Amount
+	expected := order.Quote.Gross
+	if paid.Currency != expected.Currency || paid.Amount != expected.Amount {
+		return fmt.Errorf("paid amount %s %s does not match order amount %s %s",
+			paid, paid.Currency, expected, expected.Currency)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(bodyJson))
+	return nil
+}
 
-	if err != nil {
-		fmt.Printf("[ERROR] Unable to initiate http request: %s\n", err)
-		return PaypalOrderResponse{}, err
+// capture returns the payment capture, if the order has been captured
+func (details PaypalOrderDetails) capture() *PaypalPayment {
+	for _, unit := range details.PurchaseUnits {
+		if len(unit.Payments.Captures) > 0 {
+			return &unit.Payments.Captures[0]
+		}
 	}
+	return nil
+}
 
-	// Add request headers
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Authorization", "Bearer "+accessToken)
-
-	client := &http.Client{}
-
-	// Actually make the request
-	res, err := client.Do(req)
-	if err != nil {
-		fmt.Printf("[ERROR] Unable to initiate http client, %s\n", err)
-		return PaypalOrderResponse{}, err
+// authorization returns the payment authorization, if the order has been authorized
+func (details PaypalOrderDetails) authorization() *PaypalPayment {
+	for _, unit := range details.PurchaseUnits {
+		if len(unit.Payments.Authorizations) > 0 {
+			return &unit.Payments.Authorizations[0]
+		}
 	}
+	return nil
+}
 
-	defer res.Body.Close()
-
-	// Create an HTTP response for this order creation
-	var orderRes PaypalOrderResponse
-
-	// If the order was created, create the response
-	if res.StatusCode == http.StatusCreated {
-		decoder := json.NewDecoder(res.Body)
+// captureID returns the ID of the payment capture, if the order has been captured
+func (details PaypalOrderDetails) captureID() string {
+	if capture := details.capture(); capture != nil {
+		return capture.ID
+	}
+	return ""
+}
 
-		err = decoder.Decode(&orderRes)
-		if err != nil {
-			return PaypalOrderResponse{}, err
+// ===================================================================
+// Converts the lines of a quote into Paypal purchase unit items.
+// Paypal requires the item total to be exactly the sum of
+// unit_amount * quantity, so lines whose unit price can not be
+// expressed in the currency minor units are sent as a single item.
+//
+// Parameters:
+//
+//	(pricing.Quote) quote : Itemized price of the order
+//
+// Return:
+//
+//	([]PaypalItem) : Items to send in the purchase unit
+//
+// ===================================================================
+func paypalItems(quote pricing.Quote) []PaypalItem {
+	items := make([]PaypalItem, 0, len(quote.Lines))
+
+	for _, line := range quote.Lines {
+		item := PaypalItem{
+			Name:       line.Description,
+			Quantity:   strconv.Itoa(line.Quantity),
+			UnitAmount: line.UnitPrice.Round(),
+			Category:   "DIGITAL_GOODS",
+		}
+		if item.UnitAmount.Mul(line.Quantity) != line.Amount {
+			item.Quantity = "1"
+			item.UnitAmount = line.Amount
 		}
-	} else {
-		return PaypalOrderResponse{}, errors.New("err: order could not be created")
+		items = append(items, item)
 	}
 
-	return orderRes, nil
+	return items
 }
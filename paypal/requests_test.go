@@ -0,0 +1,153 @@
+package paypal
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	oko "github.com/OneKonsole/order-model"
+	"github.com/OneKonsole/web-service-billing/payment"
+	"github.com/OneKonsole/web-service-billing/pricing"
+)
+
+func TestVerifyPayment(t *testing.T) {
+	order := NewOrderRecord("PAY-1", PaypalOrderInfos{Quote: pricing.Quote{Gross: testAmount}})
+
+	tests := []struct {
+		name    string
+		status  payment.Status
+		wantErr bool
+	}{
+		{name: "approved", status: payment.Status{State: payment.StateApproved, Amount: testAmount}},
+		{name: "authorized", status: payment.Status{State: payment.StateAuthorized, Amount: testAmount}},
+		{name: "processing", status: payment.Status{State: payment.StateProcessing, Amount: testAmount}},
+		{name: "captured", status: payment.Status{State: payment.StateCaptured, Amount: testAmount}},
+		{name: "not paid", status: payment.Status{State: payment.StatePending, ProviderStatus: "CREATED", Amount: testAmount}, wantErr: true},
+		{name: "failed", status: payment.Status{State: payment.StateFailed, ProviderStatus: "VOIDED", Amount: testAmount}, wantErr: true},
+		{name: "one cent less", status: payment.Status{State: payment.StateApproved, Amount: pricing.NewMoneyFromMinor(1199, "EUR")}, wantErr: true},
+		{name: "one cent more", status: payment.Status{State: payment.StateApproved, Amount: pricing.NewMoneyFromMinor(1201, "EUR")}, wantErr: true},
+		{name: "other currency", status: payment.Status{State: payment.StateApproved, Amount: pricing.NewMoneyFromMinor(1200, "USD")}, wantErr: true},
+		{name: "no amount", status: payment.Status{State: payment.StateApproved}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := verifyPayment(order, test.status); (err != nil) != test.wantErr {
+				t.Errorf("verifyPayment() error = %v, want error: %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestApproveRefusesAmountMismatch(t *testing.T) {
+	// The client paid one cent less than the order
+	paid := payment.Status{State: payment.StateApproved, ProviderStatus: "APPROVED", Amount: pricing.NewMoneyFromMinor(1199, "EUR")}
+	orchestrator, store := newTestOrchestrator(t, paid)
+	createTestOrder(t, orchestrator, store, "PAY-1")
+
+	if err := orchestrator.approve("PAY-1"); !errors.Is(err, ErrPaymentNotVerified) {
+		t.Fatalf("approve() error = %v, want %v", err, ErrPaymentNotVerified)
+	}
+
+	// The order keeps waiting for a valid approval
+	order, err := store.GetOrder("PAY-1")
+	if err != nil || order.Status != StatusCreated {
+		t.Errorf("order = %+v, %v, want it still %s", order, err, StatusCreated)
+	}
+	orchestrator.mutex.Lock()
+	_, pending := orchestrator.approvalChans["PAY-1"]
+	orchestrator.mutex.Unlock()
+	if !pending {
+		t.Error("approval channel removed by a refused approval")
+	}
+}
+
+// itemTotal returns the total Paypal computes from the items: unit_amount * quantity
+func itemTotal(t *testing.T, items []PaypalItem, currency string) pricing.Money {
+	t.Helper()
+	total := pricing.NewMoney(0, currency)
+	for _, item := range items {
+		quantity, err := strconv.Atoi(item.Quantity)
+		if err != nil {
+			t.Fatalf("item %s quantity = %q, want a number", item.Name, item.Quantity)
+		}
+		if item.UnitAmount.Round() != item.UnitAmount {
+			t.Errorf("item %s unit amount = %s, want at most the minor units of %s", item.Name, item.UnitAmount.Amount, currency)
+		}
+		total = total.Add(item.UnitAmount.Mul(quantity))
+	}
+	return total
+}
+
+// mustParseDecimal parses a decimal of a test
+func mustParseDecimal(t *testing.T, value string) pricing.Decimal {
+	t.Helper()
+	decimal, err := pricing.ParseDecimal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decimal
+}
+
+func TestPaypalItemsFractionalUnitPrices(t *testing.T) {
+	// Storages priced below the cent: 3 GB at 0.005 is 0.015, charged 0.02
+	// while the rounded unit price would give 3 * 0.01
+	catalog := pricing.DefaultCatalog()
+	catalog.ImageStorage = mustParseDecimal(t, "0.005")
+	catalog.MonitoringStorage = mustParseDecimal(t, "0.013")
+	quote, err := catalog.CalculatePrice(&oko.Order{ImageStorage: 3, HasMonitoring: true, MonitoringStorage: 7}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items := paypalItems(quote)
+	if len(items) != len(quote.Lines) {
+		t.Fatalf("paypalItems() = %d items, want one per line (%d)", len(items), len(quote.Lines))
+	}
+	for i, line := range quote.Lines {
+		item := items[i]
+		if line.UnitPrice.Round() == line.UnitPrice {
+			if item.Quantity != strconv.Itoa(line.Quantity) || item.UnitAmount != line.UnitPrice {
+				t.Errorf("item %s = %s x %s, want the line kept as %d x %s", item.Name, item.Quantity, item.UnitAmount, line.Quantity, line.UnitPrice)
+			}
+			continue
+		}
+		if item.Quantity != "1" || item.UnitAmount != line.Amount {
+			t.Errorf("item %s = %s x %s, want a single item of %s", item.Name, item.Quantity, item.UnitAmount, line.Amount)
+		}
+	}
+	if total := itemTotal(t, items, quote.Net.Currency); total != quote.Net {
+		t.Errorf("item total = %s, want the net amount %s", total, quote.Net)
+	}
+
+	// With a discount, Paypal checks the items against the subtotal the discount is taken from
+	discount := pricing.NewMoneyFromMinor(500, quote.Subtotal.Currency)
+	quote.Discount = &pricing.QuoteLine{Code: "discount", Quantity: 1, UnitPrice: discount, Amount: discount}
+	quote.Net = pricing.NewMoney(quote.Subtotal.Amount.Sub(discount.Amount), quote.Subtotal.Currency)
+	if total := itemTotal(t, paypalItems(quote), quote.Net.Currency); total != quote.Subtotal || total.Amount.Sub(discount.Amount) != quote.Net.Amount {
+		t.Errorf("item total = %s, want the subtotal %s, the net amount %s plus the discount", total, quote.Subtotal, quote.Net)
+	}
+}
+
+func TestPaypalItemsWithoutMinorUnits(t *testing.T) {
+	// Yens have no minor unit: 3 items at 0.5 are charged 2
+	unitPrice := pricing.NewMoney(mustParseDecimal(t, "0.5"), "JPY")
+	quote := pricing.Quote{Subtotal: pricing.NewMoney(0, "JPY")}
+	for _, line := range []pricing.QuoteLine{
+		{Code: "basic", Description: "Kubernetes cluster", Quantity: 1, UnitPrice: pricing.NewMoneyFromMinor(2500, "JPY")},
+		{Code: "img_storage", Description: "Image storage", Quantity: 3, UnitPrice: unitPrice},
+	} {
+		line.Amount = line.UnitPrice.Mul(line.Quantity).Round()
+		quote.Lines = append(quote.Lines, line)
+		quote.Subtotal = quote.Subtotal.Add(line.Amount)
+	}
+	quote.Net = quote.Subtotal
+
+	items := paypalItems(quote)
+	if items[1].Quantity != "1" || items[1].UnitAmount != quote.Lines[1].Amount {
+		t.Errorf("item %s = %s x %s, want a single item of %s", items[1].Name, items[1].Quantity, items[1].UnitAmount, quote.Lines[1].Amount)
+	}
+	if total := itemTotal(t, items, "JPY"); total != quote.Net {
+		t.Errorf("item total = %s, want the net amount %s", total, quote.Net)
+	}
+}
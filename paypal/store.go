@@ -0,0 +1,572 @@
+package paypal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	ErrOrderNotFound = errors.New("order not found")
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+var (
+	ordersBucket        = []byte("orders")
+	webhookEventsBucket = []byte("webhook_events")
+	idempotencyBucket   = []byte("idempotency_keys")
+	outboxBucket        = []byte("outbox")
+	// Redemptions of the coupons, released by UpdateOrderWithOutbox when an order ends unpaid
+	couponRedemptionsBucket = []byte("coupon_redemptions")
+	// Indexes of ListOrders, keyed by "created_at|id" and "user_id|created_at|id"
+	ordersByDateBucket = []byte("orders_by_date")
+	ordersByUserBucket = []byte("orders_by_user")
+)
+
+// OrderStore persists the orders so they survive a restart of the service
+type OrderStore interface {
+	SaveOrder(order *OrderRecord) error
+	GetOrder(id string) (*OrderRecord, error)
+	UpdateOrder(id string, update func(order *OrderRecord) error) (*OrderRecord, error)
+	UpdateOrderWithOutbox(id string, update func(order *OrderRecord) ([]OutboxMessage, error)) (*OrderRecord, error)
+	ListOrdersByStatus(statuses ...OrderStatus) ([]*OrderRecord, error)
+	ListOrders(filter OrderFilter) (*OrderPage, error)
+	HasWebhookEvent(id string) (bool, error)
+	SaveWebhookEvent(id string, eventType string) error
+	ReserveIdempotencyKey(key string, fingerprint string) (*IdempotencyRecord, error)
+	CompleteIdempotencyKey(key string, statusCode int, body []byte) error
+	ReleaseIdempotencyKey(key string) error
+	PurgeIdempotencyKeys() (int, error)
+	ListOutboxMessages(statuses ...OutboxStatus) ([]*OutboxMessage, error)
+	UpdateOutboxMessage(id uint64, update func(message *OutboxMessage) error) (*OutboxMessage, error)
+	DeleteOutboxMessage(id uint64) error
+	CouponRedemptions(code string, userID string) (int, int, error)
+	RedeemCoupon(code string, userID string, check func(total int, byUser int) error) error
+	ReleaseCoupon(code string, userID string) error
+	Close() error
+}
+
+// OrderFilter selects the orders returned by ListOrders. Empty fields select every order.
+type OrderFilter struct {
+	UserID   string
+	Statuses []OrderStatus
+	From     time.Time // Orders created at or after this date
+	To       time.Time // Orders created before this date
+	Cursor   string    // NextCursor of the previous page, empty for the first page
+	Limit    int       // Orders per page
+}
+
+// OrderPage is a page of orders, the most recent first
+type OrderPage struct {
+	Orders     []*OrderRecord `json:"orders"`
+	NextCursor string         `json:"next_cursor,omitempty"` // Empty on the last page
+}
+
+// webhookEventRecord is a processed Paypal webhook event
+type webhookEventRecord struct {
+	EventType   string    `json:"event_type"`
+	ProcessedAt time.Time `json:"processed_at"`
+}
+
+// BoltOrderStore is an OrderStore backed by an embedded bbolt database
+type BoltOrderStore struct {
+	db *bolt.DB
+}
+
+// ===================================================================
+// Opens (or creates) the bbolt database used to store the orders
+//
+// Parameters:
+//
+//	(string) path : Path of the database file
+//
+// Return
+//
+//	(*BoltOrderStore) : Store ready to be used
+//	(error) : Error while opening the database or nil if no error occurs
+//
+// Example:
+//
+//	store, err := NewBoltOrderStore("/data/billing.db")
+//
+// ===================================================================
+func NewBoltOrderStore(path string) (*BoltOrderStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("could not open order store %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		// Databases created before the indexes get them from their orders
+		indexed := tx.Bucket(ordersByDateBucket) != nil && tx.Bucket(ordersByUserBucket) != nil
+
+		for _, bucket := range [][]byte{ordersBucket, webhookEventsBucket, idempotencyBucket, outboxBucket, couponRedemptionsBucket,
+			ordersByDateBucket, ordersByUserBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		if indexed {
+			return nil
+		}
+		return tx.Bucket(ordersBucket).ForEach(func(_, value []byte) error {
+			order, err := decodeOrder(value)
+			if err != nil {
+				return err
+			}
+			return indexOrder(tx, nil, order)
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not initialize order store: %w", err)
+	}
+
+	return &BoltOrderStore{db: db}, nil
+}
+
+// ===================================================================
+// Creates or replaces an order, keyed by its checkout ID, and its
+// entries in the indexes of ListOrders.
+// The update date of the order is set before saving it.
+//
+// Parameters:
+//
+//	(*OrderRecord) order : Order to persist
+//
+// Used on:
+//
+//	(*BoltOrderStore) s : Store persisting the order
+//
+// Return
+//
+//	(error) : Error while saving or nil if no error occurs
+//
+// ===================================================================
+func (s *BoltOrderStore) SaveOrder(order *OrderRecord) error {
+	order.UpdatedAt = time.Now().UTC()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(ordersBucket)
+
+		var previous *OrderRecord
+		if value := bucket.Get([]byte(order.ID)); value != nil {
+			decoded, err := decodeOrder(value)
+			if err != nil {
+				return err
+			}
+			previous = decoded
+		}
+
+		value, err := json.Marshal(order)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte(order.ID), value); err != nil {
+			return err
+		}
+		return indexOrder(tx, previous, order)
+	})
+}
+
+// indexOrder adds an order to the indexes of ListOrders, replacing the
+// entries of its previous version. Updates can not change the creation
+// date or the user of an order, so only SaveOrder indexes orders.
+func indexOrder(tx *bolt.Tx, previous *OrderRecord, order *OrderRecord) error {
+	byDate := tx.Bucket(ordersByDateBucket)
+	byUser := tx.Bucket(ordersByUserBucket)
+
+	if previous != nil {
+		if err := byDate.Delete(orderIndexKey("", previous)); err != nil {
+			return err
+		}
+		if err := byUser.Delete(orderIndexKey(previous.Infos.Order.UserID, previous)); err != nil {
+			return err
+		}
+	}
+	if err := byDate.Put(orderIndexKey("", order), []byte(order.ID)); err != nil {
+		return err
+	}
+	return byUser.Put(orderIndexKey(order.Infos.Order.UserID, order), []byte(order.ID))
+}
+
+// orderIndexPrefix returns the prefix of the index keys of a user, or of
+// the date index when the user is empty
+func orderIndexPrefix(userID string) string {
+	if userID == "" {
+		return ""
+	}
+	return userID + "|"
+}
+
+// orderIndexDate formats a date so index keys sort like the dates
+func orderIndexDate(date time.Time) string {
+	return fmt.Sprintf("%020d", date.UnixNano())
+}
+
+// orderIndexKey returns the key of an order in the index of a user, or
+// in the date index when the user is empty
+func orderIndexKey(userID string, order *OrderRecord) []byte {
+	return []byte(orderIndexPrefix(userID) + newOrderCursor(order).indexKey())
+}
+
+// ===================================================================
+// Returns an order by its checkout ID
+//
+// Parameters:
+//
+//	(string) id : Checkout ID on the payment provider, e.g. Paypal order ID
+//
+// Used on:
+//
+//	(*BoltOrderStore) s : Store containing the order
+//
+// Return
+//
+//	(*OrderRecord) : Order found
+//	(error) : ErrOrderNotFound if the order does not exist
+//
+// ===================================================================
+func (s *BoltOrderStore) GetOrder(id string) (*OrderRecord, error) {
+	var order *OrderRecord
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(ordersBucket).Get([]byte(id))
+		if value == nil {
+			return ErrOrderNotFound
+		}
+
+		decoded, err := decodeOrder(value)
+		order = decoded
+		return err
+	})
+
+	return order, err
+}
+
+// ===================================================================
+// Reads, updates and saves an order in a single transaction, so
+// concurrent updates of the same order can not overwrite each other.
+// Nothing is saved when the update returns an error.
+//
+// Parameters:
+//
+//	(string) id : Checkout ID on the payment provider, e.g. Paypal order ID
+//	(func(*OrderRecord) error) update : Changes to apply to the order
+//
+// Used on:
+//
+//	(*BoltOrderStore) s : Store containing the order
+//
+// Return
+//
+//	(*OrderRecord) : Order as saved
+//	(error) : ErrOrderNotFound, the update error or a store error
+//
+// Example:
+//
+//	order, err := store.UpdateOrder(id, func(order *OrderRecord) error {
+//		return order.Transition(StatusApproved, "approved by the client")
+//	})
+//
+// ===================================================================
+func (s *BoltOrderStore) UpdateOrder(id string, update func(order *OrderRecord) error) (*OrderRecord, error) {
+	return s.UpdateOrderWithOutbox(id, func(order *OrderRecord) ([]OutboxMessage, error) {
+		return nil, update(order)
+	})
+}
+
+// ===================================================================
+// Updates an order like UpdateOrder and adds the messages returned by
+// the update to the outbox, in the same transaction: the messages are
+// sent if and only if the order change is saved. The coupon redemption
+// of an order ending unpaid or refunded is released in the same transaction.
+//
+// Parameters:
+//
+//	(string) id : Checkout ID on the payment provider, e.g. Paypal order ID
+//	(func(*OrderRecord) ([]OutboxMessage, error)) update : Changes to apply to the order,
+//		returning the messages to send
+//
+// Used on:
+//
+//	(*BoltOrderStore) s : Store containing the order
+//
+// Return
+//
+//	(*OrderRecord) : Order as saved
+//	(error) : ErrOrderNotFound, the update error or a store error
+//
+// ===================================================================
+func (s *BoltOrderStore) UpdateOrderWithOutbox(id string, update func(order *OrderRecord) ([]OutboxMessage, error)) (*OrderRecord, error) {
+	var order *OrderRecord
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(ordersBucket)
+
+		value := bucket.Get([]byte(id))
+		if value == nil {
+			return ErrOrderNotFound
+		}
+		decoded, err := decodeOrder(value)
+		if err != nil {
+			return err
+		}
+
+		previous := decoded.Status
+		messages, err := update(decoded)
+		if err != nil {
+			return err
+		}
+		if err := releaseOrderCoupon(tx, previous, decoded); err != nil {
+			return err
+		}
+		decoded.UpdatedAt = time.Now().UTC()
+
+		updated, err := json.Marshal(decoded)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte(id), updated); err != nil {
+			return err
+		}
+		for _, message := range messages {
+			if err := putOutboxMessage(tx.Bucket(outboxBucket), message); err != nil {
+				return err
+			}
+		}
+		order = decoded
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return order, nil
+}
+
+// ===================================================================
+// Returns every order in one of the given statuses
+//
+// Parameters:
+//
+//	(...OrderStatus) statuses : Statuses of the orders to return
+//
+// Used on:
+//
+//	(*BoltOrderStore) s : Store containing the orders
+//
+// Return
+//
+//	([]*OrderRecord) : Orders found
+//	(error) : Error while reading or nil if no error occurs
+//
+// Example:
+//
+//	pendingOrders, err := store.ListOrdersByStatus(StatusCreated, StatusApproved)
+//
+// ===================================================================
+func (s *BoltOrderStore) ListOrdersByStatus(statuses ...OrderStatus) ([]*OrderRecord, error) {
+	var orders []*OrderRecord
+
+	wanted := make(map[OrderStatus]bool, len(statuses))
+	for _, status := range statuses {
+		wanted[status] = true
+	}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(ordersBucket).ForEach(func(_, value []byte) error {
+			order, err := decodeOrder(value)
+			if err != nil {
+				return err
+			}
+			if wanted[order.Status] {
+				orders = append(orders, order)
+			}
+			return nil
+		})
+	})
+
+	return orders, err
+}
+
+// ===================================================================
+// Lists the orders matching a filter, the most recently created
+// first, one page at a time. The cursor of a page points after its
+// last order, so orders created meanwhile do not shift the next pages.
+// Orders are read from the date index, or the index of the user, from
+// the cursor: a page reads its own orders, not the whole bucket.
+//
+// Parameters:
+//
+//	(OrderFilter) filter : Orders to list and page to return
+//
+// Used on:
+//
+//	(*BoltOrderStore) s : Store containing the orders
+//
+// Return
+//
+//	(*OrderPage) : Orders of the page and cursor of the next page
+//	(error) : ErrInvalidCursor, error while reading or nil if no error occurs
+//
+// Example:
+//
+//	page, err := store.ListOrders(OrderFilter{UserID: "xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx", Limit: 20})
+//
+// ===================================================================
+func (s *BoltOrderStore) ListOrders(filter OrderFilter) (*OrderPage, error) {
+	prefix := orderIndexPrefix(filter.UserID)
+	index := ordersByDateBucket
+	if filter.UserID != "" {
+		index = ordersByUserBucket
+	}
+
+	// The listing starts before the cursor or the end date, the index is read backwards
+	upper := prefix + "~"
+	if !filter.To.IsZero() {
+		upper = prefix + orderIndexDate(filter.To)
+	}
+	if filter.Cursor != "" {
+		after, err := decodeOrderCursor(filter.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		if key := prefix + after.indexKey(); key < upper {
+			upper = key
+		}
+	}
+	lower := prefix
+	if !filter.From.IsZero() {
+		lower = prefix + orderIndexDate(filter.From)
+	}
+
+	wanted := make(map[OrderStatus]bool, len(filter.Statuses))
+	for _, status := range filter.Statuses {
+		wanted[status] = true
+	}
+
+	page := &OrderPage{Orders: []*OrderRecord{}}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		orders := tx.Bucket(ordersBucket)
+		cursor := tx.Bucket(index).Cursor()
+
+		key, id := cursor.Seek([]byte(upper))
+		if key == nil {
+			key, id = cursor.Last()
+		} else {
+			key, id = cursor.Prev()
+		}
+		for ; key != nil && string(key) >= lower && strings.HasPrefix(string(key), prefix); key, id = cursor.Prev() {
+			value := orders.Get(id)
+			if value == nil {
+				return fmt.Errorf("order %s of index key %s not found", id, key)
+			}
+			order, err := decodeOrder(value)
+			if err != nil {
+				return err
+			}
+			if len(wanted) > 0 && !wanted[order.Status] {
+				continue
+			}
+
+			// One more order than the limit tells whether a next page exists
+			if filter.Limit > 0 && len(page.Orders) == filter.Limit {
+				page.NextCursor = newOrderCursor(page.Orders[filter.Limit-1]).encode()
+				return nil
+			}
+			page.Orders = append(page.Orders, order)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+// orderCursor is the position of an order in the listing: orders are
+// sorted by creation date then ID, the most recent first
+type orderCursor struct {
+	createdAt time.Time
+	id        string
+}
+
+func newOrderCursor(order *OrderRecord) orderCursor {
+	return orderCursor{createdAt: order.CreatedAt, id: order.ID}
+}
+
+// indexKey returns the "created_at|id" part of the index keys
+func (c orderCursor) indexKey() string {
+	return orderIndexDate(c.createdAt) + "|" + c.id
+}
+
+// encode returns the opaque cursor sent to the clients
+func (c orderCursor) encode() string {
+	value := strconv.FormatInt(c.createdAt.UnixNano(), 10) + ":" + c.id
+	return base64.RawURLEncoding.EncodeToString([]byte(value))
+}
+
+func decodeOrderCursor(cursor string) (*orderCursor, error) {
+	value, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	nanos, id, found := strings.Cut(string(value), ":")
+	if !found || id == "" {
+		return nil, ErrInvalidCursor
+	}
+	createdAt, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil || createdAt < 0 {
+		return nil, ErrInvalidCursor
+	}
+
+	return &orderCursor{createdAt: time.Unix(0, createdAt).UTC(), id: id}, nil
+}
+
+// HasWebhookEvent reports whether a Paypal webhook event has already been processed
+func (s *BoltOrderStore) HasWebhookEvent(id string) (bool, error) {
+	var found bool
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket(webhookEventsBucket).Get([]byte(id)) != nil
+		return nil
+	})
+
+	return found, err
+}
+
+// SaveWebhookEvent records a processed Paypal webhook event, used to ignore its redeliveries
+func (s *BoltOrderStore) SaveWebhookEvent(id string, eventType string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		value, err := json.Marshal(webhookEventRecord{EventType: eventType, ProcessedAt: time.Now().UTC()})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(webhookEventsBucket).Put([]byte(id), value)
+	})
+}
+
+// Close releases the database file
+func (s *BoltOrderStore) Close() error {
+	return s.db.Close()
+}
+
+// decodeOrder unmarshals a stored order and restores its quote
+func decodeOrder(value []byte) (*OrderRecord, error) {
+	order := &OrderRecord{}
+	if err := json.Unmarshal(value, order); err != nil {
+		return nil, fmt.Errorf("could not decode stored order: %w", err)
+	}
+	order.Infos.Quote = order.Quote
+
+	return order, nil
+}
@@ -0,0 +1,157 @@
+package paypal
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// saveListedOrders saves an order of each given user, created a minute apart from the
+// first one, and returns the IDs of the orders of each user (and "" for all), the most recent first
+func saveListedOrders(t *testing.T, store *BoltOrderStore, users ...string) map[string][]string {
+	t.Helper()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ids := make(map[string][]string)
+
+	for i, userID := range users {
+		infos := PaypalOrderInfos{Provider: "fake"}
+		infos.Order.UserID = userID
+		order := NewOrderRecord(fmt.Sprintf("ORDER-%d", i), infos)
+		order.CreatedAt = start.Add(time.Duration(i) * time.Minute)
+		if err := store.SaveOrder(order); err != nil {
+			t.Fatal(err)
+		}
+		ids[userID] = append([]string{order.ID}, ids[userID]...)
+		ids[""] = append([]string{order.ID}, ids[""]...)
+	}
+	return ids
+}
+
+// listIDs returns the IDs of the orders of a page
+func listIDs(page *OrderPage) []string {
+	ids := []string{}
+	for _, order := range page.Orders {
+		ids = append(ids, order.ID)
+	}
+	return ids
+}
+
+func TestListOrders(t *testing.T) {
+	store, _ := openTestStore(t)
+	ids := saveListedOrders(t, store, "alice", "bob", "alice", "alice", "bob")
+
+	for _, userID := range []string{"alice", "bob", ""} {
+		t.Run("user "+userID, func(t *testing.T) {
+			var listed []string
+			filter := OrderFilter{UserID: userID, Limit: 2}
+			for pages := 1; ; pages++ {
+				page, err := store.ListOrders(filter)
+				if err != nil {
+					t.Fatalf("ListOrders() error = %v", err)
+				}
+				if len(page.Orders) > filter.Limit || pages > len(ids[userID]) {
+					t.Fatalf("ListOrders() page %d = %v, want at most %d orders", pages, listIDs(page), filter.Limit)
+				}
+				listed = append(listed, listIDs(page)...)
+				if page.NextCursor == "" {
+					break
+				}
+				filter.Cursor = page.NextCursor
+			}
+			if !reflect.DeepEqual(listed, ids[userID]) {
+				t.Errorf("ListOrders() = %v, want %v", listed, ids[userID])
+			}
+		})
+	}
+}
+
+func TestListOrdersLastPage(t *testing.T) {
+	store, _ := openTestStore(t)
+	saveListedOrders(t, store, "alice", "alice")
+
+	// A full last page has no next cursor
+	page, err := store.ListOrders(OrderFilter{UserID: "alice", Limit: 2})
+	if err != nil || len(page.Orders) != 2 || page.NextCursor != "" {
+		t.Fatalf("ListOrders() = %+v, %v, want the 2 orders without next cursor", page, err)
+	}
+
+	page, err = store.ListOrders(OrderFilter{UserID: "carol", Limit: 2})
+	if err != nil || page.Orders == nil || len(page.Orders) != 0 || page.NextCursor != "" {
+		t.Errorf("ListOrders() of a user without orders = %+v, %v, want an empty page", page, err)
+	}
+}
+
+func TestListOrdersFilters(t *testing.T) {
+	store, _ := openTestStore(t)
+	saveListedOrders(t, store, "alice", "bob", "alice", "alice", "bob")
+	if _, err := store.UpdateOrder("ORDER-2", func(order *OrderRecord) error {
+		return order.Transition(StatusExpired, "")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		filter OrderFilter
+		want   []string
+	}{
+		{name: "status", filter: OrderFilter{UserID: "alice", Statuses: []OrderStatus{StatusCreated}}, want: []string{"ORDER-3", "ORDER-0"}},
+		{name: "from included", filter: OrderFilter{From: start.Add(2 * time.Minute)}, want: []string{"ORDER-4", "ORDER-3", "ORDER-2"}},
+		{name: "to excluded", filter: OrderFilter{UserID: "bob", To: start.Add(4 * time.Minute)}, want: []string{"ORDER-1"}},
+		{name: "status on several pages", filter: OrderFilter{Statuses: []OrderStatus{StatusCreated}, Limit: 3}, want: []string{"ORDER-4", "ORDER-3", "ORDER-1"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			page, err := store.ListOrders(test.filter)
+			if err != nil {
+				t.Fatalf("ListOrders() error = %v", err)
+			}
+			if !reflect.DeepEqual(listIDs(page), test.want) {
+				t.Errorf("ListOrders() = %v, want %v", listIDs(page), test.want)
+			}
+		})
+	}
+}
+
+func TestListOrdersInvalidCursor(t *testing.T) {
+	store, _ := openTestStore(t)
+
+	for _, cursor := range []string{"not base64!", "bm8tc2VwYXJhdG9y", "YWJjOk9SREVSLTE", "MTIzOg"} {
+		if _, err := store.ListOrders(OrderFilter{Cursor: cursor}); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("ListOrders(%q) error = %v, want %v", cursor, err, ErrInvalidCursor)
+		}
+	}
+}
+
+func TestListOrdersIndexesExistingOrders(t *testing.T) {
+	store, path := openTestStore(t)
+	ids := saveListedOrders(t, store, "alice", "bob", "alice")
+
+	// Orders stored before the indexes existed
+	if err := store.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(ordersByDateBucket); err != nil {
+			return err
+		}
+		return tx.DeleteBucket(ordersByUserBucket)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	reopened, err := NewBoltOrderStore(path)
+	if err != nil {
+		t.Fatalf("NewBoltOrderStore() error = %v", err)
+	}
+	defer reopened.Close()
+
+	page, err := reopened.ListOrders(OrderFilter{UserID: "alice"})
+	if err != nil || !reflect.DeepEqual(listIDs(page), ids["alice"]) {
+		t.Errorf("ListOrders() = %v, %v, want %v", listIDs(page), err, ids["alice"])
+	}
+}
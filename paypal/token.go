@@ -0,0 +1,198 @@
+package paypal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	helpers "github.com/OneKonsole/web-service-billing/helpers"
+	"github.com/OneKonsole/web-service-billing/payment"
+)
+
+// Tokens are renewed this long before Paypal expires them, so that a
+// token never expires while a request is in flight. Short-lived tokens
+// are renewed after three quarters of their lifetime instead.
+const tokenRefreshMargin = 5 * time.Minute
+
+var (
+	ErrInvalidCredentials   = errors.New("invalid Paypal client credentials")
+	ErrInvalidTokenResponse = errors.New("invalid Paypal token response")
+)
+
+// TokenError describes a failed access token request
+type TokenError struct {
+	StatusCode  int
+	Description string
+	Err         error // ErrInvalidCredentials or ErrInvalidTokenResponse
+}
+
+func (e *TokenError) Error() string {
+	if e.Description == "" {
+		return fmt.Sprintf("%s (status code %d)", e.Err, e.StatusCode)
+	}
+	return fmt.Sprintf("%s (status code %d): %s", e.Err, e.StatusCode, e.Description)
+}
+
+func (e *TokenError) Unwrap() error {
+	return e.Err
+}
+
+// Unavailable reports whether Paypal failed on its side
+func (e *TokenError) Unavailable() bool {
+	return payment.IsUnavailableStatus(e.StatusCode)
+}
+
+// Response of Paypal POST /v1/oauth2/token
+type accessTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int    `json:"expires_in"` // Seconds
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// TokenProvider caches the owner Paypal access token and renews it
+// shortly before it expires
+type TokenProvider struct {
+	url          string
+	clientID     string
+	clientSecret string
+	token        string
+	expiresAt    time.Time
+	httpClient   *http.Client
+	mutex        sync.Mutex
+}
+
+func NewTokenProvider(url string, clientID string, clientSecret string, httpClient *http.Client) *TokenProvider {
+	return &TokenProvider{
+		url:          url,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		httpClient:   httpClient,
+	}
+}
+
+// ===================================================================
+// Returns owner paypal access token. The cached token is returned
+// until shortly before its expiry. Concurrent callers wait for a
+// single renewal instead of each requesting a new token.
+//
+// Used on:
+//
+//	(*TokenProvider) p : Provider holding the Paypal credentials
+//
+// Return
+//
+//	(string) : The access token retrieved or empty if an error occurs
+//	(error) : *TokenError, request error or nil if no error occurs
+//
+// Example:
+//
+//	accessToken, err := tokens.Token()
+//
+// ===================================================================
+func (p *TokenProvider) Token() (string, error) {
+	// Holding the lock during the renewal makes other callers wait for it
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	if p.token != "" && now.Before(p.expiresAt) {
+		return p.token, nil
+	}
+
+	response, err := requestAccessToken(p.httpClient, p.url, p.clientID, p.clientSecret)
+	if err != nil {
+		return "", err
+	}
+
+	p.token = response.AccessToken
+	lifetime := time.Duration(response.ExpiresIn) * time.Second
+	p.expiresAt = now.Add(lifetime - refreshMargin(lifetime))
+	fmt.Printf("[INFO] Paypal access token renewed, valid for %ds\n", response.ExpiresIn)
+
+	return p.token, nil
+}
+
+// refreshMargin returns how long before its expiry a token is renewed
+func refreshMargin(lifetime time.Duration) time.Duration {
+	if margin := lifetime / 4; margin < tokenRefreshMargin {
+		return margin
+	}
+	return tokenRefreshMargin
+}
+
+// ===================================================================
+// Requests a new access token with the client credentials
+//
+// Parameters:
+//
+//	(*http.Client) client : Client used for the request
+//	(string) url : Paypal API URL delivering tokens
+//	(string) clientID : Paypal Client ID (owner)
+//	(string) clientSecret : Paypal Client Secret (owner)
+//
+// Return
+//
+//	(accessTokenResponse) : Token and its lifetime
+//	(error) : *TokenError, request error or nil if no error occurs
+//
+// ===================================================================
+func requestAccessToken(client *http.Client, url string, clientID string, clientSecret string) (accessTokenResponse, error) {
+	// Paypal necessary items to add in request payload
+	payload := strings.NewReader("grant_type=client_credentials")
+
+	req, err := http.NewRequest("POST", url, payload)
+	if err != nil {
+		fmt.Printf("[ERROR] Could not initialize request to get access token : %s\n", err)
+		return accessTokenResponse{}, err
+	}
+
+	// Add HTTP headers to the request
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", "Basic "+helpers.AggregateClientInformation(clientID, clientSecret))
+
+	res, err := client.Do(req)
+	if err != nil {
+		fmt.Printf("[ERROR] Could not make request to get access token : %s\n", err)
+		return accessTokenResponse{}, err
+	}
+	defer res.Body.Close()
+
+	// Error responses carry a description, keep it when it can be parsed
+	var parsedBody accessTokenResponse
+	decodeErr := json.NewDecoder(res.Body).Decode(&parsedBody)
+
+	switch {
+	case res.StatusCode == http.StatusUnauthorized:
+		return accessTokenResponse{}, &TokenError{
+			StatusCode:  res.StatusCode,
+			Description: parsedBody.ErrorDescription,
+			Err:         ErrInvalidCredentials,
+		}
+	case res.StatusCode != http.StatusOK:
+		return accessTokenResponse{}, &TokenError{
+			StatusCode:  res.StatusCode,
+			Description: parsedBody.ErrorDescription,
+			Err:         ErrInvalidTokenResponse,
+		}
+	case decodeErr != nil:
+		return accessTokenResponse{}, &TokenError{
+			StatusCode:  res.StatusCode,
+			Description: decodeErr.Error(),
+			Err:         ErrInvalidTokenResponse,
+		}
+	case parsedBody.AccessToken == "" || parsedBody.ExpiresIn <= 0:
+		return accessTokenResponse{}, &TokenError{
+			StatusCode:  res.StatusCode,
+			Description: "missing access_token or expires_in",
+			Err:         ErrInvalidTokenResponse,
+		}
+	}
+
+	return parsedBody, nil
+}
@@ -0,0 +1,126 @@
+package paypal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRefreshMargin(t *testing.T) {
+	tests := []struct {
+		lifetime time.Duration
+		want     time.Duration
+	}{
+		{lifetime: 9 * time.Hour, want: 5 * time.Minute},
+		{lifetime: 20 * time.Minute, want: 5 * time.Minute},
+		{lifetime: 5 * time.Minute, want: 75 * time.Second},
+		{lifetime: 60 * time.Second, want: 15 * time.Second},
+		{lifetime: time.Second, want: 250 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		margin := refreshMargin(test.lifetime)
+		if margin != test.want {
+			t.Errorf("refreshMargin(%s) = %s, want %s", test.lifetime, margin, test.want)
+		}
+		if margin >= test.lifetime {
+			t.Errorf("refreshMargin(%s) = %s, token would always be expired", test.lifetime, margin)
+		}
+	}
+}
+
+// tokenServer answers token requests with a new token valid for expiresIn seconds
+func tokenServer(t *testing.T, expiresIn int, delay time.Duration) (*httptest.Server, *int32) {
+	t.Helper()
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := atomic.AddInt32(&requests, 1)
+		time.Sleep(delay)
+		fmt.Fprintf(w, `{"access_token": "token-%d", "token_type": "Bearer", "expires_in": %d}`, count, expiresIn)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestTokenProviderSingleFlight(t *testing.T) {
+	server, requests := tokenServer(t, 32400, 50*time.Millisecond)
+	provider := NewTokenProvider(server.URL, "id", "secret", server.Client())
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 20)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			token, err := provider.Token()
+			if err != nil {
+				t.Errorf("Token() error = %v", err)
+			}
+			tokens[i] = token
+		}(i)
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(requests); got != 1 {
+		t.Errorf("token requested %d times, want 1", got)
+	}
+	for _, token := range tokens {
+		if token != "token-1" {
+			t.Errorf("Token() = %q, want token-1", token)
+		}
+	}
+}
+
+func TestTokenProviderShortLivedTokenIsCached(t *testing.T) {
+	// A token valid for less than the refresh margin must still be reused
+	server, requests := tokenServer(t, 120, 0)
+	provider := NewTokenProvider(server.URL, "id", "secret", server.Client())
+
+	for i := 0; i < 5; i++ {
+		if _, err := provider.Token(); err != nil {
+			t.Fatalf("Token() error = %v", err)
+		}
+	}
+	if got := atomic.LoadInt32(requests); got != 1 {
+		t.Errorf("token requested %d times, want 1", got)
+	}
+}
+
+func TestTokenProviderErrors(t *testing.T) {
+	tests := []struct {
+		name            string
+		status          int
+		body            string
+		wantErr         error
+		wantUnavailable bool
+	}{
+		{name: "invalid credentials", status: 401, body: `{"error": "invalid_client"}`, wantErr: ErrInvalidCredentials},
+		{name: "server error", status: 503, body: ``, wantErr: ErrInvalidTokenResponse, wantUnavailable: true},
+		{name: "malformed body", status: 200, body: `not json`, wantErr: ErrInvalidTokenResponse},
+		{name: "missing expiry", status: 200, body: `{"access_token": "x"}`, wantErr: ErrInvalidTokenResponse},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.body))
+			}))
+			defer server.Close()
+
+			_, err := NewTokenProvider(server.URL, "id", "secret", server.Client()).Token()
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("Token() error = %v, want %v", err, test.wantErr)
+			}
+			var tokenError *TokenError
+			if !errors.As(err, &tokenError) || tokenError.Unavailable() != test.wantUnavailable {
+				t.Errorf("Unavailable() = %v, want %v", tokenError.Unavailable(), test.wantUnavailable)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package paypal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	helpers "github.com/OneKonsole/web-service-billing/helpers"
+)
+
+// Paypal events handled by the webhook
+const (
+	EventOrderApproved    = "CHECKOUT.ORDER.APPROVED"
+	EventCaptureCompleted = "PAYMENT.CAPTURE.COMPLETED"
+	EventCaptureDenied    = "PAYMENT.CAPTURE.DENIED"
+	EventCaptureRefunded  = "PAYMENT.CAPTURE.REFUNDED"
+)
+
+// Maximum size of a webhook event body
+const maxWebhookBodySize = 1 << 20
+
+var ErrInvalidWebhookSignature = errors.New("invalid webhook signature")
+
+// WebhookEvent is a notification sent by Paypal
+type WebhookEvent struct {
+	ID           string          `json:"id"`
+	EventType    string          `json:"event_type"`
+	ResourceType string          `json:"resource_type"`
+	Resource     json.RawMessage `json:"resource"`
+}
+
+// webhookResource holds the fields of the event resources we rely on.
+// The resource is an order for CHECKOUT.* events and a capture or a
+// refund for PAYMENT.* events.
+type webhookResource struct {
+	ID                string `json:"id"`
+	Status            string `json:"status"`
+	SupplementaryData struct {
+		RelatedIDs struct {
+			OrderID   string `json:"order_id"`
+			CaptureID string `json:"capture_id"`
+		} `json:"related_ids"`
+	} `json:"supplementary_data"`
+}
+
+// ===================================================================
+// Receives a Paypal webhook event. The event signature is verified
+// with Paypal, events already processed are ignored, then the event
+// drives the order state machine. Any processing error is answered
+// with a 500 so that Paypal delivers the event again.
+//
+// Parameters:
+//
+//	(http.ResponseWriter) w : Used to generate HTTP responses (retrieved by the router)
+//	(*http.Request) r : HTTP request sent by Paypal
+//	(string) webhookID : ID of the webhook configured on Paypal
+//
+// Used on:
+//
+//	(*OrderOrchestrator) o : Object that permits asynchronous management of the order
+//
+// ===================================================================
+func (o *OrderOrchestrator) HandleWebhook(
+	w http.ResponseWriter,
+	r *http.Request,
+	webhookID string,
+) {
+	if webhookID == "" {
+		fmt.Printf("[ERROR] Webhook event received but no webhook ID is configured\n")
+		helpers.RespondWithError(w, helpers.InternalError("Webhook is not configured", nil))
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBodySize))
+	if err != nil {
+		helpers.RespondWithError(w, helpers.ValidationError("Could not read event", nil))
+		return
+	}
+
+	var event WebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil || event.ID == "" {
+		fmt.Printf("[ERROR] Invalid webhook payload: %s\n", err)
+		helpers.RespondWithError(w, helpers.ValidationError("Invalid event", nil))
+		return
+	}
+
+	err = o.paypal.VerifyWebhookSignature(webhookID, r.Header, body)
+	if errors.Is(err, ErrInvalidWebhookSignature) {
+		fmt.Printf("[ERROR] Webhook event %s refused: %s\n", event.ID, err)
+		helpers.RespondWithError(w, helpers.UnauthorizedError(err.Error()))
+		return
+	}
+	if err != nil {
+		fmt.Printf("[ERROR] Could not verify webhook event %s: %s\n", event.ID, err)
+		helpers.RespondWithError(w, apiError("Could not verify event", err))
+		return
+	}
+
+	processed, err := o.store.HasWebhookEvent(event.ID)
+	if err != nil {
+		helpers.RespondWithError(w, helpers.InternalError("Could not read event", err))
+		return
+	}
+	if processed {
+		fmt.Printf("[INFO] Webhook event %s already processed\n", event.ID)
+		helpers.RespondWithJSON(w, http.StatusOK, map[string]string{"status": "DUPLICATE"})
+		return
+	}
+
+	fmt.Printf("[INFO] Processing webhook event %s (%s)\n", event.ID, event.EventType)
+	if err := o.processWebhookEvent(event); err != nil {
+		fmt.Printf("[ERROR] Could not process webhook event %s: %s\n", event.ID, err)
+		helpers.RespondWithError(w, apiError("Could not process event", err))
+		return
+	}
+
+	if err := o.store.SaveWebhookEvent(event.ID, event.EventType); err != nil {
+		fmt.Printf("[ERROR] Could not store webhook event %s: %s\n", event.ID, err)
+	}
+
+	helpers.RespondWithJSON(w, http.StatusOK, map[string]string{"status": "PROCESSED"})
+}
+
+// ===================================================================
+// Applies a verified webhook event to its order. Events about unknown
+// orders or that can not apply to the order status anymore are
+// ignored, since delivering them again would not change anything.
+//
+// Parameters:
+//
+//	(WebhookEvent) event : Verified Paypal event
+//
+// Used on:
+//
+//	(*OrderOrchestrator) o : Object that permits asynchronous management of the order
+//
+// Return:
+//
+//	(error) : Error worth a new delivery of the event, or nil
+//
+// ===================================================================
+func (o *OrderOrchestrator) processWebhookEvent(event WebhookEvent) error {
+	var resource webhookResource
+	if err := json.Unmarshal(event.Resource, &resource); err != nil {
+		return fmt.Errorf("invalid event resource: %w", err)
+	}
+
+	orderID := resource.SupplementaryData.RelatedIDs.OrderID
+
+	switch event.EventType {
+	case EventOrderApproved:
+		err := o.approve(resource.ID)
+		if errors.Is(err, ErrOrderNotFound) || errors.Is(err, ErrOrderAlreadyHandled) || errors.Is(err, ErrPaymentNotVerified) {
+			fmt.Printf("[INFO] Ignoring approval event of order %s: %s\n", resource.ID, err)
+			return nil
+		}
+		return err
+
+	case EventCaptureCompleted:
+		order, err := o.store.GetOrder(orderID)
+		if errors.Is(err, ErrOrderNotFound) {
+			fmt.Printf("[INFO] Ignoring capture event of unknown order %s\n", orderID)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// The browser never confirmed the approval, do it on its behalf
+		if order.Status == StatusCreated {
+			err := o.approve(orderID)
+			if errors.Is(err, ErrOrderAlreadyHandled) || errors.Is(err, ErrPaymentNotVerified) {
+				fmt.Printf("[INFO] Ignoring capture event of order %s: %s\n", orderID, err)
+				return nil
+			}
+			return err
+		}
+		return o.applyWebhookStatus(orderID, StatusCaptured, "capture completed on Paypal", func(order *OrderRecord) {
+			if order.CaptureID == "" {
+				order.CaptureID = resource.ID
+			}
+		})
+
+	case EventCaptureDenied:
+		return o.applyWebhookStatus(orderID, StatusFailed, "capture denied on Paypal")
+
+	case EventCaptureRefunded:
+		return o.handleRefundEvent(event.Resource)
+
+	default:
+		fmt.Printf("[INFO] Ignoring webhook event type %s\n", event.EventType)
+		return nil
+	}
+}
+
+// errEventIgnored leaves an order unchanged when an event does not apply to it
+var errEventIgnored = errors.New("event ignored")
+
+// ===================================================================
+// Moves an order to a status when it is still allowed, then applies
+// the changes of the event. Orders that can not move to the status
+// anymore are left untouched, as well as approved or authorized
+// orders whose payment is being secured: securePayment reads the
+// payment state from the provider and moves them itself.
+//
+// Parameters:
+//
+//	(string) orderID : Checkout ID of the order
+//	(OrderStatus) to : Status the event moves the order to
+//	(string) reason : Why the status changed
+//	(...func(order *OrderRecord)) changes : Changes made with the transition
+//
+// Used on:
+//
+//	(*OrderOrchestrator) o : Object that permits asynchronous management of the order
+//
+// Return:
+//
+//	(error) : Store error or nil if the event is applied or ignored
+//
+// ===================================================================
+func (o *OrderOrchestrator) applyWebhookStatus(orderID string, to OrderStatus, reason string, changes ...func(order *OrderRecord)) error {
+	_, err := o.store.UpdateOrder(orderID, func(order *OrderRecord) error {
+		if !order.CanTransition(to) {
+			fmt.Printf("[INFO] Order %s is %s, event can not move it to %s\n", orderID, order.Status, to)
+			return errEventIgnored
+		}
+		if (order.Status == StatusApproved || order.Status == StatusAuthorized) && o.isSecuringPayment(orderID) {
+			fmt.Printf("[INFO] Order %s payment is being secured, event left to it\n", orderID)
+			return errEventIgnored
+		}
+
+		for _, change := range changes {
+			change(order)
+		}
+		return order.Transition(to, reason)
+	})
+	if errors.Is(err, errEventIgnored) {
+		return nil
+	}
+	if errors.Is(err, ErrOrderNotFound) {
+		fmt.Printf("[INFO] Ignoring event of unknown order %s\n", orderID)
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,279 @@
+package paypal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// verificationServer answers signature verifications the way the Paypal API does
+type verificationServer struct {
+	mutex         sync.Mutex
+	status        int
+	response      string
+	verifications []map[string]json.RawMessage // Bodies of the verification requests
+	tokens        []string                     // Authorization header of each request
+}
+
+func (s *verificationServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if r.URL.Path == "/v1/oauth2/token" {
+		fmt.Fprint(w, `{"access_token": "token", "expires_in": 32400}`)
+		return
+	}
+	if r.URL.Path != "/v1/notifications/verify-webhook-signature" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var verification map[string]json.RawMessage
+	json.NewDecoder(r.Body).Decode(&verification)
+	s.verifications = append(s.verifications, verification)
+	s.tokens = append(s.tokens, r.Header.Get("Authorization"))
+
+	w.WriteHeader(s.status)
+	fmt.Fprint(w, s.response)
+}
+
+func newTestVerificationClient(t *testing.T, status int, response string) (*Client, *verificationServer) {
+	t.Helper()
+	api := &verificationServer{status: status, response: response}
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+
+	client, err := NewClient(EnvironmentSandbox, server.URL, "id", "secret", server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, api
+}
+
+func openTestStore(t *testing.T) (*BoltOrderStore, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "billing.db")
+	store, err := NewBoltOrderStore(path)
+	if err != nil {
+		t.Fatalf("NewBoltOrderStore() error = %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store, path
+}
+
+// signedHeaders returns the signature headers Paypal sends with an event
+func signedHeaders() http.Header {
+	headers := http.Header{}
+	headers.Set("PAYPAL-AUTH-ALGO", "SHA256withRSA")
+	headers.Set("PAYPAL-CERT-URL", "https://api.sandbox.paypal.com/v1/notifications/certs/CERT-1")
+	headers.Set("PAYPAL-TRANSMISSION-ID", "TRANSMISSION-1")
+	headers.Set("PAYPAL-TRANSMISSION-SIG", "c2lnbmF0dXJl")
+	headers.Set("PAYPAL-TRANSMISSION-TIME", "2024-03-01T10:00:00Z")
+	return headers
+}
+
+const testEvent = `{"id": "WH-1", "event_type": "BILLING.PLAN.CREATED", "resource": {"id": "PLAN-1"}}`
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		response    string
+		wantErr     bool
+		wantRefusal bool // ErrInvalidWebhookSignature expected
+	}{
+		{name: "authentic", status: http.StatusOK, response: `{"verification_status": "SUCCESS"}`},
+		{name: "forged", status: http.StatusOK, response: `{"verification_status": "FAILURE"}`, wantErr: true, wantRefusal: true},
+		{name: "no status", status: http.StatusOK, response: `{}`, wantErr: true, wantRefusal: true},
+		{name: "invalid response", status: http.StatusOK, response: `SUCCESS`, wantErr: true},
+		{name: "Paypal unavailable", status: http.StatusServiceUnavailable, response: `{"verification_status": "SUCCESS"}`, wantErr: true},
+		{name: "request refused", status: http.StatusBadRequest, response: `{"name": "VALIDATION_ERROR"}`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, _ := newTestVerificationClient(t, test.status, test.response)
+
+			err := client.VerifyWebhookSignature("WEBHOOK-1", signedHeaders(), []byte(testEvent))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("VerifyWebhookSignature() error = %v, want error %v", err, test.wantErr)
+			}
+			// Only a refusal proves the event is forged, other errors are worth a new delivery
+			if errors.Is(err, ErrInvalidWebhookSignature) != test.wantRefusal {
+				t.Errorf("VerifyWebhookSignature() error = %v, want refusal %v", err, test.wantRefusal)
+			}
+		})
+	}
+}
+
+func TestVerifyWebhookSignatureRequest(t *testing.T) {
+	client, api := newTestVerificationClient(t, http.StatusOK, `{"verification_status": "SUCCESS"}`)
+	if err := client.VerifyWebhookSignature("WEBHOOK-1", signedHeaders(), []byte(testEvent)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(api.verifications) != 1 || api.tokens[0] != "Bearer token" {
+		t.Fatalf("verifications = %d with tokens %q, want 1 with the access token", len(api.verifications), api.tokens)
+	}
+	verification := api.verifications[0]
+	want := map[string]string{
+		"auth_algo":         "SHA256withRSA",
+		"cert_url":          "https://api.sandbox.paypal.com/v1/notifications/certs/CERT-1",
+		"transmission_id":   "TRANSMISSION-1",
+		"transmission_sig":  "c2lnbmF0dXJl",
+		"transmission_time": "2024-03-01T10:00:00Z",
+		"webhook_id":        "WEBHOOK-1",
+	}
+	for field, value := range want {
+		var sent string
+		json.Unmarshal(verification[field], &sent)
+		if sent != value {
+			t.Errorf("%s = %q, want %q", field, sent, value)
+		}
+	}
+
+	// The event is sent back as received, only compacted: fields keep their order and values
+	var event bytes.Buffer
+	json.Compact(&event, []byte(testEvent))
+	if string(verification["webhook_event"]) != event.String() {
+		t.Errorf("webhook_event = %s, want %s", verification["webhook_event"], event.String())
+	}
+}
+
+func TestHandleWebhookSignature(t *testing.T) {
+	tests := []struct {
+		name       string
+		webhookID  string
+		status     int
+		response   string
+		wantStatus int
+		wantStored bool
+	}{
+		{name: "authentic", webhookID: "WEBHOOK-1", status: http.StatusOK, response: `{"verification_status": "SUCCESS"}`, wantStatus: http.StatusOK, wantStored: true},
+		{name: "forged", webhookID: "WEBHOOK-1", status: http.StatusOK, response: `{"verification_status": "FAILURE"}`, wantStatus: http.StatusUnauthorized},
+		{name: "verification unavailable", webhookID: "WEBHOOK-1", status: http.StatusServiceUnavailable, wantStatus: http.StatusServiceUnavailable},
+		{name: "webhook not configured", status: http.StatusOK, response: `{"verification_status": "SUCCESS"}`, wantStatus: http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, _ := newTestVerificationClient(t, test.status, test.response)
+			store, _ := openTestStore(t)
+			orchestrator := NewOrderOchestrator(store, client, time.Minute)
+
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest("POST", "/paypal/webhook", strings.NewReader(testEvent))
+			request.Header = signedHeaders()
+			orchestrator.HandleWebhook(recorder, request, test.webhookID)
+
+			if recorder.Code != test.wantStatus {
+				t.Errorf("HandleWebhook() status = %d, want %d (%s)", recorder.Code, test.wantStatus, recorder.Body)
+			}
+			// Only authentic events are recorded, the others can be delivered again
+			stored, err := store.HasWebhookEvent("WH-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored != test.wantStored {
+				t.Errorf("event stored = %v, want %v", stored, test.wantStored)
+			}
+		})
+	}
+}
+
+// saveOrderWithStatus stores an order moved through the given statuses
+func saveOrderWithStatus(t *testing.T, store *BoltOrderStore, id string, statuses ...OrderStatus) *OrderRecord {
+	t.Helper()
+	order := NewOrderRecord(id, PaypalOrderInfos{Provider: ProviderName})
+	for _, status := range statuses {
+		if err := order.Transition(status, ""); err != nil {
+			t.Fatal(err)
+		}
+		if status == StatusCaptured {
+			order.CaptureID = "CAPTURE-1"
+		}
+	}
+	if err := store.SaveOrder(order); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := store.GetOrder(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+func TestProcessWebhookEvent(t *testing.T) {
+	approved := []OrderStatus{StatusApproved}
+	authorized := []OrderStatus{StatusApproved, StatusAuthorized}
+	captured := []OrderStatus{StatusApproved, StatusCaptured}
+	provisioned := []OrderStatus{StatusApproved, StatusCaptured, StatusProvisioningRequested, StatusProvisioned}
+
+	tests := []struct {
+		name          string
+		statuses      []OrderStatus
+		securing      bool // securePayment is running for the order
+		eventType     string
+		wantStatus    OrderStatus
+		wantCaptureID string
+	}{
+		{name: "capture of an approved order", statuses: approved, eventType: EventCaptureCompleted, wantStatus: StatusCaptured, wantCaptureID: "CAPTURE-2"},
+		{name: "capture of an order being secured", statuses: approved, securing: true, eventType: EventCaptureCompleted, wantStatus: StatusApproved},
+		{name: "capture of an authorized order", statuses: authorized, eventType: EventCaptureCompleted, wantStatus: StatusAuthorized},
+		{name: "denial of an order being secured", statuses: authorized, securing: true, eventType: EventCaptureDenied, wantStatus: StatusAuthorized},
+		{name: "denial of a captured order", statuses: captured, eventType: EventCaptureDenied, wantStatus: StatusFailed, wantCaptureID: "CAPTURE-1"},
+		{name: "denial of a provisioned order", statuses: provisioned, eventType: EventCaptureDenied, wantStatus: StatusProvisioned, wantCaptureID: "CAPTURE-1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store, _ := openTestStore(t)
+			orchestrator := NewOrderOchestrator(store, nil, time.Minute)
+			before := saveOrderWithStatus(t, store, "ORDER-1", test.statuses...)
+			if test.securing {
+				defer orchestrator.claimPayment("ORDER-1")()
+			}
+
+			event := WebhookEvent{ID: "WH-1", EventType: test.eventType, Resource: json.RawMessage(
+				`{"id": "CAPTURE-2", "status": "COMPLETED", "supplementary_data": {"related_ids": {"order_id": "ORDER-1"}}}`)}
+			if err := orchestrator.processWebhookEvent(event); err != nil {
+				t.Fatalf("processWebhookEvent() error = %v", err)
+			}
+
+			order, err := store.GetOrder("ORDER-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if order.Status != test.wantStatus || order.CaptureID != test.wantCaptureID {
+				t.Errorf("order is %s with capture %q, want %s with capture %q", order.Status, order.CaptureID, test.wantStatus, test.wantCaptureID)
+			}
+			// Ignored events do not touch the order
+			if order.Status == before.Status && !order.UpdatedAt.Equal(before.UpdatedAt) {
+				t.Errorf("order updated at %s, want it left as saved at %s", order.UpdatedAt, before.UpdatedAt)
+			}
+		})
+	}
+}
+
+func TestProcessWebhookEventUnknownOrder(t *testing.T) {
+	store, _ := openTestStore(t)
+	orchestrator := NewOrderOchestrator(store, nil, time.Minute)
+
+	for _, eventType := range []string{EventCaptureCompleted, EventCaptureDenied} {
+		event := WebhookEvent{ID: "WH-1", EventType: eventType, Resource: json.RawMessage(
+			`{"id": "CAPTURE-2", "supplementary_data": {"related_ids": {"order_id": "UNKNOWN"}}}`)}
+		// Delivering the event again would not help
+		if err := orchestrator.processWebhookEvent(event); err != nil {
+			t.Errorf("processWebhookEvent(%s) error = %v, want nil", eventType, err)
+		}
+	}
+}
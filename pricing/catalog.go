@@ -0,0 +1,287 @@
+package pricing
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Catalog currency used when none is configured
+const DefaultCurrency = "EUR"
+
+var currencyCodePattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// PriceCatalog holds every price applied when an order is calculated.
+// Storage tiers are optional, storage is charged linearly at its unit
+// price when they are not set. Prices are expressed in the catalog
+// currency, other currencies are priced with an explicit price list or
+// converted with the exchange rate table.
+type PriceCatalog struct {
+	Currency               string          `json:"currency"`
+	Basic                  Decimal         `json:"basic"`
+	ImageStorage           Decimal         `json:"img_storage_price_unit"`
+	ImageStorageTiers      *StoragePricing `json:"img_storage_tiers,omitempty"`
+	MonitoringOption       Decimal         `json:"monitoring_option"`
+	MonitoringStorage      Decimal         `json:"monitoring_storage_price_unit"`
+	MonitoringStorageTiers *StoragePricing `json:"monitoring_storage_tiers,omitempty"`
+	AlertingOption         Decimal         `json:"alerting_option"`
+
+	PriceLists    map[string]*PriceCatalog `json:"price_lists,omitempty"`
+	ExchangeRates *ExchangeRates           `json:"exchange_rates,omitempty"`
+
+	exchangeRateDate string // Snapshot date of the rate used to convert this catalog
+}
+
+// PriceList is the catalog as exposed to the clients
+type PriceList struct {
+	Currency               string           `json:"currency"`
+	ExchangeRateDate       string           `json:"exchange_rate_date,omitempty"`
+	Basic                  Money            `json:"basic"`
+	ImageStorage           Money            `json:"img_storage_price_unit"`
+	ImageStorageTiers      StoragePriceList `json:"img_storage_tiers"`
+	MonitoringOption       Money            `json:"monitoring_option"`
+	MonitoringStorage      Money            `json:"monitoring_storage_price_unit"`
+	MonitoringStorageTiers StoragePriceList `json:"monitoring_storage_tiers"`
+	AlertingOption         Money            `json:"alerting_option"`
+}
+
+// CatalogStore keeps the configured catalog and allows to reload it
+// without restarting the service
+type CatalogStore struct {
+	filePath string
+	catalog  *PriceCatalog
+	mutex    sync.RWMutex
+}
+
+// ===================================================================
+// Returns the catalog used when nothing has been configured
+//
+// Return
+//
+//	(*PriceCatalog) : Catalog containing the historical prices
+//
+// ===================================================================
+func DefaultCatalog() *PriceCatalog {
+	return &PriceCatalog{
+		Currency:          DefaultCurrency,
+		Basic:             NewDecimalFromInt(20),
+		ImageStorage:      NewDecimalFromInt(1),
+		MonitoringOption:  NewDecimalFromInt(5),
+		MonitoringStorage: NewDecimalFromInt(1),
+		AlertingOption:    NewDecimalFromInt(5),
+	}
+}
+
+// ===================================================================
+// Checks that every price of the catalog can be applied to an order
+//
+// Used on:
+//
+//	(*PriceCatalog) c : Catalog to validate
+//
+// Return
+//
+//	(error) : First invalid price found or nil if the catalog is valid
+//
+// ===================================================================
+func (c *PriceCatalog) Validate() error {
+	if !currencyCodePattern.MatchString(c.Currency) {
+		return fmt.Errorf("invalid catalog currency %q", c.Currency)
+	}
+
+	prices := map[string]Decimal{
+		"basic":                         c.Basic,
+		"img_storage_price_unit":        c.ImageStorage,
+		"monitoring_option":             c.MonitoringOption,
+		"monitoring_storage_price_unit": c.MonitoringStorage,
+		"alerting_option":               c.AlertingOption,
+	}
+	for name, price := range prices {
+		if price.IsNegative() {
+			return fmt.Errorf("price %s can not be negative (%s)", name, price)
+		}
+	}
+	if c.Basic == 0 {
+		return errors.New("price basic must be set")
+	}
+
+	if err := c.imageStoragePricing().Validate(); err != nil {
+		return fmt.Errorf("invalid img_storage_tiers: %w", err)
+	}
+	if err := c.monitoringStoragePricing().Validate(); err != nil {
+		return fmt.Errorf("invalid monitoring_storage_tiers: %w", err)
+	}
+
+	for currency, priceList := range c.PriceLists {
+		if len(priceList.PriceLists) > 0 || priceList.ExchangeRates != nil {
+			return fmt.Errorf("price list %s can not contain other currencies", currency)
+		}
+		if err := priceList.Validate(); err != nil {
+			return fmt.Errorf("invalid price list %s: %w", currency, err)
+		}
+	}
+	if c.ExchangeRates != nil {
+		if err := c.ExchangeRates.Validate(); err != nil {
+			return fmt.Errorf("invalid exchange_rates: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// normalize upper-cases currency codes and sets the default tier mode
+func (c *PriceCatalog) normalize() {
+	c.Currency = strings.ToUpper(c.Currency)
+	for _, tiers := range []*StoragePricing{c.ImageStorageTiers, c.MonitoringStorageTiers} {
+		if tiers != nil && tiers.Mode == "" {
+			tiers.Mode = TierGraduated
+		}
+	}
+
+	priceLists := make(map[string]*PriceCatalog, len(c.PriceLists))
+	for currency, priceList := range c.PriceLists {
+		currency = strings.ToUpper(currency)
+		priceList.Currency = currency
+		priceList.normalize()
+		priceLists[currency] = priceList
+	}
+	c.PriceLists = priceLists
+
+	if c.ExchangeRates != nil {
+		rates := make(map[string]Decimal, len(c.ExchangeRates.Rates))
+		for currency, rate := range c.ExchangeRates.Rates {
+			rates[strings.ToUpper(currency)] = rate
+		}
+		c.ExchangeRates.Rates = rates
+	}
+}
+
+// imageStoragePricing returns the configured image storage tiers, or a
+// single tier charging the unit price
+func (c *PriceCatalog) imageStoragePricing() StoragePricing {
+	if c.ImageStorageTiers != nil {
+		return *c.ImageStorageTiers
+	}
+	return flatStoragePricing(c.ImageStorage)
+}
+
+// monitoringStoragePricing returns the configured monitoring storage
+// tiers, or a single tier charging the unit price
+func (c *PriceCatalog) monitoringStoragePricing() StoragePricing {
+	if c.MonitoringStorageTiers != nil {
+		return *c.MonitoringStorageTiers
+	}
+	return flatStoragePricing(c.MonitoringStorage)
+}
+
+// PriceList returns every price of the catalog in the catalog currency.
+// Use ForCurrency first to get the prices of another currency.
+func (c *PriceCatalog) PriceList() PriceList {
+	return PriceList{
+		Currency:               c.Currency,
+		ExchangeRateDate:       c.exchangeRateDate,
+		Basic:                  NewMoney(c.Basic, c.Currency),
+		ImageStorage:           NewMoney(c.ImageStorage, c.Currency),
+		ImageStorageTiers:      c.imageStoragePricing().PriceList(c.Currency),
+		MonitoringOption:       NewMoney(c.MonitoringOption, c.Currency),
+		MonitoringStorage:      NewMoney(c.MonitoringStorage, c.Currency),
+		MonitoringStorageTiers: c.monitoringStoragePricing().PriceList(c.Currency),
+		AlertingOption:         NewMoney(c.AlertingOption, c.Currency),
+	}
+}
+
+// ===================================================================
+// Creates a catalog store and loads the catalog a first time.
+// The catalog is read from filePath when given, then from the
+// "price_catalog" environment variable (JSON). The default catalog
+// is used when none of them is configured.
+//
+// Parameters:
+//
+//	(string) filePath : Path to a JSON catalog file, may be empty
+//
+// Return
+//
+//	(*CatalogStore) : Store containing the loaded catalog
+//	(error) : Error while loading the catalog or nil if no error occurs
+//
+// Example:
+//
+//	store, err := NewCatalogStore("/etc/web-billing/prices.json")
+//
+// ===================================================================
+func NewCatalogStore(filePath string) (*CatalogStore, error) {
+	store := &CatalogStore{filePath: filePath}
+
+	if _, err := store.Reload(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Current returns the catalog currently in use
+func (s *CatalogStore) Current() *PriceCatalog {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.catalog
+}
+
+// ===================================================================
+// Reads the catalog again from its source. The catalog in use is
+// only replaced when the new one is valid.
+//
+// Used on:
+//
+//	(*CatalogStore) s : Store to reload
+//
+// Return
+//
+//	(*PriceCatalog) : Catalog now in use
+//	(error) : Error while reading or validating the catalog
+//
+// ===================================================================
+func (s *CatalogStore) Reload() (*PriceCatalog, error) {
+	catalog, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	if err := catalog.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid price catalog: %w", err)
+	}
+
+	s.mutex.Lock()
+	s.catalog = catalog
+	s.mutex.Unlock()
+
+	return catalog, nil
+}
+
+func (s *CatalogStore) load() (*PriceCatalog, error) {
+	var content []byte
+
+	if s.filePath != "" {
+		fileContent, err := os.ReadFile(s.filePath)
+		if err != nil {
+			return nil, fmt.Errorf("could not read price catalog file: %w", err)
+		}
+		content = fileContent
+	} else if envCatalog := os.Getenv("price_catalog"); envCatalog != "" {
+		content = []byte(envCatalog)
+	} else {
+		return DefaultCatalog(), nil
+	}
+
+	catalog := &PriceCatalog{Currency: DefaultCurrency}
+	if err := json.Unmarshal(content, catalog); err != nil {
+		return nil, fmt.Errorf("could not parse price catalog: %w", err)
+	}
+	catalog.normalize()
+
+	return catalog, nil
+}
@@ -0,0 +1,64 @@
+package pricing
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeCatalog(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCatalogStoreReload(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string // Catalog file content, file removed if empty
+		wantErr bool
+	}{
+		{name: "valid catalog", content: `{"basic": 25, "img_storage_price_unit": 2}`},
+		{name: "negative price", content: `{"basic": 25, "monitoring_option": -5}`, wantErr: true},
+		{name: "missing basic price", content: `{"img_storage_price_unit": 2}`, wantErr: true},
+		{name: "not JSON", content: `basic: 25`, wantErr: true},
+		{name: "missing file", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "prices.json")
+			writeCatalog(t, path, `{"basic": 20, "img_storage_price_unit": 1}`)
+			store, err := NewCatalogStore(path)
+			if err != nil {
+				t.Fatalf("NewCatalogStore() error = %v", err)
+			}
+			previous := store.Current()
+
+			if test.content == "" {
+				os.Remove(path)
+			} else {
+				writeCatalog(t, path, test.content)
+			}
+			reloaded, err := store.Reload()
+
+			if test.wantErr {
+				// The catalog in use is kept when the new one can not be applied
+				if err == nil {
+					t.Fatalf("Reload() = %+v, want an error", reloaded)
+				}
+				if store.Current() != previous {
+					t.Errorf("Current() = %+v, want the previous catalog %+v", store.Current(), previous)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Reload() error = %v", err)
+			}
+			if store.Current() != reloaded || reloaded == previous {
+				t.Errorf("Current() = %+v, want the reloaded catalog %+v", store.Current(), reloaded)
+			}
+		})
+	}
+}
@@ -0,0 +1,320 @@
+package pricing
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Kinds of discount a coupon can give
+const (
+	CouponPercentage = "percentage"
+	CouponFixed      = "fixed"
+)
+
+// Code of the discount line of a quote
+const LineDiscount = "discount"
+
+var (
+	ErrCouponNotFound      = errors.New("unknown coupon code")
+	ErrCouponNotActive     = errors.New("coupon is not valid at this date")
+	ErrCouponExhausted     = errors.New("coupon has reached its maximum number of redemptions")
+	ErrCouponUserLimit     = errors.New("coupon has already been used by this user")
+	ErrCouponNotApplicable = errors.New("coupon does not apply to this order")
+)
+
+// Coupon is a promotion code giving a discount on an order
+type Coupon struct {
+	Code           string    `json:"code"`
+	Type           string    `json:"type"`                 // "percentage" or "fixed"
+	Value          Decimal   `json:"value"`                // e.g. "10" for 10% or "5.00" for a fixed discount
+	Currency       string    `json:"currency,omitempty"`   // Currency of fixed discounts
+	ValidFrom      time.Time `json:"valid_from,omitempty"` // Zero means no start date
+	ValidUntil     time.Time `json:"valid_until,omitempty"`
+	MaxRedemptions int       `json:"max_redemptions"` // 0 means unlimited
+	MaxPerUser     int       `json:"max_per_user"`    // 0 means unlimited
+	AppliesTo      []string  `json:"applies_to"`      // Quote line codes, empty means the whole order
+}
+
+// RedemptionStore persists the number of redemptions of each coupon,
+// so the limits of the coupons survive a restart of the service
+type RedemptionStore interface {
+	// CouponRedemptions returns the redemptions of a coupon, in total and by a user
+	CouponRedemptions(code string, userID string) (total int, byUser int, err error)
+	// RedeemCoupon counts a redemption if check accepts the current counters, atomically
+	RedeemCoupon(code string, userID string, check func(total int, byUser int) error) error
+	// ReleaseCoupon cancels a redemption
+	ReleaseCoupon(code string, userID string) error
+}
+
+// CouponBook holds the configured coupons, their redemptions are counted in a RedemptionStore
+type CouponBook struct {
+	coupons     map[string]*Coupon
+	redemptions RedemptionStore
+}
+
+// ===================================================================
+// Loads the coupons from a JSON file containing a list of coupons.
+// An empty book is returned when no file is given.
+//
+// Parameters:
+//
+//	(string) filePath : Path to a JSON coupons file, may be empty
+//	(RedemptionStore) redemptions : Store counting the redemptions
+//
+// Return
+//
+//	(*CouponBook) : Book containing the validated coupons
+//	(error) : Error while reading or validating the coupons
+//
+// Example:
+//
+//	coupons, err := LoadCouponBook("/etc/web-billing/coupons.json", store)
+//
+// ===================================================================
+func LoadCouponBook(filePath string, redemptions RedemptionStore) (*CouponBook, error) {
+	book := &CouponBook{
+		coupons:     make(map[string]*Coupon),
+		redemptions: redemptions,
+	}
+	if filePath == "" {
+		return book, nil
+	}
+
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read coupons file: %w", err)
+	}
+
+	var coupons []*Coupon
+	if err := json.Unmarshal(content, &coupons); err != nil {
+		return nil, fmt.Errorf("could not parse coupons: %w", err)
+	}
+
+	for _, coupon := range coupons {
+		coupon.Code = NormalizeCouponCode(coupon.Code)
+		coupon.Currency = strings.ToUpper(coupon.Currency)
+
+		if err := coupon.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid coupon %q: %w", coupon.Code, err)
+		}
+		if _, exists := book.coupons[coupon.Code]; exists {
+			return nil, fmt.Errorf("duplicated coupon %q", coupon.Code)
+		}
+		book.coupons[coupon.Code] = coupon
+	}
+
+	return book, nil
+}
+
+// Validate checks that the coupon can be applied to an order
+func (c *Coupon) Validate() error {
+	if c.Code == "" {
+		return errors.New("code must be set")
+	}
+
+	switch c.Type {
+	case CouponPercentage:
+		if c.Value <= 0 || c.Value > NewDecimalFromInt(100) {
+			return fmt.Errorf("percentage must be between 0 and 100 (%s)", c.Value)
+		}
+	case CouponFixed:
+		if c.Value <= 0 {
+			return fmt.Errorf("fixed discount must be positive (%s)", c.Value)
+		}
+		if !currencyCodePattern.MatchString(c.Currency) {
+			return fmt.Errorf("invalid currency %q for fixed discount", c.Currency)
+		}
+	default:
+		return fmt.Errorf("unknown coupon type %q", c.Type)
+	}
+
+	if !c.ValidUntil.IsZero() && c.ValidUntil.Before(c.ValidFrom) {
+		return errors.New("valid_until is before valid_from")
+	}
+	if c.MaxRedemptions < 0 || c.MaxPerUser < 0 {
+		return errors.New("redemption limits can not be negative")
+	}
+
+	for _, code := range c.AppliesTo {
+		switch code {
+		case LineBasic, LineImageStorage, LineMonitoringOption, LineMonitoringStorage, LineAlertingOption:
+		default:
+			return fmt.Errorf("unknown line %q in applies_to", code)
+		}
+	}
+
+	return nil
+}
+
+// ===================================================================
+// Returns the coupon matching a code if it can still be used by the
+// user at the given date. The coupon is not redeemed.
+//
+// Parameters:
+//
+//	(string) code : Coupon code sent by the client
+//	(string) userID : ID of the user ordering
+//	(time.Time) now : Date of the order
+//
+// Used on:
+//
+//	(*CouponBook) b : Book containing the configured coupons
+//
+// Return
+//
+//	(*Coupon) : Coupon to apply
+//	(error) : ErrCouponNotFound, ErrCouponNotActive, ErrCouponExhausted, ErrCouponUserLimit
+//		or a store error
+//
+// ===================================================================
+func (b *CouponBook) Find(code string, userID string, now time.Time) (*Coupon, error) {
+	coupon, err := b.activeCoupon(NormalizeCouponCode(code), now)
+	if err != nil {
+		return nil, err
+	}
+
+	total, byUser, err := b.redemptions.CouponRedemptions(coupon.Code, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := coupon.checkLimits(total, byUser); err != nil {
+		return nil, err
+	}
+
+	return coupon, nil
+}
+
+// ===================================================================
+// Counts a redemption of a coupon for a user, after checking again
+// that the coupon can still be used. The redemption is released by the
+// order store once the order ends unpaid (see ReleaseCoupon).
+//
+// Parameters:
+//
+//	(string) code : Coupon code sent by the client
+//	(string) userID : ID of the user ordering
+//	(time.Time) now : Date of the order
+//
+// Used on:
+//
+//	(*CouponBook) b : Book containing the configured coupons
+//
+// Return
+//
+//	(error) : Same errors as Find
+//
+// ===================================================================
+func (b *CouponBook) Redeem(code string, userID string, now time.Time) error {
+	coupon, err := b.activeCoupon(NormalizeCouponCode(code), now)
+	if err != nil {
+		return err
+	}
+
+	return b.redemptions.RedeemCoupon(coupon.Code, userID, coupon.checkLimits)
+}
+
+// Release cancels a redemption, e.g. when the order could not be created
+func (b *CouponBook) Release(code string, userID string) error {
+	return b.redemptions.ReleaseCoupon(NormalizeCouponCode(code), userID)
+}
+
+// activeCoupon returns the coupon of a normalized code if it is valid at the given date
+func (b *CouponBook) activeCoupon(code string, now time.Time) (*Coupon, error) {
+	coupon, ok := b.coupons[code]
+	if !ok {
+		return nil, ErrCouponNotFound
+	}
+	if (!coupon.ValidFrom.IsZero() && now.Before(coupon.ValidFrom)) ||
+		(!coupon.ValidUntil.IsZero() && now.After(coupon.ValidUntil)) {
+		return nil, ErrCouponNotActive
+	}
+
+	return coupon, nil
+}
+
+// checkLimits checks the redemption limits of the coupon against its counters
+func (c *Coupon) checkLimits(total int, byUser int) error {
+	if c.MaxRedemptions > 0 && total >= c.MaxRedemptions {
+		return ErrCouponExhausted
+	}
+	if c.MaxPerUser > 0 && byUser >= c.MaxPerUser {
+		return ErrCouponUserLimit
+	}
+
+	return nil
+}
+
+// appliesTo reports whether the coupon gives a discount on a quote line
+func (c *Coupon) appliesTo(lineCode string) bool {
+	if len(c.AppliesTo) == 0 {
+		return true
+	}
+	for _, code := range c.AppliesTo {
+		if code == lineCode {
+			return true
+		}
+	}
+	return false
+}
+
+// ===================================================================
+// Calculates the discount given by the coupon on the lines of a quote.
+// A fixed discount never exceeds the amount of the lines it applies to.
+//
+// Parameters:
+//
+//	(Quote) quote : Quote containing the lines of the order
+//
+// Used on:
+//
+//	(*Coupon) c : Coupon to apply
+//
+// Return
+//
+//	(*QuoteLine) : Discount line with a positive amount
+//	(error) : ErrCouponNotApplicable if no line can be discounted
+//
+// ===================================================================
+func (c *Coupon) discount(quote Quote) (*QuoteLine, error) {
+	eligible := NewMoney(0, quote.Subtotal.Currency)
+	for _, line := range quote.Lines {
+		if c.appliesTo(line.Code) {
+			eligible = eligible.Add(line.Amount)
+		}
+	}
+	if eligible.Amount <= 0 {
+		return nil, ErrCouponNotApplicable
+	}
+
+	var amount Money
+	switch c.Type {
+	case CouponPercentage:
+		rate := c.Value.Mul(Decimal(decimalScale / 100))
+		amount = NewMoney(eligible.Amount.Mul(rate), eligible.Currency).Round()
+	case CouponFixed:
+		if c.Currency != eligible.Currency {
+			return nil, fmt.Errorf("%w: coupon currency is %s", ErrCouponNotApplicable, c.Currency)
+		}
+		amount = NewMoney(c.Value, c.Currency).Round()
+		if amount.Amount > eligible.Amount {
+			amount = eligible
+		}
+	}
+
+	return &QuoteLine{
+		Code:        LineDiscount,
+		Description: "Coupon " + c.Code,
+		Quantity:    1,
+		UnitPrice:   amount,
+		Amount:      amount,
+	}, nil
+}
+
+// NormalizeCouponCode returns the code under which a coupon is stored
+func NormalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
@@ -0,0 +1,106 @@
+package pricing
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// memoryRedemptions is a RedemptionStore kept in memory
+type memoryRedemptions struct {
+	total  map[string]int
+	byUser map[string]map[string]int
+}
+
+func newMemoryRedemptions() *memoryRedemptions {
+	return &memoryRedemptions{total: make(map[string]int), byUser: make(map[string]map[string]int)}
+}
+
+func (m *memoryRedemptions) CouponRedemptions(code string, userID string) (int, int, error) {
+	return m.total[code], m.byUser[code][userID], nil
+}
+
+func (m *memoryRedemptions) RedeemCoupon(code string, userID string, check func(int, int) error) error {
+	if err := check(m.total[code], m.byUser[code][userID]); err != nil {
+		return err
+	}
+	m.total[code]++
+	if m.byUser[code] == nil {
+		m.byUser[code] = make(map[string]int)
+	}
+	m.byUser[code][userID]++
+	return nil
+}
+
+func (m *memoryRedemptions) ReleaseCoupon(code string, userID string) error {
+	if m.total[code] > 0 {
+		m.total[code]--
+	}
+	if m.byUser[code][userID] > 0 {
+		m.byUser[code][userID]--
+	}
+	return nil
+}
+
+func loadTestCoupons(t *testing.T, content string) (*CouponBook, *memoryRedemptions) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "coupons.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	redemptions := newMemoryRedemptions()
+	book, err := LoadCouponBook(path, redemptions)
+	if err != nil {
+		t.Fatalf("LoadCouponBook() error = %v", err)
+	}
+	return book, redemptions
+}
+
+func TestCouponBookRedeem(t *testing.T) {
+	book, redemptions := loadTestCoupons(t, `[
+		{"code": "launch", "type": "percentage", "value": "10", "max_redemptions": 3, "max_per_user": 2,
+		 "valid_from": "2024-01-01T00:00:00Z", "valid_until": "2024-12-31T00:00:00Z"}
+	]`)
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	steps := []struct {
+		user    string
+		date    time.Time
+		release bool
+		wantErr error
+	}{
+		{user: "alice", date: now},
+		{user: "alice", date: now},
+		{user: "alice", date: now, wantErr: ErrCouponUserLimit},
+		{user: "bob", date: now},
+		{user: "carol", date: now, wantErr: ErrCouponExhausted},
+		{user: "alice", release: true},
+		{user: "carol", date: now},
+		{user: "dave", date: now.AddDate(1, 0, 0), wantErr: ErrCouponNotActive},
+	}
+	for i, step := range steps {
+		if step.release {
+			if err := book.Release(" Launch ", step.user); err != nil {
+				t.Fatalf("step %d: Release() error = %v", i, err)
+			}
+			continue
+		}
+		// Codes are case insensitive
+		err := book.Redeem(" Launch ", step.user, step.date)
+		if !errors.Is(err, step.wantErr) {
+			t.Fatalf("step %d: Redeem(%s) error = %v, want %v", i, step.user, err, step.wantErr)
+		}
+	}
+
+	if redemptions.total["LAUNCH"] != 3 {
+		t.Errorf("total redemptions = %d, want 3", redemptions.total["LAUNCH"])
+	}
+	if _, err := book.Find("launch", "erin", now); !errors.Is(err, ErrCouponExhausted) {
+		t.Errorf("Find() error = %v, want %v", err, ErrCouponExhausted)
+	}
+	if _, err := book.Find("unknown", "erin", now); !errors.Is(err, ErrCouponNotFound) {
+		t.Errorf("Find() error = %v, want %v", err, ErrCouponNotFound)
+	}
+}
@@ -0,0 +1,125 @@
+package pricing
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrUnsupportedCurrency = errors.New("unsupported currency")
+
+// ExchangeRates converts the catalog base currency into other currencies
+type ExchangeRates struct {
+	SnapshotDate string             `json:"snapshot_date"` // e.g. "2024-03-01"
+	Rates        map[string]Decimal `json:"rates"`         // e.g. "USD": "1.08" for 1 base = 1.08 USD
+}
+
+// Validate checks the snapshot date and that every rate is positive
+func (r *ExchangeRates) Validate() error {
+	if _, err := time.Parse(time.DateOnly, r.SnapshotDate); err != nil {
+		return fmt.Errorf("invalid snapshot_date %q", r.SnapshotDate)
+	}
+	for currency, rate := range r.Rates {
+		if !currencyCodePattern.MatchString(currency) {
+			return fmt.Errorf("invalid currency %q", currency)
+		}
+		if rate <= 0 {
+			return fmt.Errorf("rate of %s must be positive (%s)", currency, rate)
+		}
+	}
+
+	return nil
+}
+
+// SupportedCurrencies returns every currency orders can be paid in, sorted
+func (c *PriceCatalog) SupportedCurrencies() []string {
+	currencies := []string{c.Currency}
+	for currency := range c.PriceLists {
+		currencies = append(currencies, currency)
+	}
+	if c.ExchangeRates != nil {
+		for currency := range c.ExchangeRates.Rates {
+			if _, explicit := c.PriceLists[currency]; !explicit && currency != c.Currency {
+				currencies = append(currencies, currency)
+			}
+		}
+	}
+	sort.Strings(currencies)
+
+	return currencies
+}
+
+// ===================================================================
+// Returns the catalog to apply for orders paid in a currency.
+// Explicit price lists are used first, then prices are converted from
+// the base currency with the exchange rate table. Converted prices are
+// rounded to the minor units of the currency.
+//
+// Parameters:
+//
+//	(string) currency : ISO 4217 code of the currency, base currency if empty
+//
+// Used on:
+//
+//	(*PriceCatalog) c : Catalog expressed in the base currency
+//
+// Return
+//
+//	(*PriceCatalog) : Catalog expressed in the requested currency
+//	(error) : ErrUnsupportedCurrency if the currency has no price list nor rate
+//
+// Example:
+//
+//	usdCatalog, err := catalog.ForCurrency("USD")
+//
+// ===================================================================
+func (c *PriceCatalog) ForCurrency(currency string) (*PriceCatalog, error) {
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+
+	if currency == "" || currency == c.Currency {
+		return c, nil
+	}
+	if priceList, ok := c.PriceLists[currency]; ok {
+		return priceList, nil
+	}
+	if c.ExchangeRates != nil {
+		if rate, ok := c.ExchangeRates.Rates[currency]; ok {
+			return c.convert(currency, rate), nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w %q, supported currencies are %s",
+		ErrUnsupportedCurrency, currency, strings.Join(c.SupportedCurrencies(), ", "))
+}
+
+// convert returns the base prices of the catalog converted with a rate
+func (c *PriceCatalog) convert(currency string, rate Decimal) *PriceCatalog {
+	places := MinorUnits(currency)
+	convert := func(price Decimal) Decimal {
+		return price.Mul(rate).Round(places)
+	}
+	convertTiers := func(pricing *StoragePricing) *StoragePricing {
+		if pricing == nil {
+			return nil
+		}
+		converted := &StoragePricing{Mode: pricing.Mode}
+		for _, tier := range pricing.Tiers {
+			converted.Tiers = append(converted.Tiers, PriceTier{UpTo: tier.UpTo, UnitPrice: convert(tier.UnitPrice)})
+		}
+		return converted
+	}
+
+	return &PriceCatalog{
+		Currency:               currency,
+		Basic:                  convert(c.Basic),
+		ImageStorage:           convert(c.ImageStorage),
+		ImageStorageTiers:      convertTiers(c.ImageStorageTiers),
+		MonitoringOption:       convert(c.MonitoringOption),
+		MonitoringStorage:      convert(c.MonitoringStorage),
+		MonitoringStorageTiers: convertTiers(c.MonitoringStorageTiers),
+		AlertingOption:         convert(c.AlertingOption),
+		exchangeRateDate:       c.ExchangeRates.SnapshotDate,
+	}
+}
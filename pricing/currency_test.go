@@ -0,0 +1,128 @@
+package pricing
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// loadTestCatalog loads a EUR catalog with a GBP price list and USD, JPY and GBP rates
+func loadTestCatalog(t *testing.T) *PriceCatalog {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "prices.json")
+	writeCatalog(t, path, `{
+		"currency": "eur",
+		"basic": "19.99",
+		"img_storage_price_unit": "1",
+		"img_storage_tiers": {"tiers": [{"up_to": 100, "unit_price": "1"}, {"up_to": 0, "unit_price": "0.5"}]},
+		"price_lists": {"gbp": {"basic": "17", "img_storage_price_unit": "0.9"}},
+		"exchange_rates": {"snapshot_date": "2024-03-01", "rates": {"usd": "1.0837", "JPY": "162.35", "GBP": "0.85"}}
+	}`)
+	store, err := NewCatalogStore(path)
+	if err != nil {
+		t.Fatalf("NewCatalogStore() error = %v", err)
+	}
+	return store.Current()
+}
+
+func TestForCurrency(t *testing.T) {
+	catalog := loadTestCatalog(t)
+
+	tests := []struct {
+		currency     string
+		wantCurrency string
+		wantBasic    string
+		wantStorage  string
+		wantTiers    []string
+		wantRateDate string
+		wantErr      error
+	}{
+		{currency: "", wantCurrency: "EUR", wantBasic: "19.99", wantStorage: "1", wantTiers: []string{"1", "0.5"}},
+		{currency: " eur ", wantCurrency: "EUR", wantBasic: "19.99", wantStorage: "1", wantTiers: []string{"1", "0.5"}},
+		// The explicit price list wins over the exchange rate
+		{currency: "GBP", wantCurrency: "GBP", wantBasic: "17", wantStorage: "0.9"},
+		// 19.99 * 1.0837 = 21.663163 and 0.5 * 1.0837 = 0.54185, rounded to cents
+		{currency: "usd", wantCurrency: "USD", wantBasic: "21.66", wantStorage: "1.08", wantTiers: []string{"1.08", "0.54"}, wantRateDate: "2024-03-01"},
+		// 19.99 * 162.35 = 3245.3765 and 0.5 * 162.35 = 81.175, JPY has no minor unit
+		{currency: "JPY", wantCurrency: "JPY", wantBasic: "3245", wantStorage: "162", wantTiers: []string{"162", "81"}, wantRateDate: "2024-03-01"},
+		{currency: "CHF", wantErr: ErrUnsupportedCurrency},
+	}
+
+	for _, test := range tests {
+		converted, err := catalog.ForCurrency(test.currency)
+		if !errors.Is(err, test.wantErr) {
+			t.Errorf("ForCurrency(%q) error = %v, want %v", test.currency, err, test.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		var tiers []string
+		if converted.ImageStorageTiers != nil {
+			for _, tier := range converted.ImageStorageTiers.Tiers {
+				tiers = append(tiers, tier.UnitPrice.String())
+			}
+		}
+		if converted.Currency != test.wantCurrency ||
+			converted.Basic.String() != test.wantBasic ||
+			converted.ImageStorage.String() != test.wantStorage ||
+			!reflect.DeepEqual(tiers, test.wantTiers) {
+			t.Errorf("ForCurrency(%q) = %s %s, storage %s, tiers %v, want %s %s, storage %s, tiers %v", test.currency,
+				converted.Currency, converted.Basic, converted.ImageStorage, tiers,
+				test.wantCurrency, test.wantBasic, test.wantStorage, test.wantTiers)
+		}
+		if date := converted.PriceList().ExchangeRateDate; date != test.wantRateDate {
+			t.Errorf("ForCurrency(%q) exchange rate date = %q, want %q", test.currency, date, test.wantRateDate)
+		}
+	}
+
+	// Conversions leave the base catalog untouched
+	if catalog.Basic.String() != "19.99" || catalog.ImageStorageTiers.Tiers[1].UnitPrice.String() != "0.5" {
+		t.Errorf("base catalog changed to %s, tiers %+v", catalog.Basic, catalog.ImageStorageTiers.Tiers)
+	}
+}
+
+func TestSupportedCurrencies(t *testing.T) {
+	if currencies := loadTestCatalog(t).SupportedCurrencies(); !reflect.DeepEqual(currencies, []string{"EUR", "GBP", "JPY", "USD"}) {
+		t.Errorf("SupportedCurrencies() = %v, want [EUR GBP JPY USD]", currencies)
+	}
+	if currencies := DefaultCatalog().SupportedCurrencies(); !reflect.DeepEqual(currencies, []string{"EUR"}) {
+		t.Errorf("SupportedCurrencies() = %v, want [EUR]", currencies)
+	}
+}
+
+func TestExchangeRatesValidate(t *testing.T) {
+	rate := mustParseDecimal(t, "1.08")
+
+	tests := []struct {
+		name    string
+		rates   ExchangeRates
+		wantErr bool
+	}{
+		{name: "valid", rates: ExchangeRates{SnapshotDate: "2024-03-01", Rates: map[string]Decimal{"USD": rate}}},
+		{name: "no rate", rates: ExchangeRates{SnapshotDate: "2024-03-01"}},
+		{name: "invalid date", rates: ExchangeRates{SnapshotDate: "01/03/2024"}, wantErr: true},
+		{name: "missing date", rates: ExchangeRates{Rates: map[string]Decimal{"USD": rate}}, wantErr: true},
+		{name: "invalid currency", rates: ExchangeRates{SnapshotDate: "2024-03-01", Rates: map[string]Decimal{"DOLLAR": rate}}, wantErr: true},
+		{name: "zero rate", rates: ExchangeRates{SnapshotDate: "2024-03-01", Rates: map[string]Decimal{"USD": 0}}, wantErr: true},
+		{name: "negative rate", rates: ExchangeRates{SnapshotDate: "2024-03-01", Rates: map[string]Decimal{"USD": -rate}}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		if err := test.rates.Validate(); (err != nil) != test.wantErr {
+			t.Errorf("%s: Validate() error = %v, want error %v", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestCatalogNestedPriceList(t *testing.T) {
+	catalog := DefaultCatalog()
+	catalog.PriceLists = map[string]*PriceCatalog{
+		"USD": {Currency: "USD", Basic: mustParseDecimal(t, "22"), PriceLists: map[string]*PriceCatalog{"GBP": DefaultCatalog()}},
+	}
+	if err := catalog.Validate(); err == nil {
+		t.Error("Validate() accepted a price list containing other price lists")
+	}
+}
@@ -0,0 +1,278 @@
+package pricing
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Decimal is a fixed-point number holding six fractional digits.
+// e.g. Decimal(1500000) is 1.5
+type Decimal int64
+
+const (
+	decimalPlaces = 6
+	decimalScale  = 1000000
+)
+
+// Number of digits after the decimal separator for each currency.
+// Currencies not listed here use 2 digits.
+var currencyMinorUnits = map[string]int{
+	"BHD": 3,
+	"CLP": 0,
+	"HUF": 0,
+	"ISK": 0,
+	"JOD": 3,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+	"OMR": 3,
+	"TND": 3,
+	"TWD": 0,
+	"VND": 0,
+}
+
+// Money is an amount expressed in a given currency
+type Money struct {
+	Amount   Decimal
+	Currency string
+}
+
+// jsonMoney is the representation of Money used by our API and Paypal
+type jsonMoney struct {
+	Currency string `json:"currency_code"`
+	Value    string `json:"value"`
+}
+
+// NewDecimalFromInt returns the decimal value of an integer
+func NewDecimalFromInt(value int64) Decimal {
+	return Decimal(value * decimalScale)
+}
+
+// ===================================================================
+// Parses a decimal number written with a dot as separator
+//
+// Parameters:
+//
+//	(string) value : Number to parse, e.g. "9.99" or "-0.5"
+//
+// Return
+//
+//	(Decimal) : Parsed number
+//	(error) : Error if the value is not a valid decimal number
+//
+// Example:
+//
+//	price, err := ParseDecimal("0.50")
+//
+// ===================================================================
+func ParseDecimal(value string) (Decimal, error) {
+	raw := strings.TrimSpace(value)
+	negative := strings.HasPrefix(raw, "-")
+	raw = strings.TrimPrefix(strings.TrimPrefix(raw, "-"), "+")
+
+	integerPart, fractionalPart, _ := strings.Cut(raw, ".")
+	if integerPart == "" && fractionalPart == "" {
+		return 0, fmt.Errorf("invalid decimal %q", value)
+	}
+	if len(fractionalPart) > decimalPlaces {
+		return 0, fmt.Errorf("invalid decimal %q: more than %d decimals", value, decimalPlaces)
+	}
+
+	digits := integerPart + fractionalPart + strings.Repeat("0", decimalPlaces-len(fractionalPart))
+	if strings.ContainsFunc(digits, func(r rune) bool { return r < '0' || r > '9' }) {
+		return 0, fmt.Errorf("invalid decimal %q", value)
+	}
+
+	parsed, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid decimal %q: %w", value, err)
+	}
+	if negative {
+		parsed = -parsed
+	}
+
+	return Decimal(parsed), nil
+}
+
+// Add returns d + other
+func (d Decimal) Add(other Decimal) Decimal {
+	return d + other
+}
+
+// Sub returns d - other
+func (d Decimal) Sub(other Decimal) Decimal {
+	return d - other
+}
+
+// MulInt returns d multiplied by an integer quantity
+func (d Decimal) MulInt(quantity int) Decimal {
+	return d * Decimal(quantity)
+}
+
+// Mul returns d * other, rounded half away from zero to six decimals
+func (d Decimal) Mul(other Decimal) Decimal {
+	product := new(big.Int).Mul(big.NewInt(int64(d)), big.NewInt(int64(other)))
+
+	return Decimal(divRound(product, big.NewInt(decimalScale)))
+}
+
+// Round rounds d half away from zero to the given number of decimals
+func (d Decimal) Round(places int) Decimal {
+	if places >= decimalPlaces {
+		return d
+	}
+	unit := pow10(decimalPlaces - places)
+	rounded := divRound(big.NewInt(int64(d)), big.NewInt(unit))
+
+	return Decimal(rounded * unit)
+}
+
+// IsNegative reports whether d is lower than zero
+func (d Decimal) IsNegative() bool {
+	return d < 0
+}
+
+// StringFixed formats d rounded with exactly the given number of decimals
+func (d Decimal) StringFixed(places int) string {
+	rounded := d.Round(places)
+	sign := ""
+	if rounded < 0 {
+		sign = "-"
+		rounded = -rounded
+	}
+
+	integerPart := int64(rounded) / decimalScale
+	if places <= 0 {
+		return fmt.Sprintf("%s%d", sign, integerPart)
+	}
+	if places > decimalPlaces {
+		places = decimalPlaces
+	}
+	fractionalPart := (int64(rounded) % decimalScale) / pow10(decimalPlaces-places)
+
+	return fmt.Sprintf("%s%d.%0*d", sign, integerPart, places, fractionalPart)
+}
+
+// String formats d without its trailing zeros, e.g. "0.5"
+func (d Decimal) String() string {
+	formatted := d.StringFixed(decimalPlaces)
+	formatted = strings.TrimRight(formatted, "0")
+
+	return strings.TrimSuffix(formatted, ".")
+}
+
+// MarshalJSON writes the decimal as a JSON string to keep its precision
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON accepts both JSON strings ("9.99") and numbers (9.99)
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	raw := strings.Trim(string(data), `"`)
+
+	parsed, err := ParseDecimal(raw)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+
+	return nil
+}
+
+// MinorUnits returns the number of decimals used by a currency
+func MinorUnits(currency string) int {
+	if units, ok := currencyMinorUnits[strings.ToUpper(currency)]; ok {
+		return units
+	}
+	return 2
+}
+
+// NewMoney returns an amount in the given currency
+func NewMoney(amount Decimal, currency string) Money {
+	return Money{Amount: amount, Currency: strings.ToUpper(currency)}
+}
+
+// Add returns the sum of two amounts expressed in the same currency
+func (m Money) Add(other Money) Money {
+	return Money{Amount: m.Amount.Add(other.Amount), Currency: m.Currency}
+}
+
+// Mul returns the amount multiplied by an integer quantity
+func (m Money) Mul(quantity int) Money {
+	return Money{Amount: m.Amount.MulInt(quantity), Currency: m.Currency}
+}
+
+// Round rounds the amount to the minor units of its currency
+func (m Money) Round() Money {
+	return Money{Amount: m.Amount.Round(MinorUnits(m.Currency)), Currency: m.Currency}
+}
+
+// MinorAmount returns the amount rounded to an integer number of minor units,
+// e.g. 1999 for 19.99 EUR
+func (m Money) MinorAmount() int64 {
+	places := MinorUnits(m.Currency)
+	return int64(m.Amount.Round(places)) / pow10(decimalPlaces-places)
+}
+
+// NewMoneyFromMinor returns an amount expressed in minor units, e.g. 1999 for 19.99 EUR
+func NewMoneyFromMinor(amount int64, currency string) Money {
+	return NewMoney(Decimal(amount*pow10(decimalPlaces-MinorUnits(currency))), currency)
+}
+
+// String formats the amount with the minor units of its currency,
+// e.g. "9.99" in EUR or "1000" in JPY. Unit prices more precise than
+// the minor units keep all their decimals, e.g. "0.005" in EUR.
+func (m Money) String() string {
+	places := MinorUnits(m.Currency)
+	if m.Amount.Round(places) != m.Amount {
+		return m.Amount.String()
+	}
+	return m.Amount.StringFixed(places)
+}
+
+// MarshalJSON writes the amount the way Paypal expects it,
+// e.g. {"currency_code": "EUR", "value": "9.99"}
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonMoney{Currency: m.Currency, Value: m.String()})
+}
+
+// UnmarshalJSON reads an amount written as {"currency_code": "EUR", "value": "9.99"}
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var parsed jsonMoney
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return err
+	}
+
+	amount, err := ParseDecimal(parsed.Value)
+	if err != nil {
+		return err
+	}
+	*m = NewMoney(amount, parsed.Currency)
+
+	return nil
+}
+
+// divRound divides a by b rounding half away from zero
+func divRound(a *big.Int, b *big.Int) int64 {
+	quotient, remainder := new(big.Int).QuoRem(a, b, new(big.Int))
+	if new(big.Int).Mul(new(big.Int).Abs(remainder), big.NewInt(2)).Cmp(new(big.Int).Abs(b)) >= 0 {
+		if a.Sign()*b.Sign() < 0 {
+			quotient.Sub(quotient, big.NewInt(1))
+		} else {
+			quotient.Add(quotient, big.NewInt(1))
+		}
+	}
+
+	return quotient.Int64()
+}
+
+func pow10(exponent int) int64 {
+	result := int64(1)
+	for i := 0; i < exponent; i++ {
+		result *= 10
+	}
+	return result
+}
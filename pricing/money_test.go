@@ -0,0 +1,188 @@
+package pricing
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func mustParseDecimal(t *testing.T, value string) Decimal {
+	t.Helper()
+	decimal, err := ParseDecimal(value)
+	if err != nil {
+		t.Fatalf("ParseDecimal(%q): %s", value, err)
+	}
+	return decimal
+}
+
+func TestParseDecimal(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    Decimal
+		wantErr bool
+	}{
+		{value: "9.99", want: 9990000},
+		{value: " 0.50 ", want: 500000},
+		{value: "+1.5", want: 1500000},
+		{value: "-.5", want: -500000},
+		{value: "12", want: 12000000},
+		{value: "0.000001", want: 1},
+		{value: "1.1234567", wantErr: true},
+		{value: "", wantErr: true},
+		{value: ".", wantErr: true},
+		{value: "abc", wantErr: true},
+		{value: "1.2.3", wantErr: true},
+		{value: "--1", wantErr: true},
+		{value: "1e3", wantErr: true},
+		{value: "99999999999999", wantErr: true},
+	}
+
+	for _, test := range tests {
+		decimal, err := ParseDecimal(test.value)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ParseDecimal(%q) error = %v, want error %v", test.value, err, test.wantErr)
+			continue
+		}
+		if decimal != test.want {
+			t.Errorf("ParseDecimal(%q) = %d, want %d", test.value, decimal, test.want)
+		}
+	}
+}
+
+// Rounding is half away from zero, on both signs
+func TestDecimalRound(t *testing.T) {
+	tests := []struct {
+		value  string
+		places int
+		want   string
+	}{
+		{value: "2.345", places: 2, want: "2.35"},
+		{value: "-2.345", places: 2, want: "-2.35"},
+		{value: "2.3449", places: 2, want: "2.34"},
+		{value: "0.005", places: 2, want: "0.01"},
+		{value: "0.004999", places: 2, want: "0"},
+		{value: "1000.5", places: 0, want: "1001"},
+		{value: "-1000.5", places: 0, want: "-1001"},
+		{value: "1.2345", places: 3, want: "1.235"},
+		{value: "1.234567", places: 6, want: "1.234567"},
+	}
+
+	for _, test := range tests {
+		if rounded := mustParseDecimal(t, test.value).Round(test.places).String(); rounded != test.want {
+			t.Errorf("Round(%s, %d) = %s, want %s", test.value, test.places, rounded, test.want)
+		}
+	}
+}
+
+func TestDecimalMul(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want string
+	}{
+		{a: "0.1", b: "0.1", want: "0.01"},
+		{a: "19.99", b: "0.2", want: "3.998"},
+		// Below the sixth digit the product is rounded as well
+		{a: "0.000001", b: "0.5", want: "0.000001"},
+		{a: "-0.000001", b: "0.5", want: "-0.000001"},
+		{a: "0.000001", b: "0.4", want: "0"},
+		{a: "100", b: "-0.2", want: "-20"},
+	}
+
+	for _, test := range tests {
+		if product := mustParseDecimal(t, test.a).Mul(mustParseDecimal(t, test.b)).String(); product != test.want {
+			t.Errorf("%s * %s = %s, want %s", test.a, test.b, product, test.want)
+		}
+	}
+}
+
+func TestDecimalStringFixed(t *testing.T) {
+	tests := []struct {
+		value  string
+		places int
+		want   string
+	}{
+		{value: "2.5", places: 2, want: "2.50"},
+		{value: "-0.125", places: 2, want: "-0.13"},
+		{value: "7", places: 0, want: "7"},
+		{value: "0.1", places: 8, want: "0.100000"},
+	}
+
+	for _, test := range tests {
+		if formatted := mustParseDecimal(t, test.value).StringFixed(test.places); formatted != test.want {
+			t.Errorf("StringFixed(%s, %d) = %s, want %s", test.value, test.places, formatted, test.want)
+		}
+	}
+}
+
+// Amounts are formatted with at least the minor units of their currency,
+// more precise amounts keep all their decimals until rounded
+func TestMoneyRound(t *testing.T) {
+	tests := []struct {
+		value       string
+		currency    string
+		wantString  string
+		wantRounded string
+	}{
+		{value: "9.99", currency: "EUR", wantString: "9.99", wantRounded: "9.99"},
+		{value: "10", currency: "eur", wantString: "10.00", wantRounded: "10.00"},
+		{value: "19.995", currency: "EUR", wantString: "19.995", wantRounded: "20.00"},
+		{value: "0.005", currency: "USD", wantString: "0.005", wantRounded: "0.01"},
+		{value: "1000.5", currency: "JPY", wantString: "1000.5", wantRounded: "1001"},
+		{value: "1.5", currency: "KWD", wantString: "1.500", wantRounded: "1.500"},
+		{value: "1.2345", currency: "KWD", wantString: "1.2345", wantRounded: "1.235"},
+	}
+
+	for _, test := range tests {
+		money := NewMoney(mustParseDecimal(t, test.value), test.currency)
+		if formatted := money.String(); formatted != test.wantString {
+			t.Errorf("%s %s String() = %s, want %s", test.value, test.currency, formatted, test.wantString)
+		}
+		if rounded := money.Round().String(); rounded != test.wantRounded {
+			t.Errorf("%s %s Round() = %s, want %s", test.value, test.currency, rounded, test.wantRounded)
+		}
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	encoded, err := json.Marshal(NewMoney(mustParseDecimal(t, "9.9"), "eur"))
+	if err != nil || string(encoded) != `{"currency_code":"EUR","value":"9.90"}` {
+		t.Fatalf("json.Marshal() = %s, %v", encoded, err)
+	}
+
+	var decoded Money
+	if err := json.Unmarshal([]byte(`{"currency_code": "usd", "value": "0.005"}`), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Currency != "USD" || decoded.Amount != mustParseDecimal(t, "0.005") {
+		t.Errorf("json.Unmarshal() = %s %s, want 0.005 USD", decoded, decoded.Currency)
+	}
+
+	if err := json.Unmarshal([]byte(`{"currency_code": "EUR", "value": "9,99"}`), &decoded); err == nil {
+		t.Error("json.Unmarshal() accepted a comma as decimal separator")
+	}
+}
+
+// Stripe amounts are integers of minor units
+func TestMoneyMinorAmount(t *testing.T) {
+	tests := []struct {
+		value     string
+		currency  string
+		wantMinor int64
+	}{
+		{value: "9.99", currency: "EUR", wantMinor: 999},
+		{value: "19.995", currency: "EUR", wantMinor: 2000},
+		{value: "0.005", currency: "USD", wantMinor: 1},
+		{value: "1000.5", currency: "JPY", wantMinor: 1001},
+		{value: "1.2345", currency: "KWD", wantMinor: 1235},
+		{value: "-2.345", currency: "EUR", wantMinor: -235},
+	}
+
+	for _, test := range tests {
+		money := NewMoney(mustParseDecimal(t, test.value), test.currency)
+		if minor := money.MinorAmount(); minor != test.wantMinor {
+			t.Errorf("%s %s MinorAmount() = %d, want %d", test.value, test.currency, minor, test.wantMinor)
+		}
+		if fromMinor := NewMoneyFromMinor(test.wantMinor, test.currency); fromMinor != money.Round() {
+			t.Errorf("NewMoneyFromMinor(%d, %s) = %s, want %s", test.wantMinor, test.currency, fromMinor, money.Round())
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package pricing
+
+import (
+	"fmt"
+
+	oko "github.com/OneKonsole/order-model"
+)
+
+// Codes identifying each line of a quote
+const (
+	LineBasic             = "basic"
+	LineImageStorage      = "img_storage"
+	LineMonitoringOption  = "monitoring_option"
+	LineMonitoringStorage = "monitoring_storage"
+	LineAlertingOption    = "alerting_option"
+)
+
+// QuoteLine is one billed item of an order
+type QuoteLine struct {
+	Code        string `json:"code"`
+	Description string `json:"description"`
+	Quantity    int    `json:"quantity"`
+	UnitPrice   Money  `json:"unit_price"`
+	Amount      Money  `json:"amount"`
+}
+
+// Quote is the itemized price of an order.
+// Subtotal is the sum of the lines, Net is Subtotal minus the discount
+// and Gross is Net with taxes included.
+type Quote struct {
+	Lines    []QuoteLine `json:"lines"`
+	Subtotal Money       `json:"subtotal"`
+	Discount *QuoteLine  `json:"discount,omitempty"`
+	Net      Money       `json:"net"`
+	Tax      TaxDetails  `json:"tax"`
+	Gross    Money       `json:"gross"`
+}
+
+// ===================================================================
+// Calculates the itemized price of an order based on the catalog.
+// Storage lines are only added when storage has been requested.
+// The coupon discount, if any, is returned as its own line.
+//
+// Parameters:
+//
+//	(*oko.Order) order : Order details requested by the client
+//	(*Coupon) coupon : Coupon to apply, may be nil
+//
+// Used on:
+//
+//	(*PriceCatalog) c : Catalog containing the prices to apply
+//
+// Return
+//
+//	(Quote) : Lines of the order and their net total, rounded to the currency minor units.
+//		Taxes are not applied, see TaxTable.Apply.
+//	(error) : ErrCouponNotApplicable if the coupon does not apply to the order
+//
+// Example:
+//
+//	quote, err := catalog.CalculatePrice(&order, nil)
+//	fmt.Println(quote.Net)
+//
+// ===================================================================
+func (c *PriceCatalog) CalculatePrice(order *oko.Order, coupon *Coupon) (Quote, error) {
+	prices := c.PriceList()
+	quote := Quote{Subtotal: NewMoney(0, c.Currency)}
+
+	quote.addLine(LineBasic, "Kubernetes cluster", 1, prices.Basic)
+	quote.addStorageLines(LineImageStorage, "Image storage", order.ImageStorage, c.imageStoragePricing())
+	if order.HasMonitoring {
+		quote.addLine(LineMonitoringOption, "Monitoring option", 1, prices.MonitoringOption)
+		quote.addStorageLines(LineMonitoringStorage, "Monitoring storage", order.MonitoringStorage, c.monitoringStoragePricing())
+	}
+	if order.HasAlerting {
+		quote.addLine(LineAlertingOption, "Alerting option", 1, prices.AlertingOption)
+	}
+
+	quote.Net = quote.Subtotal
+	if coupon != nil {
+		discount, err := coupon.discount(quote)
+		if err != nil {
+			return Quote{}, err
+		}
+		quote.Discount = discount
+		quote.Net = NewMoney(quote.Subtotal.Amount.Sub(discount.Amount.Amount), quote.Subtotal.Currency)
+	}
+	quote.Gross = quote.Net
+
+	return quote, nil
+}
+
+// ===================================================================
+// Appends the lines of a storage option to the quote, one line for
+// each tier the storage is charged at. Nothing is added when no
+// storage has been requested.
+//
+// Parameters:
+//
+//	(string) code : Code of the storage lines
+//	(string) label : Label of the storage option, e.g. "Image storage"
+//	(int) quantity : Storage requested (GB)
+//	(StoragePricing) pricing : Tiers of the storage option
+//
+// Used on:
+//
+//	(*Quote) q : Quote to complete
+//
+// ===================================================================
+func (q *Quote) addStorageLines(code string, label string, quantity int, pricing StoragePricing) {
+	if quantity <= 0 {
+		return
+	}
+
+	charges := pricing.charges(quantity)
+	for _, charge := range charges {
+		description := fmt.Sprintf("%s (%d GB)", label, quantity)
+		if len(charges) > 1 {
+			description = fmt.Sprintf("%s (GB %d to %d)", label, charge.From, charge.To)
+		}
+		q.addLine(code, description, charge.Quantity, NewMoney(charge.UnitPrice, q.Subtotal.Currency))
+	}
+}
+
+// addLine appends a line to the quote and adds its rounded amount to the subtotal
+func (q *Quote) addLine(code string, description string, quantity int, unitPrice Money) {
+	line := QuoteLine{
+		Code:        code,
+		Description: description,
+		Quantity:    quantity,
+		UnitPrice:   unitPrice,
+		Amount:      unitPrice.Mul(quantity).Round(),
+	}
+	q.Lines = append(q.Lines, line)
+	q.Subtotal = q.Subtotal.Add(line.Amount)
+}
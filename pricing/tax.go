@@ -0,0 +1,215 @@
+package pricing
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Country of the seller used when none is configured
+const DefaultSellerCountry = "FR"
+
+var ErrInvalidCustomerTax = errors.New("invalid customer tax information")
+
+var (
+	countryCodePattern = regexp.MustCompile(`^[A-Z]{2}$`)
+	vatNumberPattern   = regexp.MustCompile(`^[A-Z]{2}[0-9A-Z+*.]{2,12}$`)
+)
+
+// Member states of the European Union, used for reverse charge
+var euCountries = map[string]bool{
+	"AT": true, "BE": true, "BG": true, "CY": true, "CZ": true, "DE": true, "DK": true,
+	"EE": true, "ES": true, "FI": true, "FR": true, "GR": true, "HR": true, "HU": true,
+	"IE": true, "IT": true, "LT": true, "LU": true, "LV": true, "MT": true, "NL": true,
+	"PL": true, "PT": true, "RO": true, "SE": true, "SI": true, "SK": true,
+}
+
+// TaxTable holds the tax rate applied for each customer country.
+// Countries absent from the table are not taxed.
+type TaxTable struct {
+	SellerCountry string             `json:"seller_country"`
+	Rates         map[string]Decimal `json:"rates"` // e.g. "FR": "0.20"
+	checker       VATChecker
+}
+
+// TaxDetails describes the tax applied to a quote
+type TaxDetails struct {
+	Country       string  `json:"country"`
+	VATNumber     string  `json:"vat_number,omitempty"`
+	Rate          Decimal `json:"rate"`
+	VATVerified   bool    `json:"vat_verified"` // The VAT number is registered in VIES
+	ReverseCharge bool    `json:"reverse_charge"`
+	Amount        Money   `json:"amount"`
+}
+
+// ===================================================================
+// Returns the table used when nothing has been configured, containing
+// the standard VAT rates of the EU member states
+//
+// Return
+//
+//	(*TaxTable) : Table with EU standard rates, seller in France
+//
+// ===================================================================
+func DefaultTaxTable() *TaxTable {
+	rates := map[string]string{
+		"AT": "0.20", "BE": "0.21", "BG": "0.20", "CY": "0.19", "CZ": "0.21", "DE": "0.19", "DK": "0.25",
+		"EE": "0.24", "ES": "0.21", "FI": "0.255", "FR": "0.20", "GR": "0.24", "HR": "0.25", "HU": "0.27",
+		"IE": "0.23", "IT": "0.22", "LT": "0.21", "LU": "0.17", "LV": "0.21", "MT": "0.18", "NL": "0.21",
+		"PL": "0.23", "PT": "0.23", "RO": "0.21", "SE": "0.25", "SI": "0.22", "SK": "0.23",
+	}
+
+	table := &TaxTable{SellerCountry: DefaultSellerCountry, Rates: make(map[string]Decimal)}
+	for country, rate := range rates {
+		table.Rates[country], _ = ParseDecimal(rate)
+	}
+
+	return table
+}
+
+// ===================================================================
+// Loads the tax table from a JSON file, or returns the default table
+// when no file is given
+//
+// Parameters:
+//
+//	(string) filePath : Path to a JSON tax table file, may be empty
+//
+// Return
+//
+//	(*TaxTable) : Loaded and validated table
+//	(error) : Error while reading or validating the table
+//
+// Example:
+//
+//	taxes, err := LoadTaxTable("/etc/web-billing/taxes.json")
+//
+// ===================================================================
+func LoadTaxTable(filePath string) (*TaxTable, error) {
+	if filePath == "" {
+		return DefaultTaxTable(), nil
+	}
+
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read tax table file: %w", err)
+	}
+
+	table := &TaxTable{SellerCountry: DefaultSellerCountry}
+	if err := json.Unmarshal(content, table); err != nil {
+		return nil, fmt.Errorf("could not parse tax table: %w", err)
+	}
+
+	rates := make(map[string]Decimal, len(table.Rates))
+	for country, rate := range table.Rates {
+		rates[strings.ToUpper(country)] = rate
+	}
+	table.Rates = rates
+	table.SellerCountry = strings.ToUpper(table.SellerCountry)
+
+	if err := table.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid tax table: %w", err)
+	}
+
+	return table, nil
+}
+
+// UseVATChecker sets the registry checking VAT numbers. Without it, customers are never reverse charged.
+func (t *TaxTable) UseVATChecker(checker VATChecker) {
+	t.checker = checker
+}
+
+// Validate checks the seller country and that every rate is between 0 and 1
+func (t *TaxTable) Validate() error {
+	if !countryCodePattern.MatchString(t.SellerCountry) {
+		return fmt.Errorf("invalid seller country %q", t.SellerCountry)
+	}
+	for country, rate := range t.Rates {
+		if !countryCodePattern.MatchString(country) {
+			return fmt.Errorf("invalid country %q", country)
+		}
+		if rate.IsNegative() || rate > NewDecimalFromInt(1) {
+			return fmt.Errorf("invalid rate %s for %s", rate, country)
+		}
+	}
+
+	return nil
+}
+
+// ===================================================================
+// Applies the tax of the customer country on the net amount of a
+// quote. EU business customers located in another member state than
+// the seller and giving a VAT number registered in VIES are reverse
+// charged. If VIES can not be reached, the quote fails rather than
+// charging the VAT to a customer who may be exempt.
+//
+// Parameters:
+//
+//	(*Quote) quote : Quote to complete with tax and gross amounts
+//	(string) country : ISO 3166-1 alpha-2 code of the customer country
+//	(string) vatNumber : Customer VAT number, may be empty
+//
+// Used on:
+//
+//	(*TaxTable) t : Table containing the rate of each country
+//
+// Return
+//
+//	(error) : ErrInvalidCustomerTax if the country or VAT number is invalid,
+//		ErrUnregisteredVATNumber if VIES does not know the VAT number,
+//		ErrVATCheckUnavailable if VIES can not be reached
+//
+// Example:
+//
+//	err := taxes.Apply(&quote, "DE", "DE123456789")
+//
+// ===================================================================
+func (t *TaxTable) Apply(quote *Quote, country string, vatNumber string) error {
+	country = strings.ToUpper(strings.TrimSpace(country))
+	vatNumber = strings.ToUpper(strings.ReplaceAll(vatNumber, " ", ""))
+
+	if !countryCodePattern.MatchString(country) {
+		return fmt.Errorf("%w: invalid customer country %q", ErrInvalidCustomerTax, country)
+	}
+
+	details := TaxDetails{Country: country, VATNumber: vatNumber}
+
+	if vatNumber != "" {
+		if !vatNumberPattern.MatchString(vatNumber) || vatPrefix(vatNumber) != country {
+			return fmt.Errorf("%w: invalid VAT number %q for country %s", ErrInvalidCustomerTax, vatNumber, country)
+		}
+		if euCountries[country] && euCountries[t.SellerCountry] && country != t.SellerCountry && t.checker != nil {
+			registered, err := t.checker.IsRegistered(vatNumber)
+			if err != nil {
+				return fmt.Errorf("%w: %s", ErrVATCheckUnavailable, err)
+			}
+			if !registered {
+				return fmt.Errorf("%w: %s", ErrUnregisteredVATNumber, vatNumber)
+			}
+			details.VATVerified = true
+			details.ReverseCharge = true
+		}
+	}
+
+	if !details.ReverseCharge {
+		details.Rate = t.Rates[country]
+	}
+	details.Amount = NewMoney(quote.Net.Amount.Mul(details.Rate), quote.Net.Currency).Round()
+
+	quote.Tax = details
+	quote.Gross = quote.Net.Add(details.Amount)
+
+	return nil
+}
+
+// vatPrefix returns the country of a VAT number. Greece uses "EL" instead of its ISO code.
+func vatPrefix(vatNumber string) string {
+	prefix := vatNumber[:2]
+	if prefix == "EL" {
+		return "GR"
+	}
+	return prefix
+}
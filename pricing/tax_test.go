@@ -0,0 +1,207 @@
+package pricing
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeVATChecker answers from a fixed list of registered VAT numbers
+type fakeVATChecker struct {
+	registered map[string]bool
+	err        error
+	calls      int
+}
+
+func (c *fakeVATChecker) IsRegistered(vatNumber string) (bool, error) {
+	c.calls++
+	return c.registered[vatNumber], c.err
+}
+
+func TestTaxTableApply(t *testing.T) {
+	tests := []struct {
+		name          string
+		country       string
+		vatNumber     string
+		checkerErr    error
+		wantErr       error
+		wantRate      string
+		wantTax       string
+		wantReverse   bool
+		wantVerified  bool
+		wantCheckCall bool
+	}{
+		{name: "seller country", country: "FR", wantRate: "0.20", wantTax: "20.00"},
+		{name: "other EU consumer", country: "DE", wantRate: "0.19", wantTax: "19.00"},
+		{name: "lowercase country", country: " de ", wantRate: "0.19", wantTax: "19.00"},
+		{name: "outside EU", country: "US", wantRate: "0", wantTax: "0.00"},
+		{name: "missing country", country: "", wantErr: ErrInvalidCustomerTax},
+		{
+			name: "registered EU business", country: "DE", vatNumber: "de 123456789",
+			wantRate: "0", wantTax: "0.00", wantReverse: true, wantVerified: true, wantCheckCall: true,
+		},
+		{
+			name: "Greek business", country: "GR", vatNumber: "EL123456789",
+			wantRate: "0", wantTax: "0.00", wantReverse: true, wantVerified: true, wantCheckCall: true,
+		},
+		{
+			name: "unregistered EU business", country: "DE", vatNumber: "DE999999999",
+			wantErr: ErrUnregisteredVATNumber, wantCheckCall: true,
+		},
+		{
+			name: "VIES unavailable", country: "DE", vatNumber: "DE123456789", checkerErr: errors.New("timeout"),
+			wantErr: ErrVATCheckUnavailable, wantCheckCall: true,
+		},
+		{name: "business in seller country", country: "FR", vatNumber: "FR12345678901", wantRate: "0.20", wantTax: "20.00"},
+		{name: "VAT number of another country", country: "DE", vatNumber: "AT123456789", wantErr: ErrInvalidCustomerTax},
+		{name: "malformed VAT number", country: "DE", vatNumber: "DE-1", wantErr: ErrInvalidCustomerTax},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checker := &fakeVATChecker{
+				registered: map[string]bool{"DE123456789": true, "EL123456789": true},
+				err:        test.checkerErr,
+			}
+			table := DefaultTaxTable()
+			table.UseVATChecker(checker)
+			quote := Quote{Net: NewMoney(mustParseDecimal(t, "100"), "EUR")}
+
+			err := table.Apply(&quote, test.country, test.vatNumber)
+
+			if (checker.calls > 0) != test.wantCheckCall {
+				t.Errorf("VIES called %d times, want called: %v", checker.calls, test.wantCheckCall)
+			}
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("Apply() error = %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply() error = %v", err)
+			}
+			if quote.Tax.Rate != mustParseDecimal(t, test.wantRate) {
+				t.Errorf("rate = %s, want %s", quote.Tax.Rate, test.wantRate)
+			}
+			if got := quote.Tax.Amount.Amount.StringFixed(2); got != test.wantTax {
+				t.Errorf("tax = %s, want %s", got, test.wantTax)
+			}
+			if quote.Tax.ReverseCharge != test.wantReverse {
+				t.Errorf("reverse charge = %v, want %v", quote.Tax.ReverseCharge, test.wantReverse)
+			}
+			if quote.Tax.VATVerified != test.wantVerified {
+				t.Errorf("VAT verified = %v, want %v", quote.Tax.VATVerified, test.wantVerified)
+			}
+			if quote.Gross != quote.Net.Add(quote.Tax.Amount) {
+				t.Errorf("gross = %s, want net + tax", quote.Gross)
+			}
+		})
+	}
+}
+
+func TestTaxTableApplyWithoutChecker(t *testing.T) {
+	table := DefaultTaxTable()
+	quote := Quote{Net: NewMoney(mustParseDecimal(t, "100"), "EUR")}
+
+	if err := table.Apply(&quote, "DE", "DE123456789"); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if quote.Tax.ReverseCharge || quote.Tax.VATVerified {
+		t.Errorf("unverified VAT number was reverse charged: %+v", quote.Tax)
+	}
+	if quote.Tax.VATNumber != "DE123456789" {
+		t.Errorf("VAT number = %q, want it kept", quote.Tax.VATNumber)
+	}
+}
+
+func TestVIESChecker(t *testing.T) {
+	var requests []map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		requests = append(requests, body)
+
+		switch body["vatNumber"] {
+		case "123456789":
+			w.Write([]byte(`{"valid": true}`))
+		case "000000000":
+			w.Write([]byte(`{"valid": false, "userError": "INVALID"}`))
+		case "111111111":
+			w.Write([]byte(`{"valid": false, "userError": "MS_UNAVAILABLE"}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	checker := NewVIESChecker(server.URL, server.Client())
+
+	tests := []struct {
+		vatNumber      string
+		wantRegistered bool
+		wantErr        bool
+	}{
+		{vatNumber: "EL123456789", wantRegistered: true},
+		{vatNumber: "DE000000000", wantRegistered: false},
+		{vatNumber: "DE111111111", wantErr: true},
+		{vatNumber: "DE222222222", wantErr: true},
+	}
+	for _, test := range tests {
+		registered, err := checker.IsRegistered(test.vatNumber)
+		if (err != nil) != test.wantErr {
+			t.Errorf("IsRegistered(%s) error = %v, want error: %v", test.vatNumber, err, test.wantErr)
+		}
+		if registered != test.wantRegistered {
+			t.Errorf("IsRegistered(%s) = %v, want %v", test.vatNumber, registered, test.wantRegistered)
+		}
+	}
+	if requests[0]["countryCode"] != "EL" || requests[0]["vatNumber"] != "123456789" {
+		t.Errorf("VIES request = %v, want country EL and number 123456789", requests[0])
+	}
+
+	// Answers are cached, errors are not
+	checker.IsRegistered("EL123456789")
+	checker.IsRegistered("DE111111111")
+	if len(requests) != len(tests)+1 {
+		t.Errorf("VIES called %d times, want %d", len(requests), len(tests)+1)
+	}
+}
+
+func TestVIESCheckerCacheBounded(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(`{"valid": true}`))
+	}))
+	defer server.Close()
+
+	checker := NewVIESChecker(server.URL, server.Client())
+	checker.maxAnswers = 2
+
+	checker.IsRegistered("DE000000001")
+	checker.IsRegistered("DE000000002")
+	// Expired answers are dropped first
+	checker.answers["DE000000002"] = viesAnswer{registered: true, checkedAt: time.Now().Add(-viesCacheDuration)}
+	checker.IsRegistered("DE000000003")
+	if _, found := checker.answers["DE000000002"]; found || len(checker.answers) != 2 {
+		t.Errorf("cache = %v, want the expired answer dropped", checker.answers)
+	}
+
+	// Then the oldest one
+	checker.IsRegistered("DE000000004")
+	if _, found := checker.answers["DE000000001"]; found || len(checker.answers) != 2 {
+		t.Errorf("cache = %v, want the oldest answer dropped", checker.answers)
+	}
+
+	// A dropped answer is asked again
+	calls = 0
+	checker.IsRegistered("DE000000004")
+	checker.IsRegistered("DE000000001")
+	if calls != 1 {
+		t.Errorf("VIES called %d times, want 1", calls)
+	}
+}
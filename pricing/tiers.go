@@ -0,0 +1,152 @@
+package pricing
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Ways of applying storage tiers
+const (
+	TierGraduated = "graduated" // Each GB is charged at the price of the tier it falls in
+	TierVolume    = "volume"    // Every GB is charged at the price of the tier reached by the total
+)
+
+// PriceTier is a storage range sharing the same price per GB
+type PriceTier struct {
+	UpTo      int     `json:"up_to"` // Last GB of the tier, 0 means unlimited
+	UnitPrice Decimal `json:"unit_price"`
+}
+
+// StoragePricing holds the tiers applied to a storage option
+type StoragePricing struct {
+	Mode  string      `json:"mode"`
+	Tiers []PriceTier `json:"tiers"`
+}
+
+// TierPrice is a tier as exposed to the clients
+type TierPrice struct {
+	UpTo      int   `json:"up_to"`
+	UnitPrice Money `json:"unit_price"`
+}
+
+// StoragePriceList is a storage pricing as exposed to the clients
+type StoragePriceList struct {
+	Mode  string      `json:"mode"`
+	Tiers []TierPrice `json:"tiers"`
+}
+
+// tierCharge is the part of a storage quantity charged at a tier price
+type tierCharge struct {
+	From      int
+	To        int // 0 when the tier is unlimited
+	Quantity  int
+	UnitPrice Decimal
+}
+
+// flatStoragePricing charges every GB at the same unit price
+func flatStoragePricing(unitPrice Decimal) StoragePricing {
+	return StoragePricing{
+		Mode:  TierGraduated,
+		Tiers: []PriceTier{{UpTo: 0, UnitPrice: unitPrice}},
+	}
+}
+
+// ===================================================================
+// Checks that the tiers are sorted, have non-negative prices and that
+// the last one is unlimited
+//
+// Used on:
+//
+//	(StoragePricing) p : Storage pricing to validate
+//
+// Return
+//
+//	(error) : First inconsistency found or nil if the tiers are valid
+//
+// ===================================================================
+func (p StoragePricing) Validate() error {
+	if p.Mode != TierGraduated && p.Mode != TierVolume {
+		return fmt.Errorf("unknown tier mode %q", p.Mode)
+	}
+	if len(p.Tiers) == 0 {
+		return errors.New("at least one tier must be set")
+	}
+
+	previous := 0
+	for i, tier := range p.Tiers {
+		if tier.UnitPrice.IsNegative() {
+			return fmt.Errorf("tier %d price can not be negative (%s)", i+1, tier.UnitPrice)
+		}
+		last := i == len(p.Tiers)-1
+		if last && tier.UpTo != 0 {
+			return errors.New("last tier must be unlimited (up_to 0)")
+		}
+		if !last && tier.UpTo <= previous {
+			return fmt.Errorf("tier %d must end after %d GB", i+1, previous)
+		}
+		previous = tier.UpTo
+	}
+
+	return nil
+}
+
+// ===================================================================
+// Splits a storage quantity between the tiers it is charged at
+//
+// Parameters:
+//
+//	(int) quantity : Storage requested (GB)
+//
+// Used on:
+//
+//	(StoragePricing) p : Storage pricing to apply
+//
+// Return
+//
+//	([]tierCharge) : Quantity charged for each tier used
+//
+// Example:
+//
+//	// Graduated tiers 10 GB at 1, 90 GB at 0.8 then 0.5
+//	charges := pricing.charges(150) // 10 x 1, 90 x 0.8, 50 x 0.5
+//
+// ===================================================================
+func (p StoragePricing) charges(quantity int) []tierCharge {
+	var charges []tierCharge
+
+	from := 1
+	for _, tier := range p.Tiers {
+		unlimited := tier.UpTo == 0
+
+		if p.Mode == TierVolume {
+			if unlimited || quantity <= tier.UpTo {
+				return []tierCharge{{From: 1, To: quantity, Quantity: quantity, UnitPrice: tier.UnitPrice}}
+			}
+			continue
+		}
+
+		to := quantity
+		if !unlimited && tier.UpTo < quantity {
+			to = tier.UpTo
+		}
+		if to >= from {
+			charges = append(charges, tierCharge{From: from, To: to, Quantity: to - from + 1, UnitPrice: tier.UnitPrice})
+		}
+		if unlimited || tier.UpTo >= quantity {
+			break
+		}
+		from = tier.UpTo + 1
+	}
+
+	return charges
+}
+
+// PriceList returns the tiers with their prices in the given currency
+func (p StoragePricing) PriceList(currency string) StoragePriceList {
+	list := StoragePriceList{Mode: p.Mode}
+	for _, tier := range p.Tiers {
+		list.Tiers = append(list.Tiers, TierPrice{UpTo: tier.UpTo, UnitPrice: NewMoney(tier.UnitPrice, currency)})
+	}
+
+	return list
+}
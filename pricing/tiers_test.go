@@ -0,0 +1,136 @@
+package pricing
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// testStoragePricing charges 1 per GB up to 10 GB, 0.8 up to 100 GB and 0.5 beyond
+func testStoragePricing(t *testing.T, mode string) StoragePricing {
+	return StoragePricing{
+		Mode: mode,
+		Tiers: []PriceTier{
+			{UpTo: 10, UnitPrice: mustParseDecimal(t, "1")},
+			{UpTo: 100, UnitPrice: mustParseDecimal(t, "0.8")},
+			{UpTo: 0, UnitPrice: mustParseDecimal(t, "0.5")},
+		},
+	}
+}
+
+// describeCharges writes each charge as "from-to: quantity x unit price"
+func describeCharges(charges []tierCharge) []string {
+	var described []string
+	for _, charge := range charges {
+		described = append(described, fmt.Sprintf("%d-%d: %d x %s", charge.From, charge.To, charge.Quantity, charge.UnitPrice))
+	}
+	return described
+}
+
+func TestGraduatedCharges(t *testing.T) {
+	pricing := testStoragePricing(t, TierGraduated)
+
+	tests := map[int][]string{
+		0:   nil,
+		5:   {"1-5: 5 x 1"},
+		10:  {"1-10: 10 x 1"},
+		11:  {"1-10: 10 x 1", "11-11: 1 x 0.8"},
+		100: {"1-10: 10 x 1", "11-100: 90 x 0.8"},
+		150: {"1-10: 10 x 1", "11-100: 90 x 0.8", "101-150: 50 x 0.5"},
+	}
+
+	for quantity, want := range tests {
+		if charges := describeCharges(pricing.charges(quantity)); !reflect.DeepEqual(charges, want) {
+			t.Errorf("charges(%d) = %v, want %v", quantity, charges, want)
+		}
+	}
+}
+
+func TestVolumeCharges(t *testing.T) {
+	pricing := testStoragePricing(t, TierVolume)
+
+	// The whole quantity is charged at the price of the tier it reaches
+	tests := map[int][]string{
+		10:  {"1-10: 10 x 1"},
+		11:  {"1-11: 11 x 0.8"},
+		100: {"1-100: 100 x 0.8"},
+		150: {"1-150: 150 x 0.5"},
+	}
+
+	for quantity, want := range tests {
+		if charges := describeCharges(pricing.charges(quantity)); !reflect.DeepEqual(charges, want) {
+			t.Errorf("charges(%d) = %v, want %v", quantity, charges, want)
+		}
+	}
+}
+
+func TestStoragePricingValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(pricing *StoragePricing)
+		wantErr bool
+	}{
+		{name: "graduated", change: func(pricing *StoragePricing) {}},
+		{name: "volume", change: func(pricing *StoragePricing) { pricing.Mode = TierVolume }},
+		{name: "flat price", change: func(pricing *StoragePricing) { *pricing = flatStoragePricing(mustParseDecimal(t, "1")) }},
+		{name: "unknown mode", change: func(pricing *StoragePricing) { pricing.Mode = "stairs" }, wantErr: true},
+		{name: "no tier", change: func(pricing *StoragePricing) { pricing.Tiers = nil }, wantErr: true},
+		{name: "negative price", change: func(pricing *StoragePricing) { pricing.Tiers[1].UnitPrice = mustParseDecimal(t, "-0.1") }, wantErr: true},
+		{name: "last tier limited", change: func(pricing *StoragePricing) { pricing.Tiers[2].UpTo = 1000 }, wantErr: true},
+		{name: "unsorted tiers", change: func(pricing *StoragePricing) { pricing.Tiers[1].UpTo = 10 }, wantErr: true},
+		{name: "unlimited tier before the last", change: func(pricing *StoragePricing) { pricing.Tiers[0].UpTo = 0 }, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pricing := testStoragePricing(t, TierGraduated)
+			test.change(&pricing)
+			if err := pricing.Validate(); (err != nil) != test.wantErr {
+				t.Errorf("Validate() error = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestQuoteStorageLines(t *testing.T) {
+	pricing := testStoragePricing(t, TierGraduated)
+	pricing.Tiers[1].UnitPrice = mustParseDecimal(t, "0.333")
+	quote := Quote{Subtotal: NewMoney(0, "EUR")}
+	quote.addStorageLines("img_storage", "Images storage", 150, pricing)
+
+	// Each tier is a line of its own, rounded separately
+	var lines []string
+	for _, line := range quote.Lines {
+		lines = append(lines, fmt.Sprintf("%s: %s", line.Description, line.Amount))
+	}
+	want := []string{
+		"Images storage (GB 1 to 10): 10.00",
+		"Images storage (GB 11 to 100): 29.97",
+		"Images storage (GB 101 to 150): 25.00",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("Lines = %v, want %v", lines, want)
+	}
+	if quote.Subtotal.String() != "64.97" {
+		t.Errorf("Subtotal = %s, want 64.97", quote.Subtotal)
+	}
+
+	quote = Quote{Subtotal: NewMoney(0, "EUR")}
+	quote.addStorageLines("img_storage", "Images storage", 5, pricing)
+	if len(quote.Lines) != 1 || quote.Lines[0].Description != "Images storage (5 GB)" {
+		t.Errorf("Lines = %+v, want a single line for 5 GB", quote.Lines)
+	}
+}
+
+func TestStoragePriceList(t *testing.T) {
+	list := testStoragePricing(t, TierVolume).PriceList("usd")
+
+	var tiers []string
+	for _, tier := range list.Tiers {
+		tiers = append(tiers, fmt.Sprintf("%d: %s %s", tier.UpTo, tier.UnitPrice, tier.UnitPrice.Currency))
+	}
+	want := []string{"10: 1.00 USD", "100: 0.80 USD", "0: 0.50 USD"}
+	if list.Mode != TierVolume || !reflect.DeepEqual(tiers, want) {
+		t.Errorf("PriceList() = %s %v, want %s %v", list.Mode, tiers, TierVolume, want)
+	}
+}
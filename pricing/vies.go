@@ -0,0 +1,164 @@
+package pricing
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// VIES REST API of the European Commission, checking EU VAT numbers
+const DefaultVIESURL = "https://ec.europa.eu/taxation_customs/vies/rest-api/check-vat-number"
+
+// How long the answer of VIES for a VAT number is reused
+const viesCacheDuration = 24 * time.Hour
+
+// Number of VAT numbers whose answer is kept
+const viesCacheSize = 10000
+
+var (
+	ErrUnregisteredVATNumber = errors.New("VAT number is not registered")
+	ErrVATCheckUnavailable   = errors.New("VAT number can not be checked at the moment")
+)
+
+// VATChecker checks that a VAT number is registered before the customer is reverse charged
+type VATChecker interface {
+	// IsRegistered returns an error when the registry can not be reached
+	IsRegistered(vatNumber string) (bool, error)
+}
+
+// viesAnswer is a cached answer of VIES
+type viesAnswer struct {
+	registered bool
+	checkedAt  time.Time
+}
+
+// VIESChecker checks VAT numbers against VIES, caching its answers
+type VIESChecker struct {
+	url        string
+	httpClient *http.Client
+	answers    map[string]viesAnswer
+	maxAnswers int // Size of the cache, the oldest answers are dropped beyond it
+	mutex      sync.Mutex
+}
+
+// ===================================================================
+// Creates a VAT number checker using VIES
+//
+// Parameters:
+//
+//	(string) url : URL of the VIES check-vat-number API, DefaultVIESURL if empty
+//	(*http.Client) httpClient : Client used to call VIES
+//
+// Return
+//
+//	(*VIESChecker) : Checker ready to be used
+//
+// Example:
+//
+//	checker := NewVIESChecker("", &http.Client{Timeout: 10 * time.Second})
+//
+// ===================================================================
+func NewVIESChecker(url string, httpClient *http.Client) *VIESChecker {
+	if url == "" {
+		url = DefaultVIESURL
+	}
+
+	return &VIESChecker{
+		url:        url,
+		httpClient: httpClient,
+		answers:    make(map[string]viesAnswer),
+		maxAnswers: viesCacheSize,
+	}
+}
+
+// ===================================================================
+// Asks VIES whether a VAT number is registered
+//
+// Parameters:
+//
+//	(string) vatNumber : Normalized VAT number with its country prefix, e.g. "DE123456789"
+//
+// Used on:
+//
+//	(*VIESChecker) c : VIES client
+//
+// Return
+//
+//	(bool) : Whether the VAT number is registered
+//	(error) : Error if VIES could not answer
+//
+// ===================================================================
+func (c *VIESChecker) IsRegistered(vatNumber string) (bool, error) {
+	c.mutex.Lock()
+	answer, found := c.answers[vatNumber]
+	if found && time.Since(answer.checkedAt) >= viesCacheDuration {
+		delete(c.answers, vatNumber)
+		found = false
+	}
+	c.mutex.Unlock()
+	if found {
+		return answer.registered, nil
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"countryCode": vatNumber[:2],
+		"vatNumber":   vatNumber[2:],
+	})
+	if err != nil {
+		return false, err
+	}
+
+	res, err := c.httpClient.Post(c.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("could not reach VIES: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("VIES answered with status code %d", res.StatusCode)
+	}
+
+	var result struct {
+		Valid     bool   `json:"valid"`
+		UserError string `json:"userError"` // e.g. "MS_UNAVAILABLE" when a member state registry is down
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return false, fmt.Errorf("could not decode VIES answer: %w", err)
+	}
+	if !result.Valid && result.UserError != "" && result.UserError != "VALID" && result.UserError != "INVALID" {
+		return false, fmt.Errorf("VIES could not check the VAT number: %s", result.UserError)
+	}
+
+	c.remember(vatNumber, result.Valid)
+
+	return result.Valid, nil
+}
+
+// remember caches an answer of VIES. When the cache is full, expired
+// answers are dropped, then the oldest one if none has expired.
+func (c *VIESChecker) remember(vatNumber string, registered bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	if _, found := c.answers[vatNumber]; !found && len(c.answers) >= c.maxAnswers {
+		oldest := ""
+		for cached, answer := range c.answers {
+			if now.Sub(answer.checkedAt) >= viesCacheDuration {
+				delete(c.answers, cached)
+				continue
+			}
+			if oldest == "" || answer.checkedAt.Before(c.answers[oldest].checkedAt) {
+				oldest = cached
+			}
+		}
+		if len(c.answers) >= c.maxAnswers {
+			delete(c.answers, oldest)
+		}
+	}
+
+	c.answers[vatNumber] = viesAnswer{registered: registered, checkedAt: now}
+}
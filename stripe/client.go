@@ -0,0 +1,124 @@
+package stripe
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Stripe API base URL
+const DefaultBaseURL = "https://api.stripe.com"
+
+// Timeout of the requests sent to Stripe when none is configured
+const DefaultRequestTimeout = 30 * time.Second
+
+// Client sends every request made to the Stripe API
+type Client struct {
+	BaseURL    string
+	SuccessURL string // Page the customer is sent to once paid, may hold {CHECKOUT_SESSION_ID}
+	CancelURL  string // Page the customer is sent to when leaving the checkout
+	HTTPClient *http.Client
+	secretKey  string
+}
+
+// ===================================================================
+// Returns a Stripe API client
+//
+// Parameters:
+//
+//	(string) secretKey : Stripe secret API key, e.g. "sk_live_xxxx"
+//	(string) successURL : Page the customer is sent to once paid
+//	(string) cancelURL : Page the customer is sent to when leaving the checkout
+//	(*http.Client) httpClient : Client used for the requests, one with DefaultRequestTimeout if nil
+//
+// Return
+//
+//	(*Client) : Client of the Stripe API
+//
+// Example:
+//
+//	client := NewClient("sk_test_xxxx", "https://onekonsole.fr/paid", "https://onekonsole.fr/cart", nil)
+//
+// ===================================================================
+func NewClient(secretKey string, successURL string, cancelURL string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: DefaultRequestTimeout}
+	}
+
+	return &Client{
+		BaseURL:    DefaultBaseURL,
+		SuccessURL: successURL,
+		CancelURL:  cancelURL,
+		HTTPClient: httpClient,
+		secretKey:  secretKey,
+	}
+}
+
+// ===================================================================
+// Sends a request to the Stripe API and decodes its response
+//
+// Parameters:
+//
+//	(string) method : HTTP method
+//	(string) path : API path, e.g. "/v1/checkout/sessions"
+//	(url.Values) form : Parameters, form encoded in the body of POST requests
+//		and in the query of the other ones
+//	(string) idempotencyKey : Key making retries of POST requests safe, may be empty
+//	(interface{}) result : Value the JSON response is decoded in
+//
+// Used on:
+//
+//	(*Client) c : Stripe API client
+//
+// Return
+//
+//	(error) : *Error if Stripe refused the request, request error or nil
+//
+// ===================================================================
+func (c *Client) do(method string, path string, form url.Values, idempotencyKey string, result interface{}) error {
+	requestURL := c.BaseURL + path
+
+	var body *strings.Reader
+	if method == "POST" {
+		body = strings.NewReader(form.Encode())
+	} else {
+		body = strings.NewReader("")
+		if len(form) > 0 {
+			requestURL += "?" + form.Encode()
+		}
+	}
+
+	req, err := http.NewRequest(method, requestURL, body)
+	if err != nil {
+		fmt.Printf("[ERROR] Unable to initiate http request: %s\n", err)
+		return err
+	}
+
+	// Add request headers
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", "Bearer "+c.secretKey)
+	if idempotencyKey != "" {
+		req.Header.Add("Idempotency-Key", idempotencyKey)
+	}
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		var parsedBody struct {
+			Error Error `json:"error"`
+		}
+		// The status code is enough when the error can not be parsed
+		_ = json.NewDecoder(res.Body).Decode(&parsedBody)
+		parsedBody.Error.StatusCode = res.StatusCode
+		return &parsedBody.Error
+	}
+
+	return json.NewDecoder(res.Body).Decode(result)
+}
@@ -0,0 +1,51 @@
+package stripe
+
+import (
+	"fmt"
+
+	"github.com/OneKonsole/web-service-billing/payment"
+)
+
+// Checkout Session as returned by Stripe /v1/checkout/sessions
+type checkoutSession struct {
+	ID            string         `json:"id"`
+	URL           string         `json:"url"`
+	Status        string         `json:"status"`         // open, complete or expired
+	PaymentStatus string         `json:"payment_status"` // paid, unpaid or no_payment_required
+	AmountTotal   int64          `json:"amount_total"`   // Minor units
+	Currency      string         `json:"currency"`       // Lower case, e.g. "eur"
+	PaymentIntent *paymentIntent `json:"payment_intent"` // Only set when expanded
+}
+
+// PaymentIntent as returned by Stripe /v1/payment_intents
+type paymentIntent struct {
+	ID       string `json:"id"`
+	Status   string `json:"status"` // e.g. requires_capture, processing, succeeded, canceled
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// Refund as returned by Stripe /v1/refunds
+type refund struct {
+	ID       string `json:"id"`
+	Status   string `json:"status"`
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// Error is an error response of the Stripe API
+type Error struct {
+	StatusCode int    `json:"-"`
+	Type       string `json:"type"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("stripe error %d (%s %s): %s", e.StatusCode, e.Type, e.Code, e.Message)
+}
+
+// Unavailable reports whether Stripe failed on its side
+func (e *Error) Unavailable() bool {
+	return payment.IsUnavailableStatus(e.StatusCode)
+}
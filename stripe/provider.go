@@ -0,0 +1,242 @@
+package stripe
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/OneKonsole/web-service-billing/payment"
+	"github.com/OneKonsole/web-service-billing/pricing"
+)
+
+// Name of the Stripe payment provider
+const ProviderName = "stripe"
+
+// Name identifies Stripe in the orders
+func (c *Client) Name() string {
+	return ProviderName
+}
+
+// ===================================================================
+// Creates a Stripe Checkout Session the customer pays on, by card or
+// by SEPA debit for orders in euros. The order is sent as a single
+// line holding the gross amount, since our quote already includes
+// the taxes and discounts. Card payments are only authorized, to be
+// captured once the cluster is provisioned. SEPA debits can not be
+// authorized and are captured right away.
+//
+// Parameters:
+//
+//	(payment.CheckoutRequest) request : Details about the order requested
+//
+// Used on:
+//
+//	(*Client) c : Stripe API client
+//
+// Return:
+//
+//	(payment.Checkout) : Created session and its payment page
+//	(error) : Error during process or nil if no error occurs
+//
+// ===================================================================
+func (c *Client) CreateCheckout(request payment.CheckoutRequest) (payment.Checkout, error) {
+	currency := strings.ToLower(request.Amount.Currency)
+
+	form := url.Values{}
+	form.Set("mode", "payment")
+	form.Set("success_url", c.SuccessURL)
+	form.Set("cancel_url", c.CancelURL)
+	form.Set("client_reference_id", request.Reference)
+	form.Set("payment_method_types[0]", "card")
+	if currency == "eur" {
+		form.Set("payment_method_types[1]", "sepa_debit")
+	}
+	form.Set("line_items[0][quantity]", "1")
+	form.Set("line_items[0][price_data][currency]", currency)
+	form.Set("line_items[0][price_data][unit_amount]", strconv.FormatInt(request.Amount.MinorAmount(), 10))
+	form.Set("line_items[0][price_data][product_data][name]", request.Description)
+	form.Set("payment_method_options[card][capture_method]", "manual")
+	form.Set("payment_intent_data[description]", request.Description)
+	form.Set("metadata[user_id]", request.Reference)
+	form.Set("metadata[net]", request.Quote.Net.String())
+	form.Set("metadata[tax]", request.Quote.Tax.Amount.String())
+
+	var session checkoutSession
+	if err := c.do("POST", "/v1/checkout/sessions", form, request.IdempotencyKey, &session); err != nil {
+		return payment.Checkout{}, err
+	}
+
+	return payment.Checkout{
+		ID:          session.ID,
+		Provider:    ProviderName,
+		Status:      session.Status,
+		ApprovalURL: session.URL,
+	}, nil
+}
+
+// GetStatus returns the state of a Checkout Session and its PaymentIntent
+func (c *Client) GetStatus(checkoutID string) (payment.Status, error) {
+	session, err := c.getSession(checkoutID)
+	if err != nil {
+		return payment.Status{}, err
+	}
+
+	return session.paymentStatus(), nil
+}
+
+// Authorize returns the state of a Checkout Session: paying a session
+// already authorizes its card payment
+func (c *Client) Authorize(checkoutID string) (payment.Status, error) {
+	return c.GetStatus(checkoutID)
+}
+
+// ===================================================================
+// Captures the PaymentIntent of a Checkout Session, for sessions
+// created with a manual capture. Capturing a session again returns
+// its existing capture.
+//
+// Parameters:
+//
+//	(string) checkoutID : ID of the Checkout Session
+//
+// Used on:
+//
+//	(*Client) c : Stripe API client
+//
+// Return:
+//
+//	(payment.Status) : State of the session once captured
+//	(error) : Error during process or nil if no error occurs
+//
+// ===================================================================
+func (c *Client) Capture(checkoutID string) (payment.Status, error) {
+	session, err := c.getSession(checkoutID)
+	if err != nil {
+		return payment.Status{}, err
+	}
+	if session.PaymentIntent == nil {
+		return payment.Status{}, fmt.Errorf("checkout session %s has no payment yet", checkoutID)
+	}
+	// Captured by a previous attempt whose result was not saved
+	if session.PaymentIntent.Status == "succeeded" {
+		return session.paymentStatus(), nil
+	}
+
+	var captured paymentIntent
+	idempotencyKey := "capture-" + session.PaymentIntent.ID
+	if err := c.do("POST", "/v1/payment_intents/"+session.PaymentIntent.ID+"/capture", url.Values{}, idempotencyKey, &captured); err != nil {
+		return payment.Status{}, err
+	}
+	session.PaymentIntent = &captured
+
+	return session.paymentStatus(), nil
+}
+
+// ===================================================================
+// Refunds a captured PaymentIntent
+//
+// Parameters:
+//
+//	(string) captureID : ID of the PaymentIntent
+//	(*pricing.Money) amount : Amount to refund, the whole payment if nil
+//	(string) reason : Why the payment is refunded, kept in the refund metadata
+//	(string) idempotencyKey : Sent as Idempotency-Key, a retry with the same key returns the first refund
+//
+// Used on:
+//
+//	(*Client) c : Stripe API client
+//
+// Return:
+//
+//	(payment.Refund) : Refund created on Stripe
+//	(error) : Error during process or nil if no error occurs
+//
+// ===================================================================
+func (c *Client) Refund(captureID string, amount *pricing.Money, reason string, idempotencyKey string) (payment.Refund, error) {
+	form := url.Values{}
+	form.Set("payment_intent", captureID)
+	form.Set("reason", "requested_by_customer")
+	if amount != nil {
+		form.Set("amount", strconv.FormatInt(amount.MinorAmount(), 10))
+	}
+	if reason != "" {
+		form.Set("metadata[reason]", reason)
+	}
+
+	var created refund
+	if err := c.do("POST", "/v1/refunds", form, idempotencyKey, &created); err != nil {
+		return payment.Refund{}, err
+	}
+
+	return payment.Refund{
+		ID:     created.ID,
+		Status: strings.ToUpper(created.Status),
+		Amount: pricing.NewMoneyFromMinor(created.Amount, created.Currency),
+	}, nil
+}
+
+// Cancel releases the authorized payment of a Checkout Session, or
+// expires the session so it can not be paid anymore
+func (c *Client) Cancel(checkoutID string) error {
+	session, err := c.getSession(checkoutID)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case session.PaymentIntent != nil && session.PaymentIntent.Status == "requires_capture":
+		var canceled paymentIntent
+		return c.do("POST", "/v1/payment_intents/"+session.PaymentIntent.ID+"/cancel", url.Values{}, "", &canceled)
+	case session.Status == "open":
+		var expired checkoutSession
+		return c.do("POST", "/v1/checkout/sessions/"+checkoutID+"/expire", url.Values{}, "", &expired)
+	default:
+		return nil
+	}
+}
+
+// getSession returns a Checkout Session with its PaymentIntent
+func (c *Client) getSession(checkoutID string) (checkoutSession, error) {
+	form := url.Values{}
+	form.Set("expand[]", "payment_intent")
+
+	var session checkoutSession
+	err := c.do("GET", "/v1/checkout/sessions/"+checkoutID, form, "", &session)
+
+	return session, err
+}
+
+// paymentStatus converts a Checkout Session into a provider independent state
+func (s checkoutSession) paymentStatus() payment.Status {
+	status := payment.Status{
+		CheckoutID:     s.ID,
+		ProviderStatus: s.Status,
+		State:          payment.StatePending,
+		Amount:         pricing.NewMoneyFromMinor(s.AmountTotal, s.Currency),
+	}
+
+	if s.Status == "expired" {
+		status.State = payment.StateCancelled
+		return status
+	}
+	if s.PaymentIntent == nil {
+		return status
+	}
+
+	status.ProviderStatus = s.PaymentIntent.Status
+	switch s.PaymentIntent.Status {
+	case "requires_capture":
+		status.State = payment.StateAuthorized
+		status.AuthorizationID = s.PaymentIntent.ID
+	case "processing":
+		status.State = payment.StateProcessing
+	case "succeeded":
+		status.State = payment.StateCaptured
+		status.CaptureID = s.PaymentIntent.ID
+	case "canceled":
+		status.State = payment.StateCancelled
+	}
+
+	return status
+}
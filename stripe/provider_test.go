@@ -0,0 +1,41 @@
+package stripe
+
+import (
+	"testing"
+
+	"github.com/OneKonsole/web-service-billing/payment"
+)
+
+func TestPaymentStatus(t *testing.T) {
+	tests := []struct {
+		name          string
+		sessionStatus string
+		intentStatus  string // No PaymentIntent if empty
+		want          payment.State
+	}{
+		{name: "not paid yet", sessionStatus: "open", want: payment.StatePending},
+		{name: "session expired", sessionStatus: "expired", want: payment.StateCancelled},
+		{name: "card authorized", sessionStatus: "complete", intentStatus: "requires_capture", want: payment.StateAuthorized},
+		{name: "SEPA debit processing", sessionStatus: "complete", intentStatus: "processing", want: payment.StateProcessing},
+		{name: "paid", sessionStatus: "complete", intentStatus: "succeeded", want: payment.StateCaptured},
+		{name: "SEPA debit failed", sessionStatus: "complete", intentStatus: "requires_payment_method", want: payment.StatePending},
+		{name: "cancelled", sessionStatus: "complete", intentStatus: "canceled", want: payment.StateCancelled},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			session := checkoutSession{ID: "cs_1", Status: test.sessionStatus, AmountTotal: 1200, Currency: "eur"}
+			if test.intentStatus != "" {
+				session.PaymentIntent = &paymentIntent{ID: "pi_1", Status: test.intentStatus}
+			}
+
+			status := session.paymentStatus()
+			if status.State != test.want {
+				t.Errorf("State = %s, want %s", status.State, test.want)
+			}
+			if status.Amount.MinorAmount() != 1200 || status.Amount.Currency != "EUR" {
+				t.Errorf("Amount = %s %s, want 12.00 EUR", status.Amount, status.Amount.Currency)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	helpers "github.com/OneKonsole/web-service-billing/helpers"
+	paypalOrder "github.com/OneKonsole/web-service-billing/paypal"
+	"github.com/OneKonsole/web-service-billing/pricing"
+)
+
+// orderDetailsRules holds the validation rules of order_details.
+// The tags of the order model can not be used as is: required_with
+// must name a struct field, and empty storages are allowed.
+// Storages are limited to 1000 GB.
+type orderDetailsRules struct {
+	UserID            string `json:"user_id" validate:"required,isuuid"`
+	ClusterName       string `json:"cluster_name" validate:"required,max=63,isvalidclustername,startswithalphanum,endwithalphanum"`
+	HasMonitoring     bool   `json:"has_monitoring"`
+	ImageStorage      int    `json:"images_storage" validate:"min=0,max=1000"`
+	MonitoringStorage int    `json:"monitoring_storage" validate:"required_with=HasMonitoring,min=0,max=1000"`
+}
+
+// orderInfosRules holds the validation rules of /order/create and /order/quote bodies
+type orderInfosRules struct {
+	Order        orderDetailsRules `json:"order_details"`
+	CurrencyCode string            `json:"currency" validate:"omitempty,len=3,alpha"`
+	Country      string            `json:"country" validate:"required,len=2,alpha"`
+	VATNumber    string            `json:"vat_number" validate:"max=20"`
+	CouponCode   string            `json:"coupon_code" validate:"max=64"`
+	Provider     string            `json:"provider" validate:"omitempty,oneof=paypal stripe"`
+}
+
+// approveOrderRules holds the validation rules of /order/approve bodies
+type approveOrderRules struct {
+	OrderID string `json:"order_id" validate:"required,max=255,excludesall=/?#%"` // Used in the provider URLs
+}
+
+// listOrdersRules holds the validation rules of /orders query parameters
+type listOrdersRules struct {
+	UserID   string   `json:"user_id" validate:"omitempty,isuuid"`
+	Statuses []string `json:"status" validate:"dive,oneof=CREATED APPROVED AUTHORIZED CAPTURED PROVISIONING_REQUESTED PROVISIONED CANCELLED EXPIRED FAILED PARTIALLY_REFUNDED REFUNDED"`
+	Cursor   string   `json:"cursor" validate:"max=512"`
+	Limit    int      `json:"limit" validate:"min=1,max=100"`
+}
+
+// Orders per page of /orders when no limit is given
+const defaultOrdersLimit = 20
+
+// ===========================================================================================================
+// Checks an order requested by a client before pricing it
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	orderInfos (*paypalOrder.PaypalOrderInfos) : Order requested by the client
+//
+// Returns:
+//
+//	([]helpers.FieldError) : Invalid fields, empty if the order is valid
+//
+// ===========================================================================================================
+func (a *App) validateOrderInfos(orderInfos *paypalOrder.PaypalOrderInfos) []helpers.FieldError {
+	order := orderInfos.Order
+	rules := orderInfosRules{
+		Order: orderDetailsRules{
+			UserID:            order.UserID,
+			ClusterName:       order.ClusterName,
+			HasMonitoring:     order.HasMonitoring,
+			ImageStorage:      order.ImageStorage,
+			MonitoringStorage: order.MonitoringStorage,
+		},
+		CurrencyCode: orderInfos.CurrencyCode,
+		Country:      orderInfos.Country,
+		VATNumber:    orderInfos.VATNumber,
+		CouponCode:   orderInfos.CouponCode,
+		Provider:     orderInfos.Provider,
+	}
+
+	fieldErrors := helpers.FieldErrors(a.Validator.Struct(rules))
+
+	// Supported currencies depend on the current catalog
+	if orderInfos.CurrencyCode != "" {
+		_, err := a.Prices.Current().ForCurrency(orderInfos.CurrencyCode)
+		if errors.Is(err, pricing.ErrUnsupportedCurrency) {
+			fieldErrors = append(fieldErrors, helpers.FieldError{
+				Field:   "currency",
+				Rule:    "supported",
+				Message: err.Error(),
+			})
+		}
+	}
+
+	return fieldErrors
+}
+
+// ===========================================================================================================
+// Checks an order approval sent by a client
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	orderID (string) : Checkout ID sent by the client
+//
+// Returns:
+//
+//	([]helpers.FieldError) : Invalid fields, empty if the approval is valid
+//
+// ===========================================================================================================
+func (a *App) validateApproval(orderID string) []helpers.FieldError {
+	return helpers.FieldErrors(a.Validator.Struct(approveOrderRules{OrderID: orderID}))
+}
+
+// ===========================================================================================================
+// Reads the filter of an order listing from the /orders query parameters.
+// Statuses can be repeated or separated by commas, dates are RFC 3339 dates or days (2006-01-02).
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	query (url.Values) : Query parameters sent by the client
+//
+// Returns:
+//
+//	(paypalOrder.OrderFilter) : Orders to list
+//	([]helpers.FieldError) : Invalid parameters, empty if the filter is valid
+//
+// ===========================================================================================================
+func (a *App) parseOrderFilter(query url.Values) (paypalOrder.OrderFilter, []helpers.FieldError) {
+	var fieldErrors []helpers.FieldError
+
+	rules := listOrdersRules{
+		UserID: query.Get("user_id"),
+		Cursor: query.Get("cursor"),
+		Limit:  defaultOrdersLimit,
+	}
+	for _, statuses := range query["status"] {
+		rules.Statuses = append(rules.Statuses, strings.Split(statuses, ",")...)
+	}
+	if limit := query.Get("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil {
+			fieldErrors = append(fieldErrors, helpers.FieldError{Field: "limit", Rule: "numeric", Message: "must be a number"})
+		} else {
+			rules.Limit = parsed
+		}
+	}
+	fieldErrors = append(fieldErrors, helpers.FieldErrors(a.Validator.Struct(rules))...)
+
+	filter := paypalOrder.OrderFilter{UserID: rules.UserID, Cursor: rules.Cursor, Limit: rules.Limit}
+	for _, status := range rules.Statuses {
+		filter.Statuses = append(filter.Statuses, paypalOrder.OrderStatus(status))
+	}
+	var fieldError *helpers.FieldError
+	if filter.From, fieldError = dateParameter(query, "from"); fieldError != nil {
+		fieldErrors = append(fieldErrors, *fieldError)
+	}
+	if filter.To, fieldError = dateParameter(query, "to"); fieldError != nil {
+		fieldErrors = append(fieldErrors, *fieldError)
+	}
+
+	return filter, fieldErrors
+}
+
+// dateParameter reads a RFC 3339 date or a day (midnight UTC) from the query, zero if absent
+func dateParameter(query url.Values, name string) (time.Time, *helpers.FieldError) {
+	value := query.Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if date, err := time.Parse(time.RFC3339, value); err == nil {
+		return date, nil
+	}
+	if date, err := time.Parse(time.DateOnly, value); err == nil {
+		return date, nil
+	}
+
+	return time.Time{}, &helpers.FieldError{
+		Field:   name,
+		Rule:    "date",
+		Message: "must be a RFC 3339 date (2006-01-02T15:04:05Z) or a day (2006-01-02)",
+	}
+}